@@ -1,19 +1,36 @@
-package interrogate
+package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/stability-ai/stability-sdk-go/metadata"
+	"github.com/stability-ai/stability-sdk-go/stability_image"
 	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
 	"io/ioutil"
 	"os"
 )
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: interrogate <file>")
+	reproduce := flag.Bool("reproduce", false,
+		"build a request that recreates the image")
+	keepArtifacts := flag.Bool("keep-artifacts", false,
+		"re-attach embedded artifacts when reproducing")
+	seed := flag.Int64("seed", -1, "override the seed when reproducing")
+	samples := flag.Uint64("samples", 0,
+		"override the number of samples when reproducing")
+	width := flag.Uint64("width", 0, "override the width when reproducing")
+	height := flag.Uint64("height", 0,
+		"override the height when reproducing")
+	output := flag.String("o", "",
+		"write the binary request to this file when reproducing")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: interrogate [flags] <file>")
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	filepath := os.Args[1]
+	filepath := flag.Arg(0)
 	contents, err := ioutil.ReadFile(filepath)
 	if err != nil {
 		fmt.Println(err)
@@ -23,7 +40,47 @@ func main() {
 	if decodeErr != nil {
 		fmt.Println(fmt.Sprintf("WARNING: %v", decodeErr))
 	}
+	for _, analysis := range metadata.AnalyzeRequestPrompts(rq) {
+		if warning := analysis.Warning(); warning != "" {
+			fmt.Println(fmt.Sprintf("WARNING: %s", warning))
+		}
+	}
+	if *reproduce {
+		opts := metadata.NewReproduceOpts()
+		opts.KeepArtifacts = *keepArtifacts
+		if *seed >= 0 {
+			opts.Seeds = []uint32{uint32(*seed)}
+		}
+		opts.Samples = *samples
+		opts.Width = *width
+		opts.Height = *height
+		aspects := stability_image.NewAspectRatios(
+			stability_image.MaxPixels,
+			stability_image.DimensionStep,
+			stability_image.MinDimension,
+			stability_image.MaxDimension)
+		opts.AspectRatios = &aspects
+		var buildErr error
+		if rq, buildErr = metadata.BuildReproductionRequest(rq,
+			opts); buildErr != nil {
+			fmt.Println(buildErr)
+			os.Exit(1)
+		}
+		if *output != "" {
+			encoded, marshalErr := proto.Marshal(rq)
+			if marshalErr != nil {
+				fmt.Println(marshalErr)
+				os.Exit(1)
+			}
+			if writeErr := ioutil.WriteFile(*output, encoded,
+				0644); writeErr != nil {
+				fmt.Println(writeErr)
+				os.Exit(1)
+			}
+		}
+	}
 	metadata.RemoveBinaryData(rq)
 	t := prototext.Format(rq)
 	fmt.Println(t)
+	fmt.Println(fmt.Sprintf("prompt: %s", metadata.FormatRequestPrompt(rq)))
 }
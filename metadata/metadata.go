@@ -3,7 +3,6 @@ package metadata
 import (
 	"errors"
 	"fmt"
-	"strings"
 
 	"github.com/dsoprea/go-exif"
 	"github.com/nofeaturesonlybugs/z85"
@@ -19,17 +18,22 @@ func init() {
 	clipEncoder = gpt_bpe.NewCLIPEncoder()
 }
 
-// decodePbTokens decodes the given `generation.Tokens` into a string. It
-// assumes that the tokens are encoded using CLIP.
-func decodePbTokens(pbTokens *generation.Tokens) string {
-	tokens := make(gpt_bpe.Tokens, 0, len(pbTokens.Tokens))
+// decodePbTokens decodes the given `generation.Tokens` into a string, using
+// the tokenizer named by the tokens or associated with `engineId`. An error
+// wrapping `ErrUnknownTokenizer` is returned if no decoder is registered for
+// that tokenizer.
+func decodePbTokens(pbTokens *generation.Tokens, engineId string) (
+	string, error) {
+	tokenizerId := TokenizerIdFor(pbTokens, engineId)
+	decoder, lookupErr := LookupTokenizer(tokenizerId)
+	if lookupErr != nil {
+		return "", lookupErr
+	}
+	ids := make([]uint32, 0, len(pbTokens.Tokens))
 	for _, pbToken := range pbTokens.Tokens {
-		tokens = append(tokens, (gpt_bpe.Token)(pbToken.Id))
+		ids = append(ids, pbToken.Id)
 	}
-	decoded := clipEncoder.Decode(&tokens)
-	trimmedLeft := strings.TrimPrefix(decoded, "<|startoftext|>")
-	trimmedRight := strings.TrimSuffix(trimmedLeft, "<|endoftext|>")
-	return trimmedRight
+	return decoder.Decode(ids)
 }
 
 // EmbedRequest takes the `rq` Request and encode it into the `img`'s
@@ -90,7 +94,7 @@ func DecodeRequest(img *[]byte) (*generation.Request, error) {
 		return nil, errors.New("no exif entries found")
 	}
 	request := &generation.Request{}
-	var unmarshalErr error
+	var unmarshalErr, decodeErr error
 	if hist, ok := exifEntries["ImageHistory"]; ok {
 		// Decode the z85 encoded data into a byte array
 		var z85str string
@@ -105,12 +109,19 @@ func DecodeRequest(img *[]byte) (*generation.Request, error) {
 		}
 		// Try to decode the protobuf
 		unmarshalErr = tryProtobufDecode(&paddedBs, request)
-		// Decode tokens into string.
+		// Decode tokens into string. Prompts whose tokenizer is unknown
+		// are left as tokens.
 		for _, prompt := range request.GetPrompt() {
 			if text := prompt.GetText(); text == "" {
 				if tokens := prompt.GetTokens(); tokens != nil {
+					text, tokensErr := decodePbTokens(tokens,
+						request.GetEngineId())
+					if tokensErr != nil {
+						decodeErr = errors.Join(decodeErr, tokensErr)
+						continue
+					}
 					prompt.Prompt = &generation.Prompt_Text{
-						Text: decodePbTokens(tokens),
+						Text: text,
 					}
 				}
 			}
@@ -120,7 +131,7 @@ func DecodeRequest(img *[]byte) (*generation.Request, error) {
 		unmarshalErr = fmt.Errorf("error decoding protobuf: %v",
 			unmarshalErr)
 	}
-	return request, unmarshalErr
+	return request, errors.Join(unmarshalErr, decodeErr)
 }
 
 func RequantizePreserveMetadata(png *[]byte) (qzd *[]byte, err error) {
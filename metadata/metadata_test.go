@@ -1,9 +1,14 @@
 package metadata
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/stability-ai/api-interfaces/gooseai/generation"
+	"github.com/stability-ai/stability-sdk-go/stability_image"
 )
 
 var testBinImage *[]byte
@@ -41,3 +46,139 @@ func TestMetadata(t *testing.T) {
 		t.Error("Image height is not 512")
 	}
 }
+
+func TestBuildReproductionRequest(t *testing.T) {
+	aspects := stability_image.NewAspectRatios(1048576, 64,
+		256, 1536)
+	opts := NewReproduceOpts()
+	opts.Seeds = []uint32{42}
+	opts.Samples = 2
+	opts.Width = 1024
+	opts.Height = 1024
+	opts.AspectRatios = &aspects
+	request, err := ReproductionRequest(testBinImage, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.GetRequestId() != "" {
+		t.Error("request id was not stripped")
+	}
+	for _, prompt := range request.GetPrompt() {
+		if prompt.GetArtifact() != nil {
+			t.Error("artifact prompt was not removed")
+		}
+		if prompt.GetTokens() != nil {
+			t.Error("token prompt was not decoded")
+		}
+	}
+	imageParams := request.GetImage()
+	if seeds := imageParams.GetSeed(); len(seeds) != 1 || seeds[0] != 42 {
+		t.Error("seed was not overridden", seeds)
+	}
+	if imageParams.GetSamples() != 2 {
+		t.Error("samples was not overridden")
+	}
+	if imageParams.GetWidth() != 1024 || imageParams.GetHeight() != 1024 {
+		t.Error("dimensions were not overridden")
+	}
+
+	opts.Width = 1000
+	if _, err = ReproductionRequest(testBinImage, opts); err == nil {
+		t.Error("expected unsupported dimensions to be rejected")
+	}
+}
+
+func TestReproductionRequestArtifacts(t *testing.T) {
+	rq := &generation.Request{
+		RequestId: "original",
+		Prompt: []*generation.Prompt{
+			{Prompt: &generation.Prompt_Text{Text: "a galaxy"}},
+			{Prompt: &generation.Prompt_Artifact{
+				Artifact: &generation.Artifact{
+					Id:   7,
+					Uuid: "0d5ad1d5-4c0b-4f6e-9b1e-2f3a4b5c6d7e",
+					Type: generation.ArtifactType_ARTIFACT_IMAGE,
+					Data: &generation.Artifact_Binary{Binary: []byte{1}},
+				},
+			}},
+		},
+		Params: &generation.Request_Image{
+			Image: &generation.ImageParameters{},
+		},
+	}
+	opts := NewReproduceOpts()
+	opts.KeepArtifacts = true
+	reproduced, err := BuildReproductionRequest(rq, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompts := reproduced.GetPrompt()
+	if len(prompts) != 2 {
+		t.Fatal("expected the artifact to be kept, got", len(prompts),
+			"prompts")
+	}
+	artifact := prompts[1].GetArtifact()
+	if artifact.GetId() != 0 || artifact.GetUuid() != "" {
+		t.Error("artifact ids were not cleared", artifact)
+	}
+	if rq.Prompt[1].GetArtifact().GetId() != 7 {
+		t.Error("the original request was modified")
+	}
+}
+
+func TestTokenizerRegistry(t *testing.T) {
+	tokenizerId := "openclip-vit-bigg-14"
+	if id := TokenizerIdFor(&generation.Tokens{},
+		"stable-diffusion-xl-1024-v1-0"); id != tokenizerId {
+		t.Error("unexpected tokenizer for SDXL engine:", id)
+	}
+	if id := TokenizerIdFor(&generation.Tokens{TokenizerId: &tokenizerId},
+		"stable-diffusion-v1-5"); id != tokenizerId {
+		t.Error("tokens tokenizer id did not take precedence:", id)
+	}
+	if id := TokenizerIdFor(&generation.Tokens{},
+		"some-new-engine"); id != DefaultTokenizerId {
+		t.Error("unexpected tokenizer for unknown engine:", id)
+	}
+	if id := TokenizerIdFor(&generation.Tokens{},
+		"sd3-large"); id != tokenizerId {
+		t.Error("unexpected tokenizer for SD3 engine:", id)
+	}
+	t5 := "t5-v1_1-xxl"
+	_, err := decodePbTokens(&generation.Tokens{
+		Tokens:      []*generation.Token{{Id: 1}},
+		TokenizerId: &t5,
+	}, "sd3-large")
+	if !errors.Is(err, ErrUnknownTokenizer) {
+		t.Error("expected an unknown tokenizer error, got", err)
+	}
+}
+
+func TestAnalyzePrompt(t *testing.T) {
+	analysis := AnalyzePrompt("a photo of a cat")
+	if analysis.Truncated() || analysis.Warning() != "" {
+		t.Error("short prompt should not be truncated")
+	}
+	if analysis.TokenCount != len(analysis.Tokens)+2 {
+		t.Error("token count should include start and end tokens")
+	}
+
+	long := strings.TrimSpace(strings.Repeat("cat ", 100))
+	analysis = AnalyzePrompt(long)
+	if !analysis.Truncated() {
+		t.Error("long prompt should be truncated")
+	}
+	if truncated := analysis.TruncatedWords(); len(truncated) != 25 {
+		t.Error("expected 25 truncated words, got", len(truncated))
+	}
+	pbTokens := analysis.PbTokens()
+	if len(pbTokens.GetTokens()) != len(analysis.Tokens) {
+		t.Error("token form does not match the analysis")
+	}
+	if pbTokens.GetText() != long {
+		t.Error("prompt text was not set")
+	}
+	if pbTokens.GetTokens()[0].GetText() != "cat" {
+		t.Error("token text was not set")
+	}
+}
@@ -0,0 +1,129 @@
+package metadata
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stability-ai/api-interfaces/gooseai/generation"
+	"github.com/wbrown/gpt_bpe"
+	"google.golang.org/protobuf/proto"
+)
+
+// ClipContextLength is the number of tokens the CLIP text encoder attends to,
+// including the start and end of text tokens. Anything past it is truncated.
+const ClipContextLength = 77
+
+// PromptWord is a whitespace delimited word of a prompt and the CLIP tokens
+// it encodes to.
+type PromptWord struct {
+	Word      string
+	Tokens    []uint32
+	Truncated bool
+}
+
+// PromptAnalysis describes how a text prompt is tokenized by CLIP.
+type PromptAnalysis struct {
+	Text string
+	// Tokens holds the prompt's tokens, without the start and end of text
+	// tokens.
+	Tokens []uint32
+	Words  []PromptWord
+	// TokenCount includes the start and end of text tokens, so that it can
+	// be compared against ContextLength directly.
+	TokenCount    int
+	ContextLength int
+}
+
+// encodeClipWord encodes a single word with CLIP, without the start and end
+// of text tokens.
+func encodeClipWord(word string) []uint32 {
+	encoded := clipEncoder.Encode(&word)
+	ids := make([]uint32, 0, len(*encoded))
+	for _, token := range *encoded {
+		if token == clipEncoder.BosToken || token == clipEncoder.EosToken {
+			continue
+		}
+		ids = append(ids, uint32(token))
+	}
+	return ids
+}
+
+// AnalyzePrompt tokenizes `text` with CLIP and determines which of its words
+// fall past the context length. CLIP splits words on whitespace before
+// applying BPE, so each word is encoded on its own.
+func AnalyzePrompt(text string) *PromptAnalysis {
+	analysis := &PromptAnalysis{
+		Text:          text,
+		ContextLength: ClipContextLength,
+	}
+	// Reserve room for the start and end of text tokens.
+	available := analysis.ContextLength - 2
+	for _, word := range strings.Fields(text) {
+		ids := encodeClipWord(word)
+		analysis.Words = append(analysis.Words, PromptWord{
+			Word:      word,
+			Tokens:    ids,
+			Truncated: len(analysis.Tokens)+len(ids) > available,
+		})
+		analysis.Tokens = append(analysis.Tokens, ids...)
+	}
+	analysis.TokenCount = len(analysis.Tokens) + 2
+	return analysis
+}
+
+// Truncated returns true if the prompt does not fit in the context length.
+func (pa *PromptAnalysis) Truncated() bool {
+	return pa.TokenCount > pa.ContextLength
+}
+
+// TruncatedWords returns the words that are partially or entirely cut off.
+func (pa *PromptAnalysis) TruncatedWords() []string {
+	truncated := make([]string, 0)
+	for _, word := range pa.Words {
+		if word.Truncated {
+			truncated = append(truncated, word.Word)
+		}
+	}
+	return truncated
+}
+
+// Warning returns a human readable truncation warning, or an empty string if
+// the prompt fits in the context length.
+func (pa *PromptAnalysis) Warning() string {
+	if !pa.Truncated() {
+		return ""
+	}
+	return fmt.Sprintf("prompt is %d tokens, %d over the %d token limit; "+
+		"truncated: %s", pa.TokenCount, pa.TokenCount-pa.ContextLength,
+		pa.ContextLength, strings.Join(pa.TruncatedWords(), " "))
+}
+
+// PbTokens returns the prompt in its `generation.Tokens` form, carrying the
+// prompt's text alongside its tokens. Each token also carries the text it
+// decodes to.
+func (pa *PromptAnalysis) PbTokens() *generation.Tokens {
+	pbTokens := &generation.Tokens{
+		Text:        proto.String(pa.Text),
+		Tokens:      make([]*generation.Token, 0, len(pa.Tokens)),
+		TokenizerId: proto.String(DefaultTokenizerId),
+	}
+	for _, id := range pa.Tokens {
+		token := gpt_bpe.Tokens{gpt_bpe.Token(id)}
+		pbTokens.Tokens = append(pbTokens.Tokens, &generation.Token{
+			Text: proto.String(strings.TrimSpace(clipEncoder.Decode(&token))),
+			Id:   id,
+		})
+	}
+	return pbTokens
+}
+
+// AnalyzeRequestPrompts analyzes every text prompt of `rq`, in order.
+func AnalyzeRequestPrompts(rq *generation.Request) []*PromptAnalysis {
+	analyses := make([]*PromptAnalysis, 0)
+	for _, prompt := range rq.GetPrompt() {
+		if text := prompt.GetText(); text != "" {
+			analyses = append(analyses, AnalyzePrompt(text))
+		}
+	}
+	return analyses
+}
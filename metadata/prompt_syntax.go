@@ -0,0 +1,278 @@
+package metadata
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/stability-ai/api-interfaces/gooseai/generation"
+	"google.golang.org/protobuf/proto"
+)
+
+// Weighted prompt syntax
+//
+// ParseWeightedPrompt accepts the following grammar, in EBNF:
+//
+//	prompts  = segment { "|" segment } .
+//	segment  = { text | group } [ ":" weight ] .
+//	group    = "(" text [ ":" weight ] ")"
+//	         | "[" text [ ":" weight ] "]" .
+//	text     = { char | "\" any } .
+//	weight   = float .
+//
+// Every segment yields one prompt holding its text outside of groups, joined
+// by single spaces, and one prompt for each of its groups. Prompts default to
+// a weight of 1. A "(" group emphasizes its text and defaults to a weight of
+// 1.1, while a "[" group makes its text a negative prompt, defaulting to a
+// weight of -1; weights given for "[" groups are always negative.
+//
+// A ":" is only read as a weight separator when the remainder of its segment
+// or group is a finite number, otherwise it is part of the text. Any of the
+// characters `\()[]|:` can be escaped with a backslash. Text is trimmed of
+// surrounding whitespace, and empty segments are skipped. So:
+//
+//	a castle (dramatic lighting:1.3) [blurry:-0.8]
+//
+// yields "a castle" at 1, "dramatic lighting" at 1.3 and "blurry" at -0.8,
+// and `cat | dog:0.5` yields "cat" at 1 and "dog" at 0.5.
+
+const (
+	EmphasisWeight     float32 = 1.1
+	DeemphasisWeight   float32 = -1
+	promptSpecialChars         = `\()[]|:`
+)
+
+// PromptSyntaxError reports a malformed weighted prompt.
+type PromptSyntaxError struct {
+	// Position is the index of the offending character, in runes.
+	Position int
+	Msg      string
+}
+
+func (e *PromptSyntaxError) Error() string {
+	return fmt.Sprintf("prompt syntax error at position %d: %s",
+		e.Position, e.Msg)
+}
+
+type promptParser struct {
+	src []rune
+	pos int
+}
+
+func (p *promptParser) errorf(format string, args ...interface{}) error {
+	return &PromptSyntaxError{Position: p.pos, Msg: fmt.Sprintf(format,
+		args...)}
+}
+
+// parseWeight tries to read the weight following a ":" at the current
+// position, up to `end`. If successful the parser is advanced to `end`.
+func (p *promptParser) parseWeight(end func(r rune) bool) (
+	weight float32, ok bool) {
+	stop := p.pos + 1
+	for stop < len(p.src) && !end(p.src[stop]) {
+		stop++
+	}
+	parsed, err := strconv.ParseFloat(
+		strings.TrimSpace(string(p.src[p.pos+1:stop])), 32)
+	if err != nil || math.IsInf(parsed, 0) || math.IsNaN(parsed) {
+		return 0, false
+	}
+	p.pos = stop
+	return float32(parsed), true
+}
+
+// parseGroup parses a group, starting at its opening bracket.
+func (p *promptParser) parseGroup() (*generation.Prompt, error) {
+	open := p.src[p.pos]
+	closing, weight := ')', EmphasisWeight
+	if open == '[' {
+		closing, weight = ']', DeemphasisWeight
+	}
+	start := p.pos
+	p.pos++
+	var text strings.Builder
+	for {
+		if p.pos >= len(p.src) {
+			p.pos = start
+			return nil, p.errorf("unclosed %q", open)
+		}
+		switch r := p.src[p.pos]; r {
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				return nil, p.errorf("trailing escape")
+			}
+			p.pos++
+			text.WriteRune(p.src[p.pos])
+		case '(', '[', '|':
+			return nil, p.errorf("unexpected %q in group", r)
+		case ')', ']':
+			if r != closing {
+				return nil, p.errorf("mismatched %q", r)
+			}
+			p.pos++
+			trimmed := strings.TrimSpace(text.String())
+			if trimmed == "" {
+				p.pos = start
+				return nil, p.errorf("empty group")
+			}
+			return newWeightedPrompt(trimmed, weight), nil
+		case ':':
+			parsed, ok := p.parseWeight(func(r rune) bool {
+				return r == closing
+			})
+			if !ok {
+				text.WriteRune(r)
+				break
+			}
+			if open == '[' {
+				parsed = -float32(math.Abs(float64(parsed)))
+			}
+			weight = parsed
+			continue
+		default:
+			text.WriteRune(r)
+		}
+		p.pos++
+	}
+}
+
+// parseSegment parses the prompts of a segment, up to the next "|".
+func (p *promptParser) parseSegment() ([]*generation.Prompt, error) {
+	var (
+		pieces []string
+		piece  strings.Builder
+		groups []*generation.Prompt
+		weight = float32(1)
+	)
+	for p.pos < len(p.src) && p.src[p.pos] != '|' {
+		switch r := p.src[p.pos]; r {
+		case '\\':
+			if p.pos+1 >= len(p.src) {
+				return nil, p.errorf("trailing escape")
+			}
+			p.pos++
+			piece.WriteRune(p.src[p.pos])
+		case '(', '[':
+			group, groupErr := p.parseGroup()
+			if groupErr != nil {
+				return nil, groupErr
+			}
+			groups = append(groups, group)
+			pieces = append(pieces, piece.String())
+			piece.Reset()
+			continue
+		case ')', ']':
+			return nil, p.errorf("unmatched %q", r)
+		case ':':
+			start := p.pos
+			parsed, ok := p.parseWeight(func(r rune) bool {
+				return r == '|'
+			})
+			if !ok {
+				piece.WriteRune(r)
+				break
+			}
+			if len(pieces) == 0 && strings.TrimSpace(piece.String()) == "" {
+				p.pos = start
+				return nil, p.errorf("weight without text")
+			}
+			weight = parsed
+			continue
+		default:
+			piece.WriteRune(r)
+		}
+		p.pos++
+	}
+	pieces = append(pieces, piece.String())
+	texts := make([]string, 0, len(pieces))
+	for _, text := range pieces {
+		if trimmed := strings.TrimSpace(text); trimmed != "" {
+			texts = append(texts, trimmed)
+		}
+	}
+	prompts := make([]*generation.Prompt, 0, len(groups)+1)
+	if len(texts) > 0 {
+		prompts = append(prompts, newWeightedPrompt(
+			strings.Join(texts, " "), weight))
+	} else if weight != 1 {
+		return nil, p.errorf("weight without text")
+	}
+	return append(prompts, groups...), nil
+}
+
+func newWeightedPrompt(text string, weight float32) *generation.Prompt {
+	return &generation.Prompt{
+		Parameters: &generation.PromptParameters{
+			Weight: proto.Float32(weight),
+		},
+		Prompt: &generation.Prompt_Text{Text: text},
+	}
+}
+
+// ParseWeightedPrompt parses `s` in the weighted prompt syntax into a list
+// of weighted text prompts. A *PromptSyntaxError is returned for malformed
+// input.
+func ParseWeightedPrompt(s string) ([]*generation.Prompt, error) {
+	p := &promptParser{src: []rune(s)}
+	prompts := make([]*generation.Prompt, 0)
+	for {
+		segment, segmentErr := p.parseSegment()
+		if segmentErr != nil {
+			return nil, segmentErr
+		}
+		prompts = append(prompts, segment...)
+		if p.pos >= len(p.src) {
+			return prompts, nil
+		}
+		p.pos++ // Skip the "|".
+	}
+}
+
+// escapePromptText escapes the characters that are special to the weighted
+// prompt syntax.
+func escapePromptText(text string) string {
+	var escaped strings.Builder
+	for _, r := range strings.TrimSpace(text) {
+		if strings.ContainsRune(promptSpecialChars, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// FormatWeightedPrompt formats the text prompts in `prompts` in the weighted
+// prompt syntax, such that parsing the result gives the same prompts back.
+// Token and artifact prompts are skipped.
+func FormatWeightedPrompt(prompts []*generation.Prompt) string {
+	segments := make([]string, 0, len(prompts))
+	for _, prompt := range prompts {
+		text := prompt.GetText()
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		weight := float32(1)
+		if params := prompt.GetParameters(); params != nil &&
+			params.Weight != nil {
+			weight = params.GetWeight()
+		}
+		escaped := escapePromptText(text)
+		formattedWeight := strconv.FormatFloat(float64(weight), 'g', -1, 32)
+		switch {
+		case weight == 1:
+			segments = append(segments, escaped)
+		case weight < 0:
+			segments = append(segments, "["+escaped+":"+formattedWeight+"]")
+		default:
+			segments = append(segments, "("+escaped+":"+formattedWeight+")")
+		}
+	}
+	return strings.Join(segments, " | ")
+}
+
+// FormatRequestPrompt formats the text prompts of `rq`, such as one returned
+// by `DecodeRequest`, in the weighted prompt syntax.
+func FormatRequestPrompt(rq *generation.Request) string {
+	return FormatWeightedPrompt(rq.GetPrompt())
+}
@@ -0,0 +1,109 @@
+package metadata
+
+import (
+	"testing"
+
+	"github.com/stability-ai/api-interfaces/gooseai/generation"
+)
+
+type weightedPromptTest struct {
+	Text   string
+	Weight float32
+}
+
+var ParseWeightedPromptTests = map[string][]weightedPromptTest{
+	"a castle (dramatic lighting:1.3) [blurry:-0.8]": {
+		{Text: "a castle", Weight: 1},
+		{Text: "dramatic lighting", Weight: 1.3},
+		{Text: "blurry", Weight: -0.8},
+	},
+	"cat | dog:0.5": {
+		{Text: "cat", Weight: 1},
+		{Text: "dog", Weight: 0.5},
+	},
+	"(emphasis) middle [negative] end": {
+		{Text: "middle end", Weight: 1},
+		{Text: "emphasis", Weight: EmphasisWeight},
+		{Text: "negative", Weight: DeemphasisWeight},
+	},
+	"style: cinematic | a \\(literal\\) \\| pipe": {
+		{Text: "style: cinematic", Weight: 1},
+		{Text: "a (literal) | pipe", Weight: 1},
+	},
+	"[noise:0.5] || ": {
+		{Text: "noise", Weight: -0.5},
+	},
+}
+
+var ParseWeightedPromptErrors = []string{
+	"(unclosed",
+	"unopened)",
+	"(nested (group))",
+	"(mismatched]",
+	"()",
+	":0.5",
+	"(weight):2",
+	"trailing \\",
+}
+
+func comparePrompts(t *testing.T, input string,
+	prompts []*generation.Prompt, expected []weightedPromptTest) {
+	if len(prompts) != len(expected) {
+		t.Errorf("%q: expected %d prompts, got %d", input, len(expected),
+			len(prompts))
+		return
+	}
+	for idx, prompt := range prompts {
+		if prompt.GetText() != expected[idx].Text ||
+			prompt.GetParameters().GetWeight() != expected[idx].Weight {
+			t.Errorf("%q: prompt %d is %q:%v, expected %q:%v", input, idx,
+				prompt.GetText(), prompt.GetParameters().GetWeight(),
+				expected[idx].Text, expected[idx].Weight)
+		}
+	}
+}
+
+func TestParseWeightedPrompt(t *testing.T) {
+	for input, expected := range ParseWeightedPromptTests {
+		prompts, err := ParseWeightedPrompt(input)
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+			continue
+		}
+		comparePrompts(t, input, prompts, expected)
+	}
+	for _, input := range ParseWeightedPromptErrors {
+		if _, err := ParseWeightedPrompt(input); err == nil {
+			t.Errorf("%q: expected a syntax error", input)
+		}
+	}
+}
+
+func FuzzWeightedPromptRoundTrip(f *testing.F) {
+	for input := range ParseWeightedPromptTests {
+		f.Add(input)
+	}
+	for _, input := range ParseWeightedPromptErrors {
+		f.Add(input)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		prompts, err := ParseWeightedPrompt(input)
+		if err != nil {
+			return
+		}
+		formatted := FormatWeightedPrompt(prompts)
+		reparsed, err := ParseWeightedPrompt(formatted)
+		if err != nil {
+			t.Fatalf("%q formatted as %q does not parse: %v", input,
+				formatted, err)
+		}
+		expected := make([]weightedPromptTest, 0, len(prompts))
+		for _, prompt := range prompts {
+			expected = append(expected, weightedPromptTest{
+				Text:   prompt.GetText(),
+				Weight: prompt.GetParameters().GetWeight(),
+			})
+		}
+		comparePrompts(t, formatted, reparsed, expected)
+	})
+}
@@ -0,0 +1,129 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/stability-ai/api-interfaces/gooseai/generation"
+	"github.com/stability-ai/stability-sdk-go/stability_image"
+	"google.golang.org/protobuf/proto"
+)
+
+// ReproduceOpts controls how a decoded request is turned back into a request
+// that is ready to send. Zero values keep the settings of the original
+// request.
+type ReproduceOpts struct {
+	// KeepArtifacts re-attaches the artifact prompts (init images, masks)
+	// that were embedded with the request, without the ids they were given
+	// when generated. Artifacts without any data are always dropped, as they
+	// cannot be sent.
+	KeepArtifacts bool
+	Seeds         []uint32
+	Samples       uint64
+	Width         uint64
+	Height        uint64
+	// AspectRatios, if set, is used to validate overridden dimensions.
+	AspectRatios *stability_image.AspectRatios
+}
+
+func NewReproduceOpts() *ReproduceOpts {
+	return &ReproduceOpts{}
+}
+
+// hasArtifactData returns true if the artifact still carries a payload.
+func hasArtifactData(artifact *generation.Artifact) bool {
+	switch data := artifact.Data.(type) {
+	case nil:
+		return false
+	case *generation.Artifact_Binary:
+		return len(data.Binary) > 0
+	default:
+		return true
+	}
+}
+
+// BuildReproductionRequest takes a request, typically one returned by
+// `DecodeRequest`, and returns a copy of it that can be sent to recreate
+// the image. The volatile fields, the request's `RequestId` and the `Id` and
+// `Uuid` of kept artifacts, are cleared, token prompts are restored to text
+// and the overrides in `opts` are applied. The original request is not
+// modified.
+func BuildReproductionRequest(
+	rq *generation.Request,
+	opts *ReproduceOpts,
+) (*generation.Request, error) {
+	if rq == nil {
+		return nil, errors.New("no request to reproduce")
+	}
+	if opts == nil {
+		opts = NewReproduceOpts()
+	}
+	reproduced := proto.Clone(rq).(*generation.Request)
+	reproduced.RequestId = ""
+
+	prompts := make([]*generation.Prompt, 0, len(reproduced.Prompt))
+	for _, prompt := range reproduced.Prompt {
+		if artifact := prompt.GetArtifact(); artifact != nil {
+			if !opts.KeepArtifacts || !hasArtifactData(artifact) {
+				continue
+			}
+			artifact.Id = 0
+			artifact.Uuid = ""
+		} else if tokens := prompt.GetTokens(); tokens != nil {
+			text, tokensErr := decodePbTokens(tokens,
+				reproduced.GetEngineId())
+			if tokensErr != nil {
+				return nil, tokensErr
+			}
+			prompt.Prompt = &generation.Prompt_Text{Text: text}
+		}
+		prompts = append(prompts, prompt)
+	}
+	if len(prompts) == 0 {
+		return nil, errors.New("request has no prompts to reproduce")
+	}
+	reproduced.Prompt = prompts
+
+	params := reproduced.GetImage()
+	if params == nil {
+		return nil, errors.New("request has no image parameters")
+	}
+	if opts.Seeds != nil {
+		params.Seed = append([]uint32{}, opts.Seeds...)
+	}
+	if opts.Samples != 0 {
+		params.Samples = proto.Uint64(opts.Samples)
+	}
+	if opts.Width != 0 || opts.Height != 0 {
+		width, height := params.GetWidth(), params.GetHeight()
+		if opts.Width != 0 {
+			width = opts.Width
+		}
+		if opts.Height != 0 {
+			height = opts.Height
+		}
+		if opts.AspectRatios != nil {
+			if _, found := opts.AspectRatios.LookupAspect(width,
+				height); !found {
+				return nil, fmt.Errorf(
+					"%dx%d is not a supported aspect ratio", width, height)
+			}
+		}
+		params.Width = proto.Uint64(width)
+		params.Height = proto.Uint64(height)
+	}
+	return reproduced, nil
+}
+
+// ReproductionRequest decodes the request embedded in the PNG `img` and
+// returns a request that recreates it. See `BuildReproductionRequest`.
+func ReproductionRequest(
+	img *[]byte,
+	opts *ReproduceOpts,
+) (*generation.Request, error) {
+	rq, decodeErr := DecodeRequest(img)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	return BuildReproductionRequest(rq, opts)
+}
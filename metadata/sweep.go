@@ -0,0 +1,299 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/stability-ai/api-interfaces/gooseai/generation"
+	"github.com/stability-ai/stability-sdk-go/stability_image"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// SweepExtrasKey is the key of the sweep definition recorded in the
+// `Extras` of a contact sheet's embedded request.
+const SweepExtrasKey = "sweep"
+
+// SweepSetter applies a sweep axis value to a request.
+type SweepSetter func(rq *generation.Request, value string) error
+
+// SweepParameters maps the parameter names that can be swept to their
+// setters.
+var SweepParameters = map[string]SweepSetter{
+	"seed": func(rq *generation.Request, value string) error {
+		seed, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		imageParams(rq).Seed = []uint32{uint32(seed)}
+		return nil
+	},
+	"steps": func(rq *generation.Request, value string) error {
+		steps, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		imageParams(rq).Steps = proto.Uint64(steps)
+		return nil
+	},
+	"cfg_scale": func(rq *generation.Request, value string) error {
+		cfgScale, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return err
+		}
+		params := imageParams(rq)
+		if len(params.Parameters) == 0 {
+			params.Parameters = []*generation.StepParameter{{}}
+		}
+		for _, step := range params.Parameters {
+			if step.Sampler == nil {
+				step.Sampler = &generation.SamplerParameters{}
+			}
+			step.Sampler.CfgScale = proto.Float32(float32(cfgScale))
+		}
+		return nil
+	},
+	"sampler": func(rq *generation.Request, value string) error {
+		name := strings.ToUpper(value)
+		if !strings.HasPrefix(name, "SAMPLER_") {
+			name = "SAMPLER_" + name
+		}
+		sampler, ok := generation.DiffusionSampler_value[name]
+		if !ok {
+			return fmt.Errorf("unknown sampler %q", value)
+		}
+		imageParams(rq).Transform = &generation.TransformType{
+			Type: &generation.TransformType_Diffusion{
+				Diffusion: generation.DiffusionSampler(sampler),
+			},
+		}
+		return nil
+	},
+}
+
+// imageParams returns the image parameters of `rq`, adding them if missing.
+func imageParams(rq *generation.Request) *generation.ImageParameters {
+	if rq.GetImage() == nil {
+		rq.Params = &generation.Request_Image{
+			Image: &generation.ImageParameters{},
+		}
+	}
+	return rq.GetImage()
+}
+
+// SweepAxis is a parameter and the values it is swept over.
+type SweepAxis struct {
+	Parameter string
+	Values    []string
+}
+
+func (a *SweepAxis) label(idx int) string {
+	return fmt.Sprintf("%s=%s", a.Parameter, a.Values[idx])
+}
+
+// Sweep is a one or two dimensional parameter sweep. The `Y` axis is
+// optional.
+type Sweep struct {
+	X SweepAxis
+	Y *SweepAxis
+}
+
+// SweepCell is a single request of a sweep, at the given axis indices.
+type SweepCell struct {
+	X       int
+	Y       int
+	Request *generation.Request
+}
+
+func (s *Sweep) dimensions() (cols int, rows int) {
+	cols, rows = len(s.X.Values), 1
+	if s.Y != nil {
+		rows = len(s.Y.Values)
+	}
+	return cols, rows
+}
+
+func (s *Sweep) validate() error {
+	axes := []*SweepAxis{&s.X}
+	if s.Y != nil {
+		axes = append(axes, s.Y)
+	}
+	for _, axis := range axes {
+		if _, ok := SweepParameters[axis.Parameter]; !ok {
+			return fmt.Errorf("unknown sweep parameter %q", axis.Parameter)
+		}
+		if len(axis.Values) == 0 {
+			return fmt.Errorf("sweep axis %q has no values", axis.Parameter)
+		}
+	}
+	return nil
+}
+
+// Requests returns the cross product of the sweep's axes applied to `base`,
+// in row-major order: `X` varies fastest.
+func (s *Sweep) Requests(base *generation.Request) ([]SweepCell, error) {
+	if validateErr := s.validate(); validateErr != nil {
+		return nil, validateErr
+	}
+	cols, rows := s.dimensions()
+	cells := make([]SweepCell, 0, cols*rows)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			rq := proto.Clone(base).(*generation.Request)
+			if err := SweepParameters[s.X.Parameter](rq,
+				s.X.Values[x]); err != nil {
+				return nil, fmt.Errorf("%s: %w", s.X.label(x), err)
+			}
+			if s.Y != nil {
+				if err := SweepParameters[s.Y.Parameter](rq,
+					s.Y.Values[y]); err != nil {
+					return nil, fmt.Errorf("%s: %w", s.Y.label(y), err)
+				}
+			}
+			cells = append(cells, SweepCell{X: x, Y: y, Request: rq})
+		}
+	}
+	return cells, nil
+}
+
+// structValue returns the sweep definition in a form that can be stored in
+// a request's `Extras`.
+func (s *Sweep) structValue() (*structpb.Value, error) {
+	axisValue := func(axis *SweepAxis) map[string]interface{} {
+		values := make([]interface{}, 0, len(axis.Values))
+		for _, value := range axis.Values {
+			values = append(values, value)
+		}
+		return map[string]interface{}{
+			"parameter": axis.Parameter,
+			"values":    values,
+		}
+	}
+	definition := map[string]interface{}{"x": axisValue(&s.X)}
+	if s.Y != nil {
+		definition["y"] = axisValue(s.Y)
+	}
+	return structpb.NewValue(definition)
+}
+
+const (
+	labelPadding    = 4
+	labelCharWidth  = 7
+	labelLineHeight = 13
+)
+
+func drawLabel(img *image.NRGBA, x int, y int, label string) {
+	drawer := &font.Drawer{
+		Dst:  img,
+		Src:  image.Black,
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y+labelLineHeight-2),
+	}
+	drawer.DrawString(label)
+}
+
+// ContactSheet tiles the sweep's `results`, given in the order returned by
+// `Requests`, into a grid labeled with the axis values. The sheet takes the
+// dimensions of the aspect in `ars` nearest in proportion to the grid, and
+// the request it embeds is `base` with the sweep definition added to its
+// `Extras`.
+func (s *Sweep) ContactSheet(
+	base *generation.Request,
+	results []*[]byte,
+	ars *stability_image.AspectRatios,
+) (*[]byte, error) {
+	if validateErr := s.validate(); validateErr != nil {
+		return nil, validateErr
+	}
+	cols, rows := s.dimensions()
+	if len(results) != cols*rows {
+		return nil, fmt.Errorf("expected %d results, got %d", cols*rows,
+			len(results))
+	}
+	images := make([]image.Image, 0, len(results))
+	for _, result := range results {
+		img, _, _, decodeErr := stability_image.DecodeImage(result)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		images = append(images, img)
+	}
+	if ars == nil {
+		return nil, errors.New("no aspect ratios to size the sheet with")
+	}
+
+	// Lay out the header row and label column around cells the size of
+	// the first result, then lay the grid out again in the table's aspect
+	// nearest to that layout.
+	headerHeight := labelLineHeight + 2*labelPadding
+	labelWidth := 0
+	if s.Y != nil {
+		for idx := range s.Y.Values {
+			width := len(s.Y.label(idx))*labelCharWidth + 2*labelPadding
+			if width > labelWidth {
+				labelWidth = width
+			}
+		}
+	}
+	cellDim := images[0].Bounds().Size()
+	rawWidth := uint64(labelWidth + cols*cellDim.X)
+	rawHeight := uint64(headerHeight + rows*cellDim.Y)
+	aspect, found := ars.NearestRatio(rawWidth, rawHeight)
+	if !found {
+		return nil, errors.New("no aspect ratios to size the sheet with")
+	}
+	sheetWidth, sheetHeight := aspect.WidthPixels, aspect.HeightPixels
+	cellWidth := (int(sheetWidth) - labelWidth) / cols
+	cellHeight := (int(sheetHeight) - headerHeight) / rows
+	if cellWidth <= 0 || cellHeight <= 0 {
+		return nil, errors.New("sweep results are too small to tile")
+	}
+
+	sheet := imaging.New(int(sheetWidth), int(sheetHeight), color.White)
+	for idx, img := range images {
+		x, y := idx%cols, idx/cols
+		fitted := imaging.Fit(img, cellWidth, cellHeight, imaging.Lanczos)
+		fittedDim := fitted.Bounds().Size()
+		sheet = imaging.Paste(sheet, fitted, image.Pt(
+			labelWidth+x*cellWidth+(cellWidth-fittedDim.X)/2,
+			headerHeight+y*cellHeight+(cellHeight-fittedDim.Y)/2))
+	}
+	for x := range s.X.Values {
+		drawLabel(sheet, labelWidth+x*cellWidth+labelPadding, labelPadding,
+			s.X.label(x))
+	}
+	if s.Y != nil {
+		for y := range s.Y.Values {
+			drawLabel(sheet, labelPadding,
+				headerHeight+y*cellHeight+cellHeight/2-labelLineHeight/2,
+				s.Y.label(y))
+		}
+	}
+
+	encoded, encodeErr := stability_image.EncodePng(sheet, png.BestSpeed)
+	if encodeErr != nil {
+		return nil, encodeErr
+	}
+	definition, definitionErr := s.structValue()
+	if definitionErr != nil {
+		return nil, definitionErr
+	}
+	rq := proto.Clone(base).(*generation.Request)
+	if rq.Extras == nil {
+		rq.Extras = &structpb.Struct{}
+	}
+	if rq.Extras.Fields == nil {
+		rq.Extras.Fields = make(map[string]*structpb.Value)
+	}
+	rq.Extras.Fields[SweepExtrasKey] = definition
+	return EmbedRequest(rq, encoded)
+}
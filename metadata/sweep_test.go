@@ -0,0 +1,63 @@
+package metadata
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/stability-ai/api-interfaces/gooseai/generation"
+	"github.com/stability-ai/stability-sdk-go/stability_image"
+)
+
+func TestSweepContactSheet(t *testing.T) {
+	sweep := &Sweep{
+		X: SweepAxis{Parameter: "cfg_scale", Values: []string{"5", "7", "9"}},
+		Y: &SweepAxis{Parameter: "sampler", Values: []string{"k_euler",
+			"k_dpmpp_2m"}},
+	}
+	base := &generation.Request{EngineId: "stable-diffusion-v1-5"}
+	cells, err := sweep.Requests(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) != 6 {
+		t.Fatal("expected 6 requests, got", len(cells))
+	}
+	last := cells[5].Request.GetImage()
+	if last.GetParameters()[0].GetSampler().GetCfgScale() != 9 ||
+		last.GetTransform().GetDiffusion() !=
+			generation.DiffusionSampler_SAMPLER_K_DPMPP_2M {
+		t.Error("sweep values were not applied", last)
+	}
+
+	results := make([]*[]byte, 0, len(cells))
+	for range cells {
+		img := imaging.New(512, 512, color.Gray{Y: 128})
+		encoded, _ := stability_image.EncodePng(img, png.BestSpeed)
+		results = append(results, encoded)
+	}
+	aspects := stability_image.NewAspectRatios(1048576, 64, 256, 1536)
+	sheet, err := sweep.ContactSheet(base, results, &aspects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, dim, err := stability_image.DecodeImage(sheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := aspects.ReverseTable[dim]; !ok || dim.X <= dim.Y {
+		t.Error("contact sheet is not sized to a table aspect", dim)
+	}
+	if decoded.Bounds() == (image.Rectangle{}) {
+		t.Error("empty contact sheet")
+	}
+	embedded, err := DecodeRequest(sheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := embedded.GetExtras().GetFields()[SweepExtrasKey]; !ok {
+		t.Error("sweep definition was not embedded")
+	}
+}
@@ -0,0 +1,342 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"strings"
+
+	"github.com/stability-ai/api-interfaces/gooseai/generation"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// MaxTemplateExpansions limits how many prompts a template may expand to
+// combinatorially.
+var MaxTemplateExpansions = 10000
+
+// Keys of the provenance recorded in the `Extras` of expanded requests.
+const (
+	TemplateExtrasKey       = "template"
+	TemplateValuesExtrasKey = "template_values"
+)
+
+// WildcardLoader returns the values of the wildcard `name`, which is
+// referenced in templates as `__name__`.
+type WildcardLoader func(name string) ([]string, error)
+
+// FSWildcards returns a WildcardLoader that reads the wildcard `name` from
+// the file `name.txt` in `fsys`, one value per line. Blank lines and lines
+// starting with `#` are ignored.
+func FSWildcards(fsys fs.FS) WildcardLoader {
+	return func(name string) ([]string, error) {
+		contents, readErr := fs.ReadFile(fsys, name+".txt")
+		if readErr != nil {
+			return nil, readErr
+		}
+		values := make([]string, 0)
+		scanner := bufio.NewScanner(bytes.NewReader(contents))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			values = append(values, line)
+		}
+		return values, scanner.Err()
+	}
+}
+
+// TemplateSlot is a variable part of a template: either a `{a|b|c}`
+// alternation, named by its position such as `{0}`, or a `__name__`
+// wildcard.
+type TemplateSlot struct {
+	Name   string
+	Values []string
+}
+
+// TemplateChoice records the value chosen for a slot.
+type TemplateChoice struct {
+	Slot  string
+	Value string
+}
+
+// TemplateExpansion is a single prompt produced from a template.
+type TemplateExpansion struct {
+	Template string
+	Prompt   string
+	Choices  []TemplateChoice
+}
+
+// PromptTemplate is a prompt containing `{a|b|c}` alternations and
+// `__name__` wildcards, such as `a {red|blue} {car|boat} in __styles__`.
+// Within alternations, `\|` is kept as an escaped pipe for the weighted
+// prompt syntax, and `\{`, `\}` and `\_` produce literal characters
+// anywhere in the template.
+type PromptTemplate struct {
+	Template string
+	Slots    []TemplateSlot
+	// literals surround the slots, so there is always one more literal
+	// than there are slots.
+	literals []string
+}
+
+// ParsePromptTemplate parses `template`, loading its wildcards with
+// `wildcards`. `wildcards` may be nil if the template has none.
+func ParsePromptTemplate(
+	template string,
+	wildcards WildcardLoader,
+) (*PromptTemplate, error) {
+	t := &PromptTemplate{Template: template}
+	var literal strings.Builder
+	alternations := 0
+	for pos := 0; pos < len(template); pos++ {
+		c := template[pos]
+		switch {
+		case c == '\\' && pos+1 < len(template) &&
+			strings.IndexByte(`{}_`, template[pos+1]) >= 0:
+			pos++
+			literal.WriteByte(template[pos])
+		case c == '{':
+			end := pos + 1
+			for ; end < len(template) && template[end] != '}'; end++ {
+				if template[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(template) {
+				return nil, fmt.Errorf("unclosed alternation at %d", pos)
+			}
+			values := splitAlternation(template[pos+1 : end])
+			t.literals = append(t.literals, literal.String())
+			literal.Reset()
+			t.Slots = append(t.Slots, TemplateSlot{
+				Name:   fmt.Sprintf("{%d}", alternations),
+				Values: values,
+			})
+			alternations++
+			pos = end
+		case c == '}':
+			return nil, fmt.Errorf("unopened alternation at %d", pos)
+		case strings.HasPrefix(template[pos:], "__"):
+			end := strings.Index(template[pos+2:], "__")
+			if end <= 0 {
+				literal.WriteByte(c)
+				continue
+			}
+			name := template[pos+2 : pos+2+end]
+			if strings.ContainsAny(name, " \t\n") {
+				literal.WriteByte(c)
+				continue
+			}
+			if wildcards == nil {
+				return nil, fmt.Errorf("no loader for wildcard __%s__",
+					name)
+			}
+			values, loadErr := wildcards(name)
+			if loadErr != nil {
+				return nil, fmt.Errorf("loading wildcard __%s__: %w", name,
+					loadErr)
+			}
+			if len(values) == 0 {
+				return nil, fmt.Errorf("wildcard __%s__ is empty", name)
+			}
+			t.literals = append(t.literals, literal.String())
+			literal.Reset()
+			t.Slots = append(t.Slots, TemplateSlot{
+				Name:   "__" + name + "__",
+				Values: values,
+			})
+			pos += end + 3
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	t.literals = append(t.literals, literal.String())
+	return t, nil
+}
+
+// splitAlternation splits the body of an alternation on unescaped pipes.
+// Escapes are unescaped as they are in literal text, so that other escapes
+// are left for the prompt syntax.
+func splitAlternation(body string) []string {
+	values := make([]string, 0)
+	var value strings.Builder
+	for pos := 0; pos < len(body); pos++ {
+		switch c := body[pos]; {
+		case c == '\\' && pos+1 < len(body):
+			pos++
+			if strings.IndexByte(`{}_`, body[pos]) < 0 {
+				value.WriteByte('\\')
+			}
+			value.WriteByte(body[pos])
+		case c == '|':
+			values = append(values, value.String())
+			value.Reset()
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return append(values, value.String())
+}
+
+// Count returns the number of combinatorial expansions of the template.
+func (t *PromptTemplate) Count() int {
+	count := 1
+	for _, slot := range t.Slots {
+		count *= len(slot.Values)
+		if count > MaxTemplateExpansions {
+			return MaxTemplateExpansions + 1
+		}
+	}
+	return count
+}
+
+// expand builds the expansion for the given value index of each slot.
+func (t *PromptTemplate) expand(indices []int) TemplateExpansion {
+	expansion := TemplateExpansion{
+		Template: t.Template,
+		Choices:  make([]TemplateChoice, 0, len(t.Slots)),
+	}
+	var prompt strings.Builder
+	for idx, slot := range t.Slots {
+		value := slot.Values[indices[idx]]
+		prompt.WriteString(t.literals[idx])
+		prompt.WriteString(value)
+		expansion.Choices = append(expansion.Choices, TemplateChoice{
+			Slot:  slot.Name,
+			Value: value,
+		})
+	}
+	prompt.WriteString(t.literals[len(t.Slots)])
+	expansion.Prompt = prompt.String()
+	return expansion
+}
+
+// Expand returns every combination of the template's slot values, varying
+// the last slot fastest. It fails if there are more than
+// MaxTemplateExpansions combinations.
+func (t *PromptTemplate) Expand() ([]TemplateExpansion, error) {
+	count := t.Count()
+	if count > MaxTemplateExpansions {
+		return nil, fmt.Errorf("template expands to more than %d prompts",
+			MaxTemplateExpansions)
+	}
+	expansions := make([]TemplateExpansion, 0, count)
+	indices := make([]int, len(t.Slots))
+	for {
+		expansions = append(expansions, t.expand(indices))
+		slot := len(indices) - 1
+		for ; slot >= 0; slot-- {
+			indices[slot]++
+			if indices[slot] < len(t.Slots[slot].Values) {
+				break
+			}
+			indices[slot] = 0
+		}
+		if slot < 0 {
+			return expansions, nil
+		}
+	}
+}
+
+// Sample returns `n` expansions with slot values chosen at random. The same
+// `seed` always gives the same expansions.
+func (t *PromptTemplate) Sample(n int, seed int64) []TemplateExpansion {
+	rng := rand.New(rand.NewSource(seed))
+	expansions := make([]TemplateExpansion, 0, n)
+	indices := make([]int, len(t.Slots))
+	for ; n > 0; n-- {
+		for idx, slot := range t.Slots {
+			indices[idx] = rng.Intn(len(slot.Values))
+		}
+		expansions = append(expansions, t.expand(indices))
+	}
+	return expansions
+}
+
+// Request returns a copy of `base` with its text and token prompts replaced
+// by the expansion's prompt, parsed with `ParseWeightedPrompt`. Artifact
+// prompts are kept. The template and chosen values are recorded in the
+// request's `Extras`, so that they are embedded along with the request.
+func (e TemplateExpansion) Request(
+	base *generation.Request,
+) (*generation.Request, error) {
+	prompts, parseErr := ParseWeightedPrompt(e.Prompt)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	rq := proto.Clone(base).(*generation.Request)
+	for _, prompt := range base.GetPrompt() {
+		if prompt.GetArtifact() != nil {
+			prompts = append(prompts, proto.Clone(prompt).(*generation.Prompt))
+		}
+	}
+	rq.Prompt = prompts
+
+	values := make([]interface{}, 0, len(e.Choices))
+	for _, choice := range e.Choices {
+		values = append(values, map[string]interface{}{
+			"slot":  choice.Slot,
+			"value": choice.Value,
+		})
+	}
+	valuesList, listErr := structpb.NewList(values)
+	if listErr != nil {
+		return nil, listErr
+	}
+	if rq.Extras == nil {
+		rq.Extras = &structpb.Struct{}
+	}
+	if rq.Extras.Fields == nil {
+		rq.Extras.Fields = make(map[string]*structpb.Value)
+	}
+	rq.Extras.Fields[TemplateExtrasKey] = structpb.NewStringValue(e.Template)
+	rq.Extras.Fields[TemplateValuesExtrasKey] = structpb.NewListValue(
+		valuesList)
+	return rq, nil
+}
+
+// ExpansionRequests turns each of `expansions` into a request based on
+// `base`. See `TemplateExpansion.Request`.
+func ExpansionRequests(
+	base *generation.Request,
+	expansions []TemplateExpansion,
+) ([]*generation.Request, error) {
+	requests := make([]*generation.Request, 0, len(expansions))
+	for _, expansion := range expansions {
+		rq, rqErr := expansion.Request(base)
+		if rqErr != nil {
+			return nil, fmt.Errorf("%q: %w", expansion.Prompt, rqErr)
+		}
+		requests = append(requests, rq)
+	}
+	return requests, nil
+}
+
+// TemplateProvenance reads back the template and chosen values recorded by
+// `TemplateExpansion.Request`, such as from a request returned by
+// `DecodeRequest`.
+func TemplateProvenance(rq *generation.Request) (
+	template string,
+	choices []TemplateChoice,
+	err error,
+) {
+	fields := rq.GetExtras().GetFields()
+	templateValue, ok := fields[TemplateExtrasKey]
+	if !ok {
+		return "", nil, errors.New("request has no template provenance")
+	}
+	for _, value := range fields[TemplateValuesExtrasKey].GetListValue().
+		GetValues() {
+		choiceFields := value.GetStructValue().GetFields()
+		choices = append(choices, TemplateChoice{
+			Slot:  choiceFields["slot"].GetStringValue(),
+			Value: choiceFields["value"].GetStringValue(),
+		})
+	}
+	return templateValue.GetStringValue(), choices, nil
+}
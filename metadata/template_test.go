@@ -0,0 +1,120 @@
+package metadata
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stability-ai/api-interfaces/gooseai/generation"
+	"google.golang.org/protobuf/proto"
+)
+
+var testWildcards = FSWildcards(fstest.MapFS{
+	"styles.txt": &fstest.MapFile{
+		Data: []byte("# Styles\noil painting\n\nwatercolor\nphoto\n"),
+	},
+})
+
+func TestPromptTemplateExpand(t *testing.T) {
+	template, err := ParsePromptTemplate(
+		"a {red|blue|green} {car|boat} in __styles__", testWildcards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.Count() != 18 {
+		t.Error("expected 18 expansions, got", template.Count())
+	}
+	expansions, err := template.Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expansions) != 18 {
+		t.Fatal("expected 18 expansions, got", len(expansions))
+	}
+	if expansions[0].Prompt != "a red car in oil painting" {
+		t.Error("unexpected first expansion", expansions[0].Prompt)
+	}
+	if expansions[17].Prompt != "a green boat in photo" {
+		t.Error("unexpected last expansion", expansions[17].Prompt)
+	}
+	if len(expansions[0].Choices) != 3 ||
+		expansions[0].Choices[2].Slot != "__styles__" {
+		t.Error("unexpected choices", expansions[0].Choices)
+	}
+
+	sampled := template.Sample(5, 1234)
+	resampled := template.Sample(5, 1234)
+	for idx := range sampled {
+		if sampled[idx].Prompt != resampled[idx].Prompt {
+			t.Error("sampling is not deterministic")
+		}
+	}
+
+	// Escapes inside alternations are kept for the prompt syntax as they
+	// are outside them.
+	escaped, err := ParsePromptTemplate(`{\(red\)|\{blue\}|a\|b} \(red\)`,
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expansions, err = escaped.Expand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx, want := range []string{`\(red\) \(red\)`, `{blue} \(red\)`,
+		`a\|b \(red\)`} {
+		if idx >= len(expansions) || expansions[idx].Prompt != want {
+			t.Error("unexpected escaped expansions", expansions)
+			break
+		}
+	}
+	weighted, err := ParseWeightedPrompt(expansions[0].Prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(weighted) != 1 || weighted[0].GetParameters().GetWeight() != 1 ||
+		weighted[0].GetText() != "(red) (red)" {
+		t.Error("escaped emphasis was weighted", weighted)
+	}
+
+	if _, err = ParsePromptTemplate("a {red|blue", nil); err == nil {
+		t.Error("expected an unclosed alternation error")
+	}
+	if _, err = ParsePromptTemplate("in __missing__",
+		testWildcards); err == nil {
+		t.Error("expected a missing wildcard error")
+	}
+}
+
+func TestTemplateExpansionRequest(t *testing.T) {
+	template, err := ParsePromptTemplate("a {cat|dog} (sitting:1.2)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expansions, _ := template.Expand()
+	base := &generation.Request{
+		EngineId: "stable-diffusion-v1-5",
+		Prompt: []*generation.Prompt{
+			{Prompt: &generation.Prompt_Text{Text: "replaced"}},
+		},
+		Params: &generation.Request_Image{Image: &generation.ImageParameters{
+			Width:  proto.Uint64(512),
+			Height: proto.Uint64(512),
+		}},
+	}
+	requests, err := ExpansionRequests(base, expansions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 || len(requests[1].GetPrompt()) != 2 ||
+		requests[1].GetPrompt()[0].GetText() != "a dog" {
+		t.Fatal("unexpected expanded requests", requests)
+	}
+	recorded, choices, err := TemplateProvenance(requests[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorded != template.Template || len(choices) != 1 ||
+		choices[0].Value != "dog" {
+		t.Error("unexpected provenance", recorded, choices)
+	}
+}
@@ -0,0 +1,132 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/stability-ai/api-interfaces/gooseai/generation"
+	"github.com/wbrown/gpt_bpe"
+)
+
+// ErrUnknownTokenizer is returned when tokens were produced by a tokenizer
+// that has no registered decoder.
+var ErrUnknownTokenizer = errors.New("unknown tokenizer")
+
+// DefaultTokenizerId is used for tokens that neither name their tokenizer
+// nor belong to an engine with a known tokenizer.
+const DefaultTokenizerId = "clip"
+
+// TokenDecoder decodes token ids produced by a specific tokenizer back into
+// text.
+type TokenDecoder interface {
+	Decode(ids []uint32) (string, error)
+}
+
+// BPEDecoder is a TokenDecoder backed by a `gpt_bpe` encoder. The `Prefix`
+// and `Suffix` special tokens are stripped from the decoded text.
+type BPEDecoder struct {
+	Encoder *gpt_bpe.GPTEncoder
+	Prefix  string
+	Suffix  string
+}
+
+func (d BPEDecoder) Decode(ids []uint32) (string, error) {
+	tokens := make(gpt_bpe.Tokens, 0, len(ids))
+	for _, id := range ids {
+		tokens = append(tokens, (gpt_bpe.Token)(id))
+	}
+	decoded := d.Encoder.Decode(&tokens)
+	decoded = strings.TrimPrefix(decoded, d.Prefix)
+	return strings.TrimSuffix(decoded, d.Suffix), nil
+}
+
+var (
+	tokenizersMtx sync.RWMutex
+	// tokenizers maps tokenizer ids to their decoders.
+	tokenizers = map[string]TokenDecoder{}
+	// engineTokenizers maps engine id prefixes to tokenizer ids.
+	engineTokenizers = map[string]string{}
+)
+
+// RegisterTokenizer registers `decoder` under the tokenizer `id`, replacing
+// any decoder that was previously registered with that id. Ids are case
+// insensitive.
+func RegisterTokenizer(id string, decoder TokenDecoder) {
+	tokenizersMtx.Lock()
+	defer tokenizersMtx.Unlock()
+	tokenizers[strings.ToLower(id)] = decoder
+}
+
+// RegisterEngineTokenizer declares that engines whose id starts with
+// `enginePrefix` produce tokens with the tokenizer `tokenizerId`. The longest
+// matching prefix wins.
+func RegisterEngineTokenizer(enginePrefix string, tokenizerId string) {
+	tokenizersMtx.Lock()
+	defer tokenizersMtx.Unlock()
+	engineTokenizers[strings.ToLower(enginePrefix)] = strings.ToLower(
+		tokenizerId)
+}
+
+// LookupTokenizer returns the decoder registered for the tokenizer `id`.
+func LookupTokenizer(id string) (TokenDecoder, error) {
+	tokenizersMtx.RLock()
+	defer tokenizersMtx.RUnlock()
+	decoder, ok := tokenizers[strings.ToLower(id)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTokenizer, id)
+	}
+	return decoder, nil
+}
+
+// TokenizerIdFor returns the id of the tokenizer that produced `pbTokens`.
+// The `TokenizerId` of the tokens takes precedence, followed by the tokenizer
+// registered for `engineId`, falling back to `DefaultTokenizerId`.
+func TokenizerIdFor(pbTokens *generation.Tokens, engineId string) string {
+	if id := pbTokens.GetTokenizerId(); id != "" {
+		return id
+	}
+	tokenizersMtx.RLock()
+	defer tokenizersMtx.RUnlock()
+	engineId = strings.ToLower(engineId)
+	var tokenizerId, matched string
+	for prefix, id := range engineTokenizers {
+		if strings.HasPrefix(engineId, prefix) && len(prefix) > len(matched) {
+			tokenizerId, matched = id, prefix
+		}
+	}
+	if tokenizerId == "" {
+		return DefaultTokenizerId
+	}
+	return tokenizerId
+}
+
+func init() {
+	// The OpenCLIP models were trained with the same BPE vocabulary as
+	// OpenAI's CLIP, so they share a decoder.
+	clipDecoder := BPEDecoder{
+		Encoder: &clipEncoder,
+		Prefix:  "<|startoftext|>",
+		Suffix:  "<|endoftext|>",
+	}
+	for _, id := range []string{
+		"clip",
+		"openai/clip-vit-large-patch14",
+		"openclip-vit-h-14",
+		"openclip-vit-bigg-14",
+	} {
+		RegisterTokenizer(id, clipDecoder)
+	}
+
+	RegisterEngineTokenizer("stable-diffusion-v1", "clip")
+	RegisterEngineTokenizer("stable-diffusion-512-v2", "openclip-vit-h-14")
+	RegisterEngineTokenizer("stable-diffusion-768-v2", "openclip-vit-h-14")
+	RegisterEngineTokenizer("stable-diffusion-xl", "openclip-vit-bigg-14")
+	// SD3 prompts are tokenized with T5 as well as both CLIP encoders.
+	// There is no T5 decoder bundled, so tokens that do not name their
+	// tokenizer are decoded as CLIP's; T5 tokens must name theirs, and fail
+	// with ErrUnknownTokenizer until a decoder is registered.
+	RegisterEngineTokenizer("sd3", "openclip-vit-bigg-14")
+	RegisterEngineTokenizer("stable-diffusion-3", "openclip-vit-bigg-14")
+}
@@ -0,0 +1,315 @@
+package stability_image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+
+	"github.com/disintegration/imaging"
+)
+
+var ErrUnknownAlphaPolicy = errors.New("unknown alpha policy")
+
+// DefaultAlphaColor is the color AlphaFlatten flattens onto when none is
+// given.
+var DefaultAlphaColor = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+
+// AlphaPolicy is how images with transparency are prepared. Opaque images
+// are prepared alike under every policy.
+type AlphaPolicy int
+
+const (
+	// AlphaKeep leaves transparency as it was decoded.
+	AlphaKeep AlphaPolicy = iota
+	// AlphaFlatten composites the image onto a solid color.
+	AlphaFlatten
+	// AlphaPremultiply keeps transparency, but gives transparent pixels the
+	// colors around them, weighted by alpha as premultiplied colors are,
+	// so that resizing, blurring and reflecting don't darken or fringe the
+	// visible edges.
+	AlphaPremultiply
+	// AlphaGenerate treats transparent pixels as a region to generate: the
+	// image is made opaque as AlphaPremultiply colors it, and its alpha is
+	// worked into the mask.
+	AlphaGenerate
+)
+
+func (p AlphaPolicy) String() string {
+	return [...]string{"keep", "flatten", "premultiply", "generate"}[p]
+}
+
+func (p *AlphaPolicy) FromString(s string) {
+	switch s {
+	case "keep":
+		*p = AlphaKeep
+	case "flatten":
+		*p = AlphaFlatten
+	case "premultiply", "premultiplied":
+		*p = AlphaPremultiply
+	case "generate", "mask":
+		*p = AlphaGenerate
+	}
+}
+
+func (p AlphaPolicy) MarshalText() ([]byte, error) {
+	if p < AlphaKeep || p > AlphaGenerate {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownAlphaPolicy, int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+func (p *AlphaPolicy) UnmarshalText(text []byte) error {
+	parsed := AlphaPolicy(-1)
+	parsed.FromString(string(text))
+	if parsed < 0 {
+		return fmt.Errorf("%w: %q", ErrUnknownAlphaPolicy, text)
+	}
+	*p = parsed
+	return nil
+}
+
+// isOpaque reports whether every pixel of `img` is fully opaque.
+func isOpaque(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return opaque.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// FlattenAlpha composites `img` onto `background`, returning an opaque
+// copy of it.
+func FlattenAlpha(img image.Image, background color.Color) *image.NRGBA {
+	bounds := img.Bounds()
+	flattened := imaging.New(bounds.Dx(), bounds.Dy(), background)
+	draw.Draw(flattened, flattened.Bounds(), img, bounds.Min, draw.Over)
+	return flattened
+}
+
+// BleedAlpha returns a copy of `img` whose fully transparent pixels take
+// the colors of the visible pixels nearest them, keeping their alpha. The
+// colors are pushed down an image pyramid as premultiplied colors, so that
+// each is weighted by its alpha, and pulled back up into the gaps.
+func BleedAlpha(img image.Image) *image.NRGBA {
+	bled := imaging.Clone(img)
+	size := bled.Bounds().Size()
+	if size.X == 0 || size.Y == 0 {
+		return bled
+	}
+
+	// Each level holds premultiplied red, green, blue and alpha from 0 to 1
+	// per pixel, and halves the level before it.
+	type level struct {
+		size image.Point
+		pix  []float32
+	}
+	levels := []level{{size: size, pix: make([]float32, size.X*size.Y*4)}}
+	for idx := 0; idx < len(bled.Pix); idx += 4 {
+		alpha := float32(bled.Pix[idx+3]) / 255
+		for channel := 0; channel < 3; channel++ {
+			levels[0].pix[idx+channel] = float32(bled.Pix[idx+channel]) /
+				255 * alpha
+		}
+		levels[0].pix[idx+3] = alpha
+	}
+	for last := levels[0]; last.size.X > 1 || last.size.Y > 1; {
+		reduced := level{size: image.Point{X: (last.size.X + 1) / 2,
+			Y: (last.size.Y + 1) / 2}}
+		reduced.pix = make([]float32, reduced.size.X*reduced.size.Y*4)
+		for y := 0; y < reduced.size.Y; y++ {
+			for x := 0; x < reduced.size.X; x++ {
+				var sum [4]float32
+				for _, from := range [4]image.Point{{2 * x, 2 * y},
+					{2*x + 1, 2 * y}, {2 * x, 2*y + 1}, {2*x + 1, 2*y + 1}} {
+					if from.X >= last.size.X || from.Y >= last.size.Y {
+						continue
+					}
+					idx := (from.Y*last.size.X + from.X) * 4
+					for channel := range sum {
+						sum[channel] += last.pix[idx+channel]
+					}
+				}
+				// Coverage saturates, keeping the color it averages to.
+				scale := float32(1)
+				if sum[3] > 1 {
+					scale = 1 / sum[3]
+				}
+				idx := (y*reduced.size.X + x) * 4
+				for channel := range sum {
+					reduced.pix[idx+channel] = sum[channel] * scale
+				}
+			}
+		}
+		levels = append(levels, reduced)
+		last = reduced
+	}
+
+	// Composite each level over the one above it, down to the image, whose
+	// transparent pixels then take the color they were composited to.
+	for k := len(levels) - 2; k >= 0; k-- {
+		fine, coarse := levels[k], levels[k+1]
+		for y := 0; y < fine.size.Y; y++ {
+			for x := 0; x < fine.size.X; x++ {
+				idx := (y*fine.size.X + x) * 4
+				under := ((y/2)*coarse.size.X + x/2) * 4
+				cover := 1 - fine.pix[idx+3]
+				if k == 0 {
+					if cover < 1 || coarse.pix[under+3] == 0 {
+						continue
+					}
+					for channel := 0; channel < 3; channel++ {
+						bled.Pix[idx+channel] = uint8(min(1,
+							coarse.pix[under+channel]/
+								coarse.pix[under+3])*255 + 0.5)
+					}
+					continue
+				}
+				for channel := 0; channel < 4; channel++ {
+					fine.pix[idx+channel] += cover * coarse.pix[under+channel]
+				}
+			}
+		}
+	}
+	return bled
+}
+
+// resizeWithAlpha resizes `img` as imaging.Resize does, which weights each
+// color by its alpha as resizing premultiplied colors does. With
+// AlphaPremultiply, the colors of the pixels it leaves transparent black
+// are bled back in.
+func resizeWithAlpha(
+	img image.Image,
+	width int,
+	height int,
+	filter imaging.ResampleFilter,
+	policy AlphaPolicy,
+) *image.NRGBA {
+	resized := imaging.Resize(img, width, height, filter)
+	if policy == AlphaPremultiply && !isOpaque(resized) {
+		return BleedAlpha(resized)
+	}
+	return resized
+}
+
+// alphaLevels returns the alpha of `img` as a gray image.
+func alphaLevels(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	levels := image.NewGray(image.Rectangle{Max: bounds.Size()})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			_, _, _, a := img.At(x, y).RGBA()
+			levels.Pix[(y-bounds.Min.Y)*levels.Stride+x-bounds.Min.X] =
+				uint8(a >> 8)
+		}
+	}
+	return levels
+}
+
+// AlphaInpaintMask derives an inpaint mask from the transparency of `img`,
+// marking the pixels to generate black and those to keep white, as outpaint
+// masks do: the more transparent a pixel is, the darker it is in the mask,
+// so that pixels under half opacity are generated. It fails with
+// ErrEmptyMask if none are.
+func AlphaInpaintMask(img image.Image) (*image.Gray, error) {
+	mask := alphaLevels(img)
+	for _, generated := range maskGenerated(mask) {
+		if generated {
+			return mask, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no pixel is under half opacity",
+		ErrEmptyMask)
+}
+
+// applyAlphaPolicy prepares `img` by `policy`, returning whether it changed
+// it, and for AlphaGenerate, the alpha to work into the mask. Opaque
+// images are returned as they are.
+func applyAlphaPolicy(
+	img image.Image,
+	policy AlphaPolicy,
+	background color.Color,
+) (prepared image.Image, alpha *image.Gray, applied bool, err error) {
+	if policy < AlphaKeep || policy > AlphaGenerate {
+		return nil, nil, false, fmt.Errorf("%w: %d", ErrUnknownAlphaPolicy,
+			int(policy))
+	}
+	if policy == AlphaKeep || isOpaque(img) {
+		return img, nil, false, nil
+	}
+	switch policy {
+	case AlphaFlatten:
+		if background == nil {
+			background = DefaultAlphaColor
+		}
+		return FlattenAlpha(img, background), nil, true, nil
+	case AlphaPremultiply:
+		return BleedAlpha(img), nil, true, nil
+	}
+	bled := BleedAlpha(img)
+	for idx := 3; idx < len(bled.Pix); idx += 4 {
+		bled.Pix[idx] = 0xff
+	}
+	return bled, alphaLevels(img), true, nil
+}
+
+// maskTransparent works `alpha`, the alpha of an outpainted source, into
+// the outpaint mask `masked` along the source's placement in `geometry`, so
+// that its transparent pixels are generated too. A nil mask keeps the whole
+// canvas.
+func maskTransparent(
+	masked *[]byte,
+	alpha *image.Gray,
+	geometry *OutpaintGeometry,
+	opts *OutpaintImageOpts,
+) (*[]byte, error) {
+	generateLevel := float64(maskValue(0, opts.MaskBackground,
+		opts.MaskInvert))
+	keepLevel := float64(maskValue(1, opts.MaskBackground, opts.MaskInvert))
+	var mask *image.NRGBA
+	if masked == nil {
+		mask = imaging.New(geometry.Target.X, geometry.Target.Y,
+			color.Gray16{Y: uint16(keepLevel)})
+	} else {
+		decoded, _, _, err := DecodeImage(masked)
+		if err != nil {
+			return nil, err
+		}
+		mask = imaging.Clone(decoded)
+	}
+	if mask.Bounds().Size() != geometry.Target {
+		return nil, fmt.Errorf("%w: mask is %v, not %v", ErrGeometryMismatch,
+			mask.Bounds().Size(), geometry.Target)
+	}
+
+	placement := geometry.Placement
+	scaled := imaging.Resize(alpha, placement.Dx(), placement.Dy(),
+		imaging.Linear)
+	visible := placement.Intersect(mask.Bounds())
+	for y := visible.Min.Y; y < visible.Max.Y; y++ {
+		for x := visible.Min.X; x < visible.Max.X; x++ {
+			idx := mask.PixOffset(x, y)
+			gray, _, _, _ := mask.At(x, y).RGBA()
+			kept := (float64(gray) - generateLevel) /
+				(keepLevel - generateLevel)
+			opacity := float64(scaled.Pix[scaled.PixOffset(
+				x-placement.Min.X, y-placement.Min.Y)]) / 0xff
+			if opacity >= kept {
+				continue
+			}
+			level := uint8(maskValue(opacity, opts.MaskBackground,
+				opts.MaskInvert) >> 8)
+			copy(mask.Pix[idx:idx+3], []uint8{level, level, level})
+		}
+	}
+	return EncodePng(mask, png.BestSpeed)
+}
@@ -0,0 +1,194 @@
+package stability_image
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// halfTransparent returns a red image of `size` whose right half is
+// transparent black.
+func halfTransparent(size image.Point) *image.NRGBA {
+	img := flatImage(size, color.NRGBA{R: 255, A: 255})
+	for y := 0; y < size.Y; y++ {
+		for x := size.X / 2; x < size.X; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{})
+		}
+	}
+	return img
+}
+
+func TestAlphaPolicy(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	source := halfTransparent(image.Point{X: 400, Y: 200})
+	bled := BleedAlpha(source)
+	for _, point := range []image.Point{{10, 10}, {250, 100}, {399, 199}} {
+		want := red
+		if point.X >= 200 {
+			want.A = 0
+		}
+		if bled.NRGBAAt(point.X, point.Y) != want {
+			t.Error("bled", bled.NRGBAAt(point.X, point.Y), "at", point)
+		}
+	}
+	raw, err := EncodePng(source, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Coercing keeps transparency as it is, colors it, flattens it or
+	// masks it to be generated.
+	aspects := NewAspectRatios(1048576, 64, 256, 1536)
+	for _, test := range []struct {
+		policy      AlphaPolicy
+		transparent color.NRGBA
+		masked      bool
+	}{
+		{AlphaKeep, color.NRGBA{}, false},
+		{AlphaPremultiply, color.NRGBA{R: 255}, false},
+		{AlphaFlatten, color.NRGBA{255, 255, 255, 255}, false},
+		{AlphaGenerate, red, true},
+	} {
+		opts := NewCoerceImageOpts()
+		opts.Alpha = test.policy
+		result, coerceErr := aspects.CoerceImageWithOpts(raw, opts)
+		if coerceErr != nil {
+			t.Fatal(coerceErr)
+		}
+		coerced, _, _, decodeErr := DecodeImage(result.Coerced)
+		if decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+		right := image.Point{X: result.Size.X * 7 / 8, Y: result.Size.Y / 2}
+		left := image.Point{X: result.Size.X / 8, Y: result.Size.Y / 2}
+		if colorDistance(coerced.At(right.X, right.Y), test.transparent) >
+			0 || colorDistance(coerced.At(left.X, left.Y), red) > 0 {
+			t.Error(test.policy, "coerced to", coerced.At(left.X, left.Y),
+				coerced.At(right.X, right.Y))
+		}
+		if (result.Mask != nil) != test.masked {
+			t.Error(test.policy, "masked:", result.Mask != nil)
+			continue
+		}
+		if !test.masked {
+			continue
+		}
+		mask, _, maskDim, decodeErr := DecodeImage(result.Mask)
+		if decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+		if *maskDim != result.Size {
+			t.Fatal("mask is", *maskDim)
+		}
+		if gray, _, _, _ := mask.At(right.X, right.Y).RGBA(); gray != 0 {
+			t.Error("transparent pixels are not generated")
+		}
+		if gray, _, _, _ := mask.At(left.X, left.Y).RGBA(); gray != 0xffff {
+			t.Error("opaque pixels are generated")
+		}
+	}
+
+	// Outpainting with AlphaGenerate generates the transparent pixels of
+	// the source along with the extended area.
+	for _, policy := range []AlphaPolicy{AlphaKeep, AlphaGenerate} {
+		opts := NewOutpaintImageOpts()
+		opts.Alpha = policy
+		opts.Seed = 1
+		plan, planErr := PlanOutpaint(raw, 1024, 1024, opts)
+		if planErr != nil {
+			t.Fatal(planErr)
+		}
+		mask, _, _, decodeErr := DecodeImage(plan.Masked)
+		if decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+		middle := plan.Placement.Min.Add(plan.Placement.Size().Div(2))
+		transparent := middle.Add(image.Pt(plan.Placement.Dx()/4, 0))
+		opaque := middle.Sub(image.Pt(plan.Placement.Dx()/4, 0))
+		keep := maskValue(1, opts.MaskBackground, opts.MaskInvert) >> 8
+		generate := maskValue(0, opts.MaskBackground, opts.MaskInvert) >> 8
+		want := keep
+		if policy == AlphaGenerate {
+			want = generate
+		}
+		if gray := color.GrayModel.Convert(mask.At(transparent.X,
+			transparent.Y)).(color.Gray).Y; uint16(gray) != want {
+			t.Error(policy, "masked transparent pixels", gray)
+		}
+		if gray := color.GrayModel.Convert(mask.At(opaque.X,
+			opaque.Y)).(color.Gray).Y; uint16(gray) != keep {
+			t.Error(policy, "masked opaque pixels", gray)
+		}
+		if gray := color.GrayModel.Convert(mask.At(512,
+			2)).(color.Gray).Y; uint16(gray) != generate {
+			t.Error(policy, "masked the extended area", gray)
+		}
+	}
+
+	// Inpainting without a mask inpaints the transparent pixels.
+	holed := flatImage(image.Point{X: 1200, Y: 1000}, color.NRGBA{128, 128,
+		128, 255})
+	disc := discMask(holed.Bounds().Size(), image.Point{X: 300, Y: 700}, 50)
+	for idx, level := range disc.Pix {
+		if level != 0 {
+			copy(holed.Pix[idx*4:], []uint8{0, 0, 0, 0})
+		}
+	}
+	src, err := EncodePng(holed, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crop, cropMask, geometry, err := PrepareInpaintCrop(src, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geometry.Bounds != image.Rect(250, 650, 351, 751) {
+		t.Error("derived mask is bounded by", geometry.Bounds)
+	}
+	cropped, _, _, err := DecodeImage(crop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isOpaque(cropped) {
+		t.Error("crop is not opaque")
+	}
+	if _, _, _, err = DecodeImage(cropMask); err != nil {
+		t.Fatal(err)
+	}
+	generated, err := EncodePng(flatImage(geometry.Size, red), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pastedData, err := PasteInpaintResult(src, nil, generated, geometry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pasted, _, _, err := DecodeImage(pastedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if colorDistance(pasted.At(300, 700), red) > 0 ||
+		colorDistance(pasted.At(100, 100), holed.At(100, 100)) > 0 {
+		t.Error("pasted", pasted.At(300, 700), pasted.At(100, 100))
+	}
+	opaque, err := EncodePng(flatImage(image.Point{X: 64, Y: 64}, red), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = PrepareInpaintCrop(opaque, nil, nil); !errors.Is(err,
+		ErrEmptyMask) {
+		t.Error("opaque source was not reported", err)
+	}
+
+	var policy AlphaPolicy
+	if err = json.Unmarshal([]byte(`"mask"`), &policy); err != nil ||
+		policy != AlphaGenerate {
+		t.Error("policy alias was not decoded", policy, err)
+	}
+	if err = json.Unmarshal([]byte(`"erase"`), &policy); !errors.Is(err,
+		ErrUnknownAlphaPolicy) {
+		t.Error("unknown policy was not reported", err)
+	}
+}
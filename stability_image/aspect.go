@@ -196,6 +196,32 @@ func (a *AspectRatios) LookupAspect(
 	return nil, false
 }
 
+// NearestRatio returns the aspect ratio in the table whose pixel dimensions
+// are nearest in proportion to `width` by `height`, comparing ratios on a
+// logarithmic scale so that wide and tall ratios are treated alike. Ties go
+// to the first label in sorted order.
+func (a *AspectRatios) NearestRatio(width uint64, height uint64) (
+	aspect *AspectRatio,
+	found bool,
+) {
+	labels := make([]string, 0, len(a.Table))
+	for label := range a.Table {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	ratio := math.Log(float64(width) / float64(height))
+	nearest := math.Inf(1)
+	for _, label := range labels {
+		candidate := a.Table[label]
+		distance := math.Abs(ratio - math.Log(
+			float64(candidate.WidthPixels)/float64(candidate.HeightPixels)))
+		if distance < nearest {
+			aspect, nearest = &candidate, distance
+		}
+	}
+	return aspect, aspect != nil
+}
+
 // InsertAspect - given an AspectRatio, insert it into the AspectRatioCollection
 // if it is not already in the table.
 func (ac *AspectRatioCollection) InsertAspect(aspect *AspectRatio) (
@@ -269,6 +295,19 @@ type AspectOutpaints struct {
 	Outpaints   []OutpaintDescription
 }
 
+// FilterOutpaintOpts are the options of FilterByOutpaintWithOpts.
+type FilterOutpaintOpts struct {
+	// SeamCarve offers OutpaintSeamCarve for the aspect ratios SeamCarve can
+	// retarget to, as configured by SeamCarveOpts.
+	SeamCarve     bool
+	SeamCarveOpts *SeamCarveOpts
+	// ZoomOut, if between 0 and 1, describes zooming out by this factor as
+	// OutpaintImageOpts.ZoomOut does, rather than filling an axis of each
+	// aspect ratio. The source is then placed by ZoomPlacement, extending
+	// both axes at once, towards the corners for corner anchors.
+	ZoomOut float64
+}
+
 // FilterByOutpaint - given an AspectRatioCollection and an
 // image.Point filter it by the OutpaintCondition and return a slice of
 // AspectOutpaints that match the aspect ratio and allowed outpaint conditions.
@@ -278,6 +317,32 @@ func (as *AspectRatios) FilterByOutpaint(
 ) (
 	filtered []AspectOutpaints,
 ) {
+	return as.FilterByOutpaintWithOpts(filter, ac, nil)
+}
+
+// FilterByOutpaintWithOpts filters as FilterByOutpaint does, or for
+// zooming out with `opts.ZoomOut`. With `opts.SeamCarve` it also offers
+// retargeting to the aspect ratios that seam carving can reach within its
+// SeamCarveOpts.MaxRatio.
+func (as *AspectRatios) FilterByOutpaintWithOpts(
+	filter image.Point,
+	ac AspectRatioCollection,
+	opts *FilterOutpaintOpts,
+) (
+	filtered []AspectOutpaints,
+) {
+	if opts == nil {
+		opts = &FilterOutpaintOpts{}
+	}
+	seamOpts := opts.SeamCarveOpts
+	if seamOpts == nil {
+		seamOpts = NewSeamCarveOpts()
+	}
+	seamMaxRatio := seamOpts.MaxRatio
+	if seamMaxRatio <= 0 {
+		seamMaxRatio = DefaultSeamCarveMaxRatio
+	}
+	zoomOut := opts.ZoomOut > 0 && opts.ZoomOut <= 1
 	filtered = make([]AspectOutpaints, 0)
 
 	for _, aspect := range ac {
@@ -291,26 +356,43 @@ func (as *AspectRatios) FilterByOutpaint(
 			continue
 		}
 		if aspect.WidthPixels == uint64(filter.X) &&
-			aspect.HeightPixels == uint64(filter.Y) {
+			aspect.HeightPixels == uint64(filter.Y) && !zoomOut {
 			continue
 		}
+		target := image.Point{X: int(aspect.WidthPixels),
+			Y: int(aspect.HeightPixels)}
+		// Anchors that lead to the same action, as every anchor scaling
+		// down does, are described once.
 		descriptions := make([]OutpaintDescription, 0)
-		for direction := Direction(0); direction < 5; direction++ {
+		described := make(map[OutpaintAction]bool)
+		for direction := Direction(0); direction < DirectionCount; direction++ {
 			outpaintCondition := CondNone
-			outpaintCondition.FromPoints(filter, image.Point{
-				X: int(aspect.WidthPixels),
-				Y: int(aspect.HeightPixels),
-			})
-			outpaintCondition.SetDirection(direction)
+			if zoomOut {
+				outpaintCondition.FromPlacement(target, ZoomPlacement(filter,
+					target, opts.ZoomOut, direction))
+			} else {
+				outpaintCondition.FromPoints(filter, target)
+				outpaintCondition.SetDirection(direction)
+			}
 
 			outpaintAction := outpaintActions[outpaintCondition]
 
-			if outpaintAction != OutpaintNone {
+			if outpaintAction != OutpaintNone && !described[outpaintAction] {
+				described[outpaintAction] = true
 				description := OutpaintDescriptions[outpaintAction]
+				description.Action = outpaintAction
 				description.Condition = outpaintCondition
 				descriptions = append(descriptions, description)
 			}
 		}
+		if opts.SeamCarve && filter.X*target.Y != filter.Y*target.X &&
+			SeamCarveRatio(filter, target, seamOpts.Insert) <= seamMaxRatio {
+			description := OutpaintDescriptions[OutpaintSeamCarve]
+			description.Action = OutpaintSeamCarve
+			description.Condition = CondNone
+			description.Condition.FromPoints(filter, target)
+			descriptions = append(descriptions, description)
+		}
 		filtered = append(filtered, AspectOutpaints{
 			AspectRatio: aspect,
 			Outpaints:   descriptions,
@@ -67,14 +67,46 @@ func TestAspectRatioCollection_FilterByOutpaint(t *testing.T) {
 				aspect.AspectRatio.Label,
 				aspect.AspectRatio.WidthPixels,
 				aspect.AspectRatio.HeightPixels))
+			seen := make(map[OutpaintAction]bool)
 			for _, outpaint := range aspect.Outpaints {
 				t.Log(fmt.Sprintf("\t%s %s: %s %s",
 					outpaint.Anchor,
 					outpaint.ScaleStr, outpaint,
 					outpaint.Condition))
+				if seen[outpaint.Action] {
+					t.Error(outpaint.Action, "is offered more than once")
+				}
+				seen[outpaint.Action] = true
 			}
 		}
 	}
+
+	// Every anchor scales a larger source of the same aspect ratio down,
+	// which is offered once.
+	square := []AspectRatio{aspects.Table["1:1"]}
+	filtered := aspects.FilterByOutpaint(image.Point{X: 4096, Y: 4096},
+		square)
+	if len(filtered) != 1 || len(filtered[0].Outpaints) != 1 ||
+		filtered[0].Outpaints[0].Action != OutpaintScaleDown {
+		t.Error("unexpected outpaints for a larger square", filtered)
+	}
+
+	// Zooming out extends both axes, all around the source or away from
+	// the corner it is anchored in.
+	zoomed := aspects.FilterByOutpaintWithOpts(image.Point{X: 1024, Y: 1024},
+		square, &FilterOutpaintOpts{ZoomOut: 0.5})
+	want := map[OutpaintAction]bool{OutpaintAllSides: true,
+		OutpaintToTopLeft: true, OutpaintToTopRight: true,
+		OutpaintToBottomLeft: true, OutpaintToBottomRight: true}
+	if len(zoomed) != 1 || len(zoomed[0].Outpaints) != len(want) {
+		t.Fatal("unexpected outpaints for zooming out", zoomed)
+	}
+	for _, outpaint := range zoomed[0].Outpaints {
+		if !want[outpaint.Action] || !outpaint.Condition.IsBothAxes() {
+			t.Error("unexpected outpaint for zooming out", outpaint.Action,
+				outpaint.Condition)
+		}
+	}
 }
 
 func TestReverseAspectRatiosTable_ScanNearestN(t *testing.T) {
@@ -0,0 +1,458 @@
+package stability_image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+var (
+	ErrUnknownAspect     = errors.New("unknown aspect ratio")
+	ErrUnknownCoerceMode = errors.New("unknown coerce mode")
+	ErrUnknownCropMetric = errors.New("unknown crop metric")
+)
+
+// CoerceMode is how CoerceImageWithOpts fits an image to dimensions of a
+// different aspect ratio.
+type CoerceMode int
+
+const (
+	// CoerceStretch scales the image to the dimensions, distorting it.
+	CoerceStretch CoerceMode = iota
+	// CoercePad scales the image to fit within the dimensions, and pads the
+	// rest with a solid color.
+	CoercePad
+	// CoerceCenterCrop scales the image to cover the dimensions, and crops
+	// what overhangs them evenly from both sides.
+	CoerceCenterCrop
+	// CoerceSmartCrop scales the image to cover the dimensions, and crops it
+	// to the window holding the most detail.
+	CoerceSmartCrop
+)
+
+func (m CoerceMode) String() string {
+	return [...]string{"stretch", "pad", "center-crop", "smart-crop"}[m]
+}
+
+func (m *CoerceMode) FromString(s string) {
+	switch s {
+	case "stretch":
+		*m = CoerceStretch
+	case "pad":
+		*m = CoercePad
+	case "center-crop", "center":
+		*m = CoerceCenterCrop
+	case "smart-crop", "smart":
+		*m = CoerceSmartCrop
+	}
+}
+
+func (m CoerceMode) MarshalText() ([]byte, error) {
+	if m < CoerceStretch || m > CoerceSmartCrop {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCoerceMode, int(m))
+	}
+	return []byte(m.String()), nil
+}
+
+func (m *CoerceMode) UnmarshalText(text []byte) error {
+	parsed := CoerceMode(-1)
+	parsed.FromString(string(text))
+	if parsed < 0 {
+		return fmt.Errorf("%w: %q", ErrUnknownCoerceMode, text)
+	}
+	*m = parsed
+	return nil
+}
+
+// CropMetric is how CoerceSmartCrop measures the detail in a window.
+type CropMetric int
+
+const (
+	// CropMetricEnergy sums the gradient magnitude of the luminance, which
+	// favors edges.
+	CropMetricEnergy CropMetric = iota
+	// CropMetricEntropy measures the entropy of the luminance histogram,
+	// which favors varied tones and textures.
+	CropMetricEntropy
+)
+
+func (m CropMetric) String() string {
+	return [...]string{"energy", "entropy"}[m]
+}
+
+func (m *CropMetric) FromString(s string) {
+	switch s {
+	case "energy":
+		*m = CropMetricEnergy
+	case "entropy":
+		*m = CropMetricEntropy
+	}
+}
+
+func (m CropMetric) MarshalText() ([]byte, error) {
+	if m < CropMetricEnergy || m > CropMetricEntropy {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCropMetric, int(m))
+	}
+	return []byte(m.String()), nil
+}
+
+func (m *CropMetric) UnmarshalText(text []byte) error {
+	parsed := CropMetric(-1)
+	parsed.FromString(string(text))
+	if parsed < 0 {
+		return fmt.Errorf("%w: %q", ErrUnknownCropMetric, text)
+	}
+	*m = parsed
+	return nil
+}
+
+const (
+	// smartCropAnalysisSize is the longest side an image is scaled down to
+	// before the smart crop measures it.
+	smartCropAnalysisSize = 256
+	// smartCropBins is the number of luminance bins CropMetricEntropy
+	// measures.
+	smartCropBins = 32
+)
+
+type CoerceImageOpts struct {
+	// Mode is how the image is fitted to the dimensions.
+	Mode CoerceMode
+	// Metric is how CoerceSmartCrop measures detail.
+	Metric CropMetric
+	// Aspect, if set, is the label of the aspect ratio to coerce to. If
+	// empty, stretching coerces to the dimensions CoerceImage does, and the
+	// other modes to the aspect ratio in the table nearest the image's.
+	Aspect string
+	// PadColor is the color CoercePad pads with.
+	PadColor color.Color
+	// KeepProfile converts the coerced image back to the ICC profile of the
+	// source and embeds it, rather than leaving it in sRGB.
+	KeepProfile bool
+	// Alpha is how a source with transparency is coerced. With
+	// AlphaGenerate, CoerceResult.Mask marks its transparent pixels.
+	Alpha AlphaPolicy
+	// AlphaColor is the color AlphaFlatten flattens onto. If nil,
+	// DefaultAlphaColor is used.
+	AlphaColor color.Color
+}
+
+func NewCoerceImageOpts() *CoerceImageOpts {
+	return &CoerceImageOpts{
+		Mode:     CoerceStretch,
+		Metric:   CropMetricEnergy,
+		PadColor: color.NRGBA{A: 255},
+	}
+}
+
+// CoerceResult is an image coerced by CoerceImageWithOpts, along with how
+// the source maps onto it.
+type CoerceResult struct {
+	// Coerced is the coerced image, encoded as a PNG.
+	Coerced *[]byte `json:"coerced,omitempty"`
+	// Mask, with AlphaGenerate, is an inpaint mask of the coerced image
+	// derived from the source's transparency, as AlphaInpaintMask derives
+	// it: black where generated, and white where kept, padding included. It
+	// is nil if the source is opaque.
+	Mask *[]byte `json:"mask,omitempty"`
+	// Source is the size of the source once upright, and Format the format
+	// it was decoded from.
+	Source image.Point `json:"source"`
+	Format string      `json:"format"`
+	// Orientation is the orientation the source was stored in. Crop is in
+	// the upright source.
+	Orientation Orientation `json:"orientation"`
+	// Profile is the ICC profile embedded in the source, if any.
+	Profile *ICCProfile `json:"profile,omitempty"`
+	// Size is the size of the coerced image.
+	Size image.Point `json:"size"`
+	Mode CoerceMode  `json:"mode"`
+	// Crop is the part of the source kept, in source pixels.
+	Crop image.Rectangle `json:"crop"`
+	// Placement is where the crop sits in the coerced image.
+	Placement image.Rectangle `json:"placement"`
+}
+
+// ToSource maps a point of the coerced image to the source.
+func (r *CoerceResult) ToSource(p image.Point) image.Point {
+	return image.Point{
+		X: r.Crop.Min.X + int(math.Floor(float64(p.X-r.Placement.Min.X)*
+			float64(r.Crop.Dx())/float64(r.Placement.Dx()))),
+		Y: r.Crop.Min.Y + int(math.Floor(float64(p.Y-r.Placement.Min.Y)*
+			float64(r.Crop.Dy())/float64(r.Placement.Dy()))),
+	}
+}
+
+// FromSource maps a point of the source to the coerced image.
+func (r *CoerceResult) FromSource(p image.Point) image.Point {
+	return image.Point{
+		X: r.Placement.Min.X + int(math.Floor(float64(p.X-r.Crop.Min.X)*
+			float64(r.Placement.Dx())/float64(r.Crop.Dx()))),
+		Y: r.Placement.Min.Y + int(math.Floor(float64(p.Y-r.Crop.Min.Y)*
+			float64(r.Placement.Dy())/float64(r.Crop.Dy()))),
+	}
+}
+
+// coverCrop returns the size of the largest crop of a source of `size` with
+// the aspect ratio of `target`.
+func coverCrop(size image.Point, target image.Point) image.Point {
+	if size.X*target.Y > size.Y*target.X {
+		return image.Point{X: fitLength(size.Y, target.X, target.Y),
+			Y: size.Y}
+	}
+	return image.Point{X: size.X, Y: fitLength(size.X, target.Y, target.X)}
+}
+
+// smartCrop returns where a crop of `crop` from `img` holds the most
+// detail by `metric`, sliding it along the axis it is shorter than the
+// image in. The image is measured scaled down, for speed.
+func smartCrop(
+	img image.Image,
+	crop image.Point,
+	metric CropMetric,
+) image.Point {
+	size := img.Bounds().Size()
+	horizontal := crop.X < size.X
+	if crop.X >= size.X && crop.Y >= size.Y {
+		return image.Point{}
+	}
+	scale := math.Min(1, float64(smartCropAnalysisSize)/
+		float64(max(size.X, size.Y)))
+	small := imaging.Resize(img, max(1, int(float64(size.X)*scale)),
+		max(1, int(float64(size.Y)*scale)), imaging.Box)
+	smallSize := small.Bounds().Size()
+	luma := make([]float64, smallSize.X*smallSize.Y)
+	for idx := range luma {
+		pix := small.Pix[idx*4:][:4]
+		luma[idx] = (0.299*float64(pix[0]) + 0.587*float64(pix[1]) +
+			0.114*float64(pix[2])) * float64(pix[3]) / 255
+	}
+
+	// Reduce the measure to one line along the sliding axis.
+	length, across := smallSize.X, smallSize.Y
+	at := func(along int, over int) int { return over*smallSize.X + along }
+	window := int(math.Round(float64(crop.X) * float64(smallSize.X) /
+		float64(size.X)))
+	if !horizontal {
+		length, across = smallSize.Y, smallSize.X
+		at = func(along int, over int) int { return along*smallSize.X + over }
+		window = int(math.Round(float64(crop.Y) * float64(smallSize.Y) /
+			float64(size.Y)))
+	}
+	window = max(1, min(length, window))
+	best, bestScore := 0, math.Inf(-1)
+	switch metric {
+	case CropMetricEntropy:
+		histograms := make([][smartCropBins]int, length)
+		for along := 0; along < length; along++ {
+			for over := 0; over < across; over++ {
+				bin := int(luma[at(along, over)]) * smartCropBins / 256
+				histograms[along][min(bin, smartCropBins-1)]++
+			}
+		}
+		var counts [smartCropBins]int
+		for along := 0; along < length; along++ {
+			for bin, count := range histograms[along] {
+				counts[bin] += count
+			}
+			if along >= window {
+				for bin, count := range histograms[along-window] {
+					counts[bin] -= count
+				}
+			}
+			if along < window-1 {
+				continue
+			}
+			total := float64(window * across)
+			entropy := 0.0
+			for _, count := range counts {
+				if count > 0 {
+					p := float64(count) / total
+					entropy -= p * math.Log2(p)
+				}
+			}
+			if entropy > bestScore {
+				best, bestScore = along-window+1, entropy
+			}
+		}
+	default:
+		energy := make([]float64, length+1)
+		for along := 0; along < length; along++ {
+			sum := 0.0
+			for over := 0; over < across; over++ {
+				next, below := along+1, over+1
+				if next == length {
+					next = along - 1
+				}
+				if below == across {
+					below = over - 1
+				}
+				value := luma[at(along, over)]
+				if next >= 0 {
+					sum += math.Abs(luma[at(next, over)] - value)
+				}
+				if below >= 0 {
+					sum += math.Abs(luma[at(along, below)] - value)
+				}
+			}
+			energy[along+1] = energy[along] + sum
+		}
+		for start := 0; start+window <= length; start++ {
+			if score := energy[start+window] - energy[start]; score >
+				bestScore {
+				best, bestScore = start, score
+			}
+		}
+	}
+
+	offset := image.Point{}
+	if horizontal {
+		offset.X = min(size.X-crop.X, int(math.Round(float64(best)*
+			float64(size.X)/float64(smallSize.X))))
+	} else {
+		offset.Y = min(size.Y-crop.Y, int(math.Round(float64(best)*
+			float64(size.Y)/float64(smallSize.Y))))
+	}
+	return offset
+}
+
+// CoerceImageWithOpts coerces an image to dimensions from the aspect ratios
+// table as CoerceImage does, fitting it to them as `opts.Mode` says, and
+// reports where the source ended up in the coerced image. The image is
+// returned as it is if it needs neither scaling, turning upright nor
+// re-encoding as a PNG.
+func (ars *AspectRatios) CoerceImageWithOpts(
+	raw *[]byte,
+	opts *CoerceImageOpts,
+) (*CoerceResult, error) {
+	if opts == nil {
+		opts = NewCoerceImageOpts()
+	}
+	info, err := DecodeImageInfo(raw)
+	if err != nil {
+		return nil, err
+	}
+	format, origDim := info.Format, &info.Size
+	img, alpha, alphaApplied, err := applyAlphaPolicy(info.Image, opts.Alpha,
+		opts.AlphaColor)
+	if err != nil {
+		return nil, err
+	}
+	result := &CoerceResult{
+		Source:      *origDim,
+		Format:      format,
+		Orientation: info.Orientation,
+		Profile:     info.Profile,
+		Mode:        opts.Mode,
+		Crop:        image.Rectangle{Max: *origDim},
+		Placement:   image.Rectangle{Max: *origDim},
+	}
+	var target image.Point
+	switch {
+	case opts.Aspect != "":
+		aspect, ok := ars.Table[opts.Aspect]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q is not in the table",
+				ErrUnknownAspect, opts.Aspect)
+		}
+		target = image.Point{X: int(aspect.WidthPixels),
+			Y: int(aspect.HeightPixels)}
+	case opts.Mode == CoerceStretch:
+		width, height := ars.NearestAspectWH(uint64(origDim.X),
+			uint64(origDim.Y), MaxPixels)
+		target = image.Point{X: int(width), Y: int(height)}
+	default:
+		aspect, ok := ars.NearestRatio(uint64(origDim.X), uint64(origDim.Y))
+		if !ok {
+			return nil, fmt.Errorf("%w: the table is empty", ErrUnknownAspect)
+		}
+		target = image.Point{X: int(aspect.WidthPixels),
+			Y: int(aspect.HeightPixels)}
+	}
+	result.Size = target
+
+	switch opts.Mode {
+	case CoerceStretch:
+		result.Placement = image.Rectangle{Max: target}
+	case CoercePad:
+		fitted := image.Point{X: min(target.X, fitLength(target.Y, origDim.X,
+			origDim.Y)), Y: target.Y}
+		if origDim.X*target.Y > origDim.Y*target.X {
+			fitted = image.Point{X: target.X, Y: min(target.Y,
+				fitLength(target.X, origDim.Y, origDim.X))}
+		}
+		result.Placement = AnchorPlacement(fitted, target, DirectionCenter)
+	case CoerceCenterCrop, CoerceSmartCrop:
+		crop := coverCrop(*origDim, target)
+		offset := origDim.Sub(crop).Div(2)
+		if opts.Mode == CoerceSmartCrop {
+			offset = smartCrop(img, crop, opts.Metric)
+		}
+		result.Crop = image.Rectangle{Min: offset, Max: offset.Add(crop)}
+		result.Placement = image.Rectangle{Max: target}
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnknownCoerceMode, int(opts.Mode))
+	}
+
+	// fit scales the crop of `src` to its placement, on a canvas of `fill`
+	// if it does not cover the target.
+	fit := func(
+		src image.Image,
+		fill color.Color,
+		filter imaging.ResampleFilter,
+		policy AlphaPolicy,
+	) image.Image {
+		bounds := src.Bounds()
+		if result.Crop.Size() != bounds.Size() {
+			src = imaging.Crop(src, result.Crop.Add(bounds.Min))
+		}
+		if result.Placement.Size() != result.Crop.Size() {
+			src = resizeWithAlpha(src, result.Placement.Dx(),
+				result.Placement.Dy(), filter, policy)
+		}
+		if result.Placement == (image.Rectangle{Max: target}) {
+			return src
+		}
+		canvas := imaging.New(target.X, target.Y, fill)
+		draw.Draw(canvas, result.Placement, src, src.Bounds().Min, draw.Src)
+		return canvas
+	}
+	padColor := opts.PadColor
+	if padColor == nil {
+		padColor = color.Transparent
+	}
+	coerced := fit(img, padColor, imaging.Lanczos, opts.Alpha)
+	if alpha != nil {
+		// The padding is kept, and the source's transparent pixels
+		// generated.
+		if result.Mask, err = EncodePng(fit(alpha, color.White,
+			imaging.Linear, AlphaKeep), png.BestSpeed); err != nil {
+			return nil, err
+		}
+	}
+
+	// A source converted from its profile is only left as it is if it is to
+	// keep the profile.
+	converted := info.Profile != nil && info.Profile.Converted
+	if target == *origDim && result.Crop.Size() == *origDim &&
+		format == "png" && info.Orientation == OrientationNormal &&
+		(!converted || opts.KeepProfile) && !alphaApplied {
+		result.Coerced = raw
+		return result, nil
+	}
+	var profile *ICCProfile
+	if opts.KeepProfile {
+		profile = info.Profile
+	}
+	if result.Coerced, err = EncodePngWithProfile(coerced, png.BestSpeed,
+		profile); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
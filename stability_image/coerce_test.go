@@ -0,0 +1,160 @@
+package stability_image
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// detailedStrip returns a flat gray strip of `size` with a checkered patch
+// the height of the strip, starting `at` across it.
+func detailedStrip(size image.Point, at int) *image.NRGBA {
+	strip := image.NewNRGBA(image.Rectangle{Max: size})
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			level := uint8(128)
+			if x >= at && x < at+size.Y {
+				level = uint8(40 + 170*((x/7+y/7)%2) + (x*y)%13)
+			}
+			strip.SetNRGBA(x, y, color.NRGBA{level, level, level, 255})
+		}
+	}
+	return strip
+}
+
+func TestCoerceImageWithOpts(t *testing.T) {
+	aspects := NewAspectRatios(1048576, 64, 256, 1536)
+	strip := detailedStrip(image.Point{X: 960, Y: 320}, 600)
+	raw, err := EncodePng(strip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Crops take a square window of the strip, either from its middle or
+	// where the detail is.
+	for _, test := range []struct {
+		mode   CoerceMode
+		metric CropMetric
+		minX   int
+		maxX   int
+	}{
+		{CoerceCenterCrop, CropMetricEnergy, 320, 320},
+		{CoerceSmartCrop, CropMetricEnergy, 560, 640},
+		{CoerceSmartCrop, CropMetricEntropy, 560, 640},
+	} {
+		opts := NewCoerceImageOpts()
+		opts.Mode = test.mode
+		opts.Metric = test.metric
+		opts.Aspect = "1:1"
+		result, coerceErr := aspects.CoerceImageWithOpts(raw, opts)
+		if coerceErr != nil {
+			t.Fatal(coerceErr)
+		}
+		if result.Crop.Size() != (image.Point{X: 320, Y: 320}) ||
+			result.Crop.Min.X < test.minX || result.Crop.Min.X > test.maxX ||
+			result.Placement != (image.Rectangle{Max: result.Size}) {
+			t.Error(test.mode, test.metric, "cropped", result.Crop, "to",
+				result.Placement)
+		}
+		_, _, coercedDim, decodeErr := DecodeImage(result.Coerced)
+		if decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+		if *coercedDim != result.Size || result.Size.X != result.Size.Y {
+			t.Error(test.mode, "coerced to", *coercedDim, result.Size)
+		}
+		// The middle of the coerced image maps back to the middle of the
+		// crop.
+		middle := result.Size.Div(2)
+		if source := result.ToSource(middle); source.Sub(result.Crop.Min.Add(
+			result.Crop.Size().Div(2))).X > 1 {
+			t.Error(test.mode, "maps", middle, "back to", source)
+		}
+		if test.mode == CoerceSmartCrop && test.metric == CropMetricEnergy {
+			os.MkdirAll(OutputDir, 0755)
+			if writeErr := ioutil.WriteFile(OutputDir+"/smart_crop.png",
+				*result.Coerced, 0644); writeErr != nil {
+				t.Fatal(writeErr)
+			}
+		}
+	}
+
+	// Padding fits the whole strip in, centered between bars of the pad
+	// color.
+	opts := NewCoerceImageOpts()
+	opts.Mode = CoercePad
+	opts.Aspect = "1:1"
+	opts.PadColor = color.NRGBA{R: 255, A: 255}
+	result, err := aspects.CoerceImageWithOpts(raw, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Crop != strip.Bounds() || result.Placement.Dx() !=
+		result.Size.X || abs(result.Placement.Min.Y-(result.Size.Y-
+		result.Placement.Dy())/2) > 1 ||
+		result.Placement.Dy() != result.Size.X/3 {
+		t.Error("padded", result.Crop, "to", result.Placement, "of",
+			result.Size)
+	}
+	padded, _, _, err := DecodeImage(result.Coerced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if colorDistance(padded.At(0, 0), opts.PadColor) > 0 ||
+		colorDistance(padded.At(result.Size.X/2, result.Size.Y/2),
+			strip.At(480, 160)) > 8 {
+		t.Error("unexpected padding", padded.At(0, 0))
+	}
+	for _, point := range []image.Point{{0, 0}, {600, 100}, {959, 319}} {
+		if back := result.ToSource(result.FromSource(point)); back.Sub(
+			point).X > 2 || back.Sub(point).Y > 2 {
+			t.Error("padding maps", point, "back to", back)
+		}
+	}
+
+	// Stretching is what CoerceImage does, and leaves fitting PNGs be.
+	coerced, origDim, format, scaledDim, err := aspects.CoerceImage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = aspects.CoerceImageWithOpts(raw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(*coerced, *result.Coerced) || *origDim != result.Source ||
+		format != "png" || *scaledDim != result.Size ||
+		result.Crop != strip.Bounds() {
+		t.Error("stretching differs from CoerceImage", *scaledDim,
+			result.Size)
+	}
+	fitting, err := EncodePng(image.NewNRGBA(image.Rectangle{Max: result.Size}),
+		0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err = aspects.CoerceImageWithOpts(fitting, nil); err != nil ||
+		result.Coerced != fitting {
+		t.Error("fitting image was coerced", err)
+	}
+
+	opts.Aspect = "7:3"
+	if _, err = aspects.CoerceImageWithOpts(raw, opts); !errors.Is(err,
+		ErrUnknownAspect) {
+		t.Error("unknown aspect was not reported", err)
+	}
+	var mode CoerceMode
+	if err = json.Unmarshal([]byte(`"smart"`), &mode); err != nil ||
+		mode != CoerceSmartCrop {
+		t.Error("mode alias was not decoded", mode, err)
+	}
+	var metric CropMetric
+	if err = json.Unmarshal([]byte(`"contrast"`), &metric); !errors.Is(err,
+		ErrUnknownCropMetric) {
+		t.Error("unknown metric was not reported", err)
+	}
+}
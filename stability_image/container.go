@@ -0,0 +1,110 @@
+package stability_image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// pngSignature starts every PNG.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// isJpeg, isPng and isWebp tell the container of an encoded image by its
+// signature.
+func isJpeg(raw []byte) bool {
+	return bytes.HasPrefix(raw, []byte{0xff, 0xd8})
+}
+
+func isPng(raw []byte) bool {
+	return bytes.HasPrefix(raw, pngSignature)
+}
+
+func isWebp(raw []byte) bool {
+	return len(raw) >= 12 && bytes.Equal(raw[:4], []byte("RIFF")) &&
+		bytes.Equal(raw[8:12], []byte("WEBP"))
+}
+
+// jpegSegments calls `fn` with the marker and data of each segment of a
+// JPEG up to the start of the scan, until `fn` returns false.
+func jpegSegments(raw []byte, fn func(marker byte, data []byte) bool) {
+	pos := 2
+	for pos+4 <= len(raw) {
+		if raw[pos] != 0xff {
+			return
+		}
+		marker := raw[pos+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte before a marker.
+			pos++
+			continue
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd8):
+			// Markers without a length.
+			pos += 2
+			continue
+		case marker == 0xda || marker == 0xd9:
+			return
+		}
+		length := int(binary.BigEndian.Uint16(raw[pos+2:]))
+		if length < 2 || pos+2+length > len(raw) {
+			return
+		}
+		if !fn(marker, raw[pos+4:pos+2+length]) {
+			return
+		}
+		pos += 2 + length
+	}
+}
+
+// pngChunks calls `fn` with the type and data of each chunk of a PNG up to
+// IEND, until `fn` returns false.
+func pngChunks(raw []byte, fn func(chunk string, data []byte) bool) {
+	// Chunks are a length, a type, the data and a CRC.
+	for pos := len(pngSignature); pos+12 <= len(raw); {
+		length := int(binary.BigEndian.Uint32(raw[pos:]))
+		chunk := string(raw[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(raw) || chunk == "IEND" {
+			return
+		}
+		if !fn(chunk, raw[pos+8:pos+8+length]) {
+			return
+		}
+		pos += 12 + length
+	}
+}
+
+// webpChunks calls `fn` with the FourCC and data of each chunk of a WebP,
+// until `fn` returns false.
+func webpChunks(raw []byte, fn func(chunk string, data []byte) bool) {
+	// Chunks are a FourCC, a little-endian length and the data, padded to
+	// an even length.
+	for pos := 12; pos+8 <= len(raw); {
+		length := int(binary.LittleEndian.Uint32(raw[pos+4:]))
+		if length < 0 || pos+8+length > len(raw) {
+			return
+		}
+		if !fn(string(raw[pos:pos+4]), raw[pos+8:pos+8+length]) {
+			return
+		}
+		pos += 8 + length + length%2
+	}
+}
+
+// pngWithChunk returns an encoded PNG with a chunk of type `chunk` holding
+// `data` inserted after its IHDR, where metadata chunks that must precede
+// the image data can go.
+func pngWithChunk(encoded []byte, chunk string, data []byte) []byte {
+	// The signature is followed by the IHDR, with its 13 bytes of data.
+	ihdrEnd := len(pngSignature) + 12 + 13
+	if len(encoded) < ihdrEnd {
+		return encoded
+	}
+	body := append([]byte(chunk), data...)
+	inserted := make([]byte, 0, len(encoded)+len(body)+8)
+	inserted = append(inserted, encoded[:ihdrEnd]...)
+	inserted = binary.BigEndian.AppendUint32(inserted, uint32(len(data)))
+	inserted = append(inserted, body...)
+	inserted = binary.BigEndian.AppendUint32(inserted,
+		crc32.ChecksumIEEE(body))
+	return append(inserted, encoded[ihdrEnd:]...)
+}
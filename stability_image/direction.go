@@ -1,6 +1,12 @@
 package stability_image
 
-import "image"
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+var ErrUnknownDirection = errors.New("unknown direction")
 
 type Direction int
 
@@ -10,18 +16,29 @@ const (
 	DirectionLeft
 	DirectionDown
 	DirectionUp
+	DirectionUpLeft
+	DirectionUpRight
+	DirectionDownLeft
+	DirectionDownRight
+	// DirectionCount is the number of directions, for iterating over them.
+	DirectionCount
 )
 
 var DirectionMatrix = map[Direction]image.Point{
-	DirectionCenter: {0, 0},
-	DirectionRight:  {1, 0},
-	DirectionLeft:   {-1, 0},
-	DirectionUp:     {0, -1},
-	DirectionDown:   {0, 1},
+	DirectionCenter:    {0, 0},
+	DirectionRight:     {1, 0},
+	DirectionLeft:      {-1, 0},
+	DirectionUp:        {0, -1},
+	DirectionDown:      {0, 1},
+	DirectionUpLeft:    {-1, -1},
+	DirectionUpRight:   {1, -1},
+	DirectionDownLeft:  {-1, 1},
+	DirectionDownRight: {1, 1},
 }
 
 func (dir Direction) String() string {
-	return [...]string{"center", "right", "left", "down", "up"}[dir]
+	return [...]string{"center", "right", "left", "down", "up",
+		"up-left", "up-right", "down-left", "down-right"}[dir]
 }
 
 func (dir *Direction) FromString(s string) {
@@ -36,7 +53,42 @@ func (dir *Direction) FromString(s string) {
 		*dir = DirectionUp
 	case "down":
 		*dir = DirectionDown
+	case "up-left", "top-left":
+		*dir = DirectionUpLeft
+	case "up-right", "top-right":
+		*dir = DirectionUpRight
+	case "down-left", "bottom-left":
+		*dir = DirectionDownLeft
+	case "down-right", "bottom-right":
+		*dir = DirectionDownRight
+	}
+}
+
+func (dir Direction) MarshalText() ([]byte, error) {
+	if dir < DirectionCenter || dir >= DirectionCount {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownDirection, int(dir))
 	}
+	return []byte(dir.String()), nil
+}
+
+func (dir *Direction) UnmarshalText(text []byte) error {
+	parsed := Direction(-1)
+	parsed.FromString(string(text))
+	if parsed < 0 {
+		return fmt.Errorf("%w: %q", ErrUnknownDirection, text)
+	}
+	*dir = parsed
+	return nil
+}
+
+// DirectionFromMatrix returns the Direction for a DirectionMatrix vector.
+func DirectionFromMatrix(p image.Point) Direction {
+	for dir, v := range DirectionMatrix {
+		if v == p {
+			return dir
+		}
+	}
+	return DirectionCenter
 }
 
 func (dir Direction) IsHorizontal() bool {
@@ -47,6 +99,11 @@ func (dir Direction) IsVertical() bool {
 	return dir == DirectionUp || dir == DirectionDown
 }
 
+func (dir Direction) IsCorner() bool {
+	v := DirectionMatrix[dir]
+	return v.X != 0 && v.Y != 0
+}
+
 func (dir Direction) IsUpperOrLeft() bool {
 	return dir == DirectionUp || dir == DirectionLeft
 }
@@ -54,3 +111,15 @@ func (dir Direction) IsUpperOrLeft() bool {
 func (dir Direction) IsLowerOrRight() bool {
 	return dir == DirectionDown || dir == DirectionRight
 }
+
+// Horizontal returns the horizontal component of the direction: left, right
+// or center.
+func (dir Direction) Horizontal() Direction {
+	return DirectionFromMatrix(image.Point{X: DirectionMatrix[dir].X})
+}
+
+// Vertical returns the vertical component of the direction: up, down or
+// center.
+func (dir Direction) Vertical() Direction {
+	return DirectionFromMatrix(image.Point{Y: DirectionMatrix[dir].Y})
+}
@@ -0,0 +1,522 @@
+package stability_image
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/disintegration/imaging"
+)
+
+var ErrInvalidProfile = errors.New("invalid ICC profile")
+
+const (
+	// iccHeaderSize is the size of the header of an ICC profile, which the
+	// tag table follows.
+	iccHeaderSize = 128
+	// iccMaxSize bounds the size of the profiles decompressed from PNGs.
+	iccMaxSize = 16 << 20
+	// iccEncodeLevels is the number of entries in the tables encoding
+	// linear light, which are indexed by its square root to keep the
+	// shadows precise.
+	iccEncodeLevels = 4096
+	// iccProfileName is the name PNGs embed profiles under.
+	iccProfileName = "ICC Profile"
+)
+
+// iccJpegHeader starts each APP2 segment of a JPEG holding part of an ICC
+// profile, followed by the segment's sequence number and the count.
+var iccJpegHeader = []byte("ICC_PROFILE\x00")
+
+// srgbToXYZ converts linear sRGB to XYZ, adapted to the D50 white point of
+// the ICC profile connection space.
+var srgbToXYZ = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// iccCurve maps an encoded level from 0 to 1 to linear light.
+type iccCurve func(float64) float64
+
+// ICCProfile is an ICC color profile embedded in an image. Images in RGB
+// matrix/TRC profiles, such as Display P3 and Adobe RGB, are converted to
+// sRGB on decode. Others are left as they are.
+type ICCProfile struct {
+	// Data is the profile as it was embedded.
+	Data []byte `json:"-"`
+	// Description is the profile's name, if it has one.
+	Description string `json:"description,omitempty"`
+	// ColorSpace is the color space of the images in the profile, such as
+	// "RGB" or "CMYK".
+	ColorSpace string `json:"color_space"`
+	// Converted reports whether images are converted from the profile to
+	// sRGB on decode, which they are unless it is sRGB already or not a
+	// matrix/TRC RGB profile.
+	Converted bool `json:"converted"`
+
+	// toXYZ converts the profile's linear light to XYZ, and curves
+	// linearize each of its channels.
+	toXYZ  [3][3]float64
+	curves [3]iccCurve
+}
+
+// iccTransform converts 8-bit pixels from one RGB color space to another
+// through linear light.
+type iccTransform struct {
+	decode [3][256]float64
+	matrix [3][3]float64
+	encode [3][iccEncodeLevels]uint8
+}
+
+// ParseICCProfile parses the parts of an ICC profile needed to convert
+// images between it and sRGB.
+func ParseICCProfile(data []byte) (*ICCProfile, error) {
+	if len(data) < iccHeaderSize+4 ||
+		!bytes.Equal(data[36:40], []byte("acsp")) {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalidProfile)
+	}
+	profile := &ICCProfile{
+		Data:       data,
+		ColorSpace: strings.TrimSpace(string(data[16:20])),
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[iccHeaderSize:]))
+	for tag := 0; tag < count; tag++ {
+		pos := iccHeaderSize + 4 + tag*12
+		if pos+12 > len(data) {
+			return nil, fmt.Errorf("%w: truncated tag table",
+				ErrInvalidProfile)
+		}
+		offset := int(binary.BigEndian.Uint32(data[pos+4:]))
+		size := int(binary.BigEndian.Uint32(data[pos+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, fmt.Errorf("%w: tag %q is out of bounds",
+				ErrInvalidProfile, data[pos:pos+4])
+		}
+		tags[string(data[pos:pos+4])] = data[offset : offset+size]
+	}
+	profile.Description = iccText(tags["desc"])
+
+	if profile.ColorSpace != "RGB" || string(data[20:24]) != "XYZ " {
+		return profile, nil
+	}
+	for channel, prefix := range []string{"r", "g", "b"} {
+		column, ok := iccXYZ(tags[prefix+"XYZ"])
+		if !ok {
+			return profile, nil
+		}
+		for row := range column {
+			profile.toXYZ[row][channel] = column[row]
+		}
+		if profile.curves[channel], ok = iccParseCurve(
+			tags[prefix+"TRC"]); !ok {
+			return profile, nil
+		}
+	}
+	if _, ok := invert3(profile.toXYZ); !ok {
+		return profile, nil
+	}
+	profile.Converted = !profile.isSRGB()
+	return profile, nil
+}
+
+// ReadICCProfile returns the ICC profile embedded in an encoded JPEG, PNG
+// or WebP, without decoding it, or nil if there is none.
+func ReadICCProfile(raw []byte) (*ICCProfile, error) {
+	var (
+		data []byte
+		err  error
+	)
+	switch {
+	case isJpeg(raw):
+		// The profile is split across APP2 segments, numbered from 1.
+		segments := map[int][]byte{}
+		total := 0
+		jpegSegments(raw, func(marker byte, segment []byte) bool {
+			if marker == 0xe2 && bytes.HasPrefix(segment, iccJpegHeader) &&
+				len(segment) >= len(iccJpegHeader)+2 {
+				sequence := int(segment[len(iccJpegHeader)])
+				total = int(segment[len(iccJpegHeader)+1])
+				segments[sequence] = segment[len(iccJpegHeader)+2:]
+			}
+			return true
+		})
+		for sequence := 1; sequence <= total; sequence++ {
+			segment, ok := segments[sequence]
+			if !ok {
+				return nil, fmt.Errorf("%w: segment %d of %d is missing",
+					ErrInvalidProfile, sequence, total)
+			}
+			data = append(data, segment...)
+		}
+	case isPng(raw):
+		pngChunks(raw, func(chunk string, chunkData []byte) bool {
+			if chunk != "iCCP" {
+				return true
+			}
+			data, err = iccInflate(chunkData)
+			return false
+		})
+	case isWebp(raw):
+		webpChunks(raw, func(chunk string, chunkData []byte) bool {
+			if chunk == "ICCP" {
+				data = chunkData
+				return false
+			}
+			return true
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	return ParseICCProfile(data)
+}
+
+// iccInflate decompresses the profile of an iCCP chunk, which follows its
+// name and compression method.
+func iccInflate(chunk []byte) ([]byte, error) {
+	nameEnd := bytes.IndexByte(chunk, 0)
+	if nameEnd < 0 || nameEnd+2 > len(chunk) || chunk[nameEnd+1] != 0 {
+		return nil, fmt.Errorf("%w: malformed iCCP chunk", ErrInvalidProfile)
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(chunk[nameEnd+2:]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProfile, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, iccMaxSize))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProfile, err)
+	}
+	return data, nil
+}
+
+// iccFixed reads an s15Fixed16Number.
+func iccFixed(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 65536
+}
+
+// iccXYZ reads the single value of an XYZType tag.
+func iccXYZ(tag []byte) ([3]float64, bool) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+	return [3]float64{iccFixed(tag[8:]), iccFixed(tag[12:]),
+		iccFixed(tag[16:])}, true
+}
+
+// iccParseCurve reads a curveType or parametricCurveType tag.
+func iccParseCurve(tag []byte) (iccCurve, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		if count < 0 || len(tag) < 12+count*2 {
+			return nil, false
+		}
+		switch count {
+		case 0:
+			return func(x float64) float64 { return x }, true
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, true
+		}
+		table := make([]float64, count)
+		for entry := range table {
+			table[entry] = float64(binary.BigEndian.Uint16(
+				tag[12+entry*2:])) / 65535
+		}
+		return func(x float64) float64 {
+			at := max(0, min(1, x)) * float64(count-1)
+			entry := min(int(at), count-2)
+			return table[entry] + (at-float64(entry))*(table[entry+1]-
+				table[entry])
+		}, true
+	case "para":
+		function := int(binary.BigEndian.Uint16(tag[8:]))
+		if function > 4 {
+			return nil, false
+		}
+		count := [...]int{1, 3, 4, 5, 7}[function]
+		if len(tag) < 12+count*4 {
+			return nil, false
+		}
+		// The parameters are g, a, b, c, d, e and f, as many as the
+		// function takes, with the rest making it reduce to the simpler
+		// functions.
+		params := []float64{1, 1, 0, 0, 0, 0, 0}
+		for param := 0; param < count; param++ {
+			params[param] = iccFixed(tag[12+param*4:])
+		}
+		g, a, b, c, d, e, f := params[0], params[1], params[2], params[3],
+			params[4], params[5], params[6]
+		switch function {
+		case 1, 2:
+			// Below -b/a, the curve is c, or 0.
+			d = -b / a
+			e, f = c, c
+			c = 0
+		}
+		return func(x float64) float64 {
+			if x >= d {
+				return math.Pow(max(0, a*x+b), g) + e
+			}
+			return c*x + f
+		}, true
+	}
+	return nil, false
+}
+
+// iccText reads a textDescriptionType or multiLocalizedUnicodeType tag,
+// taking the first of its localizations.
+func iccText(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		length := int(binary.BigEndian.Uint32(tag[8:]))
+		if length < 0 || len(tag) < 12+length {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+length]), "\x00")
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if length < 0 || offset < 0 || offset+length > len(tag) {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for unit := range units {
+			units[unit] = binary.BigEndian.Uint16(tag[offset+unit*2:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
+
+// srgbLinear decodes an sRGB level from 0 to 1 to linear light.
+func srgbLinear(x float64) float64 {
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+// srgbEncode encodes linear light to an sRGB level from 0 to 1.
+func srgbEncode(linear float64) float64 {
+	if linear <= 0.0031308 {
+		return linear * 12.92
+	}
+	return 1.055*math.Pow(linear, 1/2.4) - 0.055
+}
+
+// mul3 multiplies two 3x3 matrices.
+func mul3(a [3][3]float64, b [3][3]float64) (product [3][3]float64) {
+	for row := 0; row < 3; row++ {
+		for column := 0; column < 3; column++ {
+			for k := 0; k < 3; k++ {
+				product[row][column] += a[row][k] * b[k][column]
+			}
+		}
+	}
+	return product
+}
+
+// invert3 inverts a 3x3 matrix, reporting false if it is singular.
+func invert3(m [3][3]float64) (inverse [3][3]float64, ok bool) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if math.Abs(det) < 1e-9 {
+		return inverse, false
+	}
+	for row := 0; row < 3; row++ {
+		for column := 0; column < 3; column++ {
+			// The inverse is the transposed cofactors over the determinant.
+			r0, r1 := (column+1)%3, (column+2)%3
+			c0, c1 := (row+1)%3, (row+2)%3
+			inverse[row][column] = (m[r0][c0]*m[r1][c1] -
+				m[r0][c1]*m[r1][c0]) / det
+		}
+	}
+	return inverse, true
+}
+
+// newICCTransform builds a transform decoding each channel with `decode`,
+// converting linear light with `matrix` and encoding it with `encode`.
+func newICCTransform(
+	decode [3]iccCurve,
+	matrix [3][3]float64,
+	encode [3]iccCurve,
+) *iccTransform {
+	transform := &iccTransform{matrix: matrix}
+	for channel := 0; channel < 3; channel++ {
+		for level := 0; level < 256; level++ {
+			transform.decode[channel][level] = decode[channel](
+				float64(level) / 255)
+		}
+		for entry := 0; entry < iccEncodeLevels; entry++ {
+			root := float64(entry) / (iccEncodeLevels - 1)
+			transform.encode[channel][entry] = uint8(math.Round(max(0,
+				min(1, encode[channel](root*root))) * 255))
+		}
+	}
+	return transform
+}
+
+// pixel converts a pixel's color channels in place.
+func (t *iccTransform) pixel(pix []uint8) {
+	linear := [3]float64{t.decode[0][pix[0]], t.decode[1][pix[1]],
+		t.decode[2][pix[2]]}
+	for channel := 0; channel < 3; channel++ {
+		value := t.matrix[channel][0]*linear[0] +
+			t.matrix[channel][1]*linear[1] + t.matrix[channel][2]*linear[2]
+		entry := math.Sqrt(max(0, min(1, value))) * (iccEncodeLevels - 1)
+		pix[channel] = t.encode[channel][int(entry+0.5)]
+	}
+}
+
+// apply returns a copy of `img` converted by the transform.
+func (t *iccTransform) apply(img image.Image) *image.NRGBA {
+	converted := imaging.Clone(img)
+	bounds := converted.Bounds()
+	parallelRows(bounds.Min.Y, bounds.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := converted.Pix[converted.PixOffset(bounds.Min.X, y):]
+			for x := 0; x < bounds.Dx(); x++ {
+				t.pixel(row[x*4:])
+			}
+		}
+	})
+	return converted
+}
+
+// inverseCurve returns the inverse of a curve, which is assumed to be
+// increasing, found by bisection.
+func inverseCurve(curve iccCurve) iccCurve {
+	return func(linear float64) float64 {
+		lo, hi := 0.0, 1.0
+		for step := 0; step < 24; step++ {
+			mid := (lo + hi) / 2
+			if curve(mid) < linear {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		return (lo + hi) / 2
+	}
+}
+
+// toSRGB returns the transform from the profile to sRGB.
+func (p *ICCProfile) toSRGB() *iccTransform {
+	fromXYZ, _ := invert3(srgbToXYZ)
+	return newICCTransform(p.curves, mul3(fromXYZ, p.toXYZ),
+		[3]iccCurve{srgbEncode, srgbEncode, srgbEncode})
+}
+
+// fromSRGB returns the transform from sRGB to the profile.
+func (p *ICCProfile) fromSRGB() *iccTransform {
+	fromXYZ, _ := invert3(p.toXYZ)
+	return newICCTransform([3]iccCurve{srgbLinear, srgbLinear, srgbLinear},
+		mul3(fromXYZ, srgbToXYZ), [3]iccCurve{inverseCurve(p.curves[0]),
+			inverseCurve(p.curves[1]), inverseCurve(p.curves[2])})
+}
+
+// isSRGB reports whether converting ramps of each channel and of gray from
+// the profile to sRGB leaves them within a level of where they were.
+func (p *ICCProfile) isSRGB() bool {
+	transform := p.toSRGB()
+	for level := 0; level < 256; level += 15 {
+		for _, ramp := range [][3]uint8{{uint8(level), 0, 0},
+			{0, uint8(level), 0}, {0, 0, uint8(level)},
+			{uint8(level), uint8(level), uint8(level)}} {
+			pix := ramp
+			transform.pixel(pix[:])
+			for channel := range pix {
+				if abs(int(pix[channel])-int(ramp[channel])) > 1 {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// ToSRGB converts `img` from the profile to sRGB, or returns it as it is if
+// the profile is not Converted.
+func (p *ICCProfile) ToSRGB(img image.Image) image.Image {
+	if !p.Converted {
+		return img
+	}
+	return p.toSRGB().apply(img)
+}
+
+// FromSRGB converts `img` from sRGB to the profile, or returns it as it is
+// if the profile is not Converted.
+func (p *ICCProfile) FromSRGB(img image.Image) image.Image {
+	if !p.Converted {
+		return img
+	}
+	return p.fromSRGB().apply(img)
+}
+
+// EncodePngWithProfile encodes `img`, in sRGB, as a PNG in `profile`: it is
+// converted to the profile, which is embedded along with it. A nil profile
+// encodes it as EncodePng does.
+func EncodePngWithProfile(
+	img image.Image,
+	level png.CompressionLevel,
+	profile *ICCProfile,
+) (*[]byte, error) {
+	if profile == nil {
+		return EncodePng(img, level)
+	}
+	encoded, err := EncodePng(profile.FromSRGB(img), level)
+	if err != nil {
+		return nil, err
+	}
+	var compressed bytes.Buffer
+	compressed.WriteString(iccProfileName + "\x00\x00")
+	writer := zlib.NewWriter(&compressed)
+	if _, err = writer.Write(profile.Data); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	embedded := pngWithChunk(*encoded, "iCCP", compressed.Bytes())
+	return &embedded, nil
+}
+
+// AttachICCProfile re-encodes `encoded`, an sRGB image such as a generation
+// from a source decoded from `profile`, as a PNG in the profile, so that it
+// matches the source.
+func AttachICCProfile(
+	encoded *[]byte,
+	profile *ICCProfile,
+) (*[]byte, error) {
+	img, _, _, err := DecodeImage(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return EncodePngWithProfile(img, png.BestSpeed, profile)
+}
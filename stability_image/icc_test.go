@@ -0,0 +1,322 @@
+package stability_image
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+	"unicode/utf16"
+)
+
+// iccMatrixProfile returns a matrix/TRC ICC profile in `space`, with the
+// colorants in the columns of `toXYZ`, each channel linearized by the curve
+// tag `trc`, and described as `description` in a mluc tag, or a desc tag
+// if `legacy` is set.
+func iccMatrixProfile(
+	space string,
+	description string,
+	legacy bool,
+	toXYZ [3][3]float64,
+	trc []byte,
+) []byte {
+	var desc []byte
+	if legacy {
+		desc = append([]byte("desc\x00\x00\x00\x00"),
+			binary.BigEndian.AppendUint32(nil, uint32(len(description)+1))...)
+		desc = append(append(desc, description...), 0)
+	} else {
+		units := utf16.Encode([]rune(description))
+		desc = []byte("mluc\x00\x00\x00\x00")
+		for _, value := range []uint32{1, 12, 0x656e5553,
+			uint32(len(units) * 2), 28} {
+			desc = binary.BigEndian.AppendUint32(desc, value)
+		}
+		for _, unit := range units {
+			desc = binary.BigEndian.AppendUint16(desc, unit)
+		}
+	}
+	tags := []struct {
+		signature string
+		data      []byte
+	}{{"desc", desc}, {"rTRC", trc}, {"gTRC", trc}, {"bTRC", trc}}
+	for channel, signature := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz := []byte("XYZ \x00\x00\x00\x00")
+		for row := 0; row < 3; row++ {
+			xyz = binary.BigEndian.AppendUint32(xyz, uint32(int32(
+				math.Round(toXYZ[row][channel]*65536))))
+		}
+		tags = append(tags, struct {
+			signature string
+			data      []byte
+		}{signature, xyz})
+	}
+
+	profile := make([]byte, iccHeaderSize)
+	binary.BigEndian.PutUint32(profile[8:], 0x04300000)
+	copy(profile[12:], "mntr")
+	copy(profile[16:], space)
+	copy(profile[20:], "XYZ ")
+	copy(profile[36:], "acsp")
+	profile = binary.BigEndian.AppendUint32(profile, uint32(len(tags)))
+	offset := len(profile) + len(tags)*12
+	var data []byte
+	for _, tag := range tags {
+		profile = append(profile, tag.signature...)
+		profile = binary.BigEndian.AppendUint32(profile,
+			uint32(offset+len(data)))
+		profile = binary.BigEndian.AppendUint32(profile, uint32(len(tag.data)))
+		data = append(data, tag.data...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	profile = append(profile, data...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+// iccSRGBCurve returns a parametric curve tag of the sRGB transfer function.
+func iccSRGBCurve() []byte {
+	curve := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, param := range []float64{2.4, 1 / 1.055, 0.055 / 1.055,
+		1 / 12.92, 0.04045} {
+		curve = binary.BigEndian.AppendUint32(curve, uint32(int32(
+			math.Round(param*65536))))
+	}
+	return curve
+}
+
+// iccGammaCurve returns a curve tag of a gamma, in 8.8 fixed point.
+func iccGammaCurve(gamma uint16) []byte {
+	return binary.BigEndian.AppendUint16(
+		[]byte("curv\x00\x00\x00\x00\x00\x00\x00\x01"), gamma)
+}
+
+// iccTableCurve returns a curve tag tabulating the sRGB transfer function.
+func iccTableCurve(entries int) []byte {
+	curve := binary.BigEndian.AppendUint32([]byte("curv\x00\x00\x00\x00"),
+		uint32(entries))
+	for entry := 0; entry < entries; entry++ {
+		curve = binary.BigEndian.AppendUint16(curve, uint16(math.Round(
+			srgbLinear(float64(entry)/float64(entries-1))*65535)))
+	}
+	return curve
+}
+
+// withICCProfile returns an encoded JPEG or PNG with `profile` embedded in
+// it, split across `segments` APP2 segments for JPEGs.
+func withICCProfile(encoded []byte, profile []byte, segments int) []byte {
+	if !isJpeg(encoded) {
+		var compressed bytes.Buffer
+		compressed.WriteString("test\x00\x00")
+		writer := zlib.NewWriter(&compressed)
+		writer.Write(profile)
+		writer.Close()
+		return pngWithChunk(encoded, "iCCP", compressed.Bytes())
+	}
+	size := (len(profile) + segments - 1) / segments
+	for segment := segments; segment >= 1; segment-- {
+		part := profile[(segment-1)*size : min(len(profile), segment*size)]
+		data := append(append([]byte{}, iccJpegHeader...), byte(segment),
+			byte(segments))
+		encoded = jpegWithSegment(encoded, 0xe2, append(data, part...))
+	}
+	return encoded
+}
+
+// flatImage returns an image of `size` filled with `fill`.
+func flatImage(size image.Point, fill color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rectangle{Max: size})
+	for idx := 0; idx < len(img.Pix); idx += 4 {
+		copy(img.Pix[idx:], []uint8{fill.R, fill.G, fill.B, fill.A})
+	}
+	return img
+}
+
+func TestICCProfile(t *testing.T) {
+	displayP3 := iccMatrixProfile("RGB ", "Display P3", false,
+		[3][3]float64{
+			{0.51512, 0.29198, 0.15710},
+			{0.24120, 0.69225, 0.06657},
+			{-0.00105, 0.04189, 0.78407},
+		}, iccSRGBCurve())
+	adobeRGB := iccMatrixProfile("RGB ", "Adobe RGB (1998)", true,
+		[3][3]float64{
+			{0.60974, 0.20528, 0.14919},
+			{0.31111, 0.62567, 0.06322},
+			{0.01947, 0.06087, 0.74457},
+		}, iccGammaCurve(563))
+	sRGB := iccMatrixProfile("RGB ", "sRGB", false, srgbToXYZ,
+		iccTableCurve(1024))
+	cmyk := iccMatrixProfile("CMYK", "Coated", false, srgbToXYZ,
+		iccSRGBCurve())
+
+	source := color.NRGBA{200, 120, 60, 255}
+	img := flatImage(image.Point{X: 64, Y: 64}, source)
+	pngData, err := EncodePng(img, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jpegData bytes.Buffer
+	if err = jpeg.Encode(&jpegData, img, &jpeg.Options{Quality: 100}); err !=
+		nil {
+		t.Fatal(err)
+	}
+
+	// The expected colors were worked out independently from the profiles'
+	// matrices and curves.
+	for _, test := range []struct {
+		encoded     []byte
+		description string
+		converted   bool
+		expected    color.NRGBA
+		tolerance   int
+	}{
+		{withICCProfile(*pngData, displayP3, 1), "Display P3", true,
+			color.NRGBA{213, 115, 42, 255}, 1},
+		{withICCProfile(jpegData.Bytes(), displayP3, 1), "Display P3", true,
+			color.NRGBA{213, 115, 42, 255}, 3},
+		{withICCProfile(jpegData.Bytes(), adobeRGB, 3), "Adobe RGB (1998)",
+			true, color.NRGBA{224, 121, 53, 255}, 3},
+		{withICCProfile(*pngData, adobeRGB, 1), "Adobe RGB (1998)", true,
+			color.NRGBA{224, 121, 53, 255}, 1},
+		{withICCProfile(*pngData, sRGB, 1), "sRGB", false, source, 0},
+		{withICCProfile(*pngData, cmyk, 1), "Coated", false, source, 0},
+	} {
+		profile, readErr := ReadICCProfile(test.encoded)
+		if readErr != nil {
+			t.Fatal(test.description, readErr)
+		}
+		if profile == nil || profile.Description != test.description ||
+			profile.Converted != test.converted {
+			t.Error("unexpected profile", profile, "for", test.description)
+			continue
+		}
+		info, decodeErr := DecodeImageInfo(&test.encoded)
+		if decodeErr != nil {
+			t.Fatal(test.description, decodeErr)
+		}
+		if info.Profile == nil || info.Profile.Description !=
+			test.description || colorDistance(info.Image.At(32, 32),
+			test.expected) > test.tolerance {
+			t.Error(test.description, info.Format, "decoded to",
+				info.Image.At(32, 32), "rather than", test.expected)
+		}
+	}
+
+	// A profile missing a segment is reported, and ignored on decode.
+	broken := withICCProfile(jpegData.Bytes(), adobeRGB, 3)
+	broken = bytes.Replace(broken, append(append([]byte{}, iccJpegHeader...),
+		2, 3), append(append([]byte{}, iccJpegHeader...), 4, 3), 1)
+	if _, err = ReadICCProfile(broken); !errors.Is(err, ErrInvalidProfile) {
+		t.Error("missing segment was not reported", err)
+	}
+	decoded, _, _, err := DecodeImage(&broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if colorDistance(decoded.At(32, 32), source) > 3 {
+		t.Error("broken profile was applied", decoded.At(32, 32))
+	}
+
+	// Coercing leaves the source in sRGB, or with `KeepProfile`, converts
+	// it back and embeds the profile again.
+	aspects := NewAspectRatios(1048576, 64, 256, 1536)
+	fitting, err := EncodePng(flatImage(image.Point{X: 1024, Y: 1024},
+		source), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range [][]byte{
+		withICCProfile(*fitting, displayP3, 1),
+		withICCProfile(*pngData, displayP3, 1),
+	} {
+		for _, keep := range []bool{false, true} {
+			opts := NewCoerceImageOpts()
+			opts.KeepProfile = keep
+			result, coerceErr := aspects.CoerceImageWithOpts(&raw, opts)
+			if coerceErr != nil {
+				t.Fatal(coerceErr)
+			}
+			if result.Profile == nil || !result.Profile.Converted {
+				t.Error("profile was not recorded", result.Profile)
+			}
+			if (result.Coerced == &raw) != (keep && result.Source ==
+				result.Size) {
+				t.Error("fitting source was passed through:",
+					result.Coerced == &raw, "keeping profile:", keep)
+			}
+			embedded, readErr := ReadICCProfile(*result.Coerced)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if (embedded != nil) != keep || (keep &&
+				!bytes.Equal(embedded.Data, displayP3)) {
+				t.Error("unexpected embedded profile", embedded,
+					"keeping profile:", keep)
+			}
+			coerced, _, _, decodeErr := DecodeImage(result.Coerced)
+			if decodeErr != nil {
+				t.Fatal(decodeErr)
+			}
+			stored, _, decodeErr := image.Decode(bytes.NewReader(
+				*result.Coerced))
+			if decodeErr != nil {
+				t.Fatal(decodeErr)
+			}
+			storedColor := color.NRGBA{213, 115, 42, 255}
+			if keep {
+				storedColor = source
+			}
+			if colorDistance(coerced.At(100, 100), color.NRGBA{213, 115,
+				42, 255}) > 1 || colorDistance(stored.At(100, 100),
+				storedColor) > 1 {
+				t.Error("coerced to", coerced.At(100, 100), "stored as",
+					stored.At(100, 100), "keeping profile:", keep)
+			}
+			if !keep {
+				continue
+			}
+			encodedResult, jsonErr := json.Marshal(result)
+			if jsonErr != nil {
+				t.Fatal(jsonErr)
+			}
+			if !bytes.Contains(encodedResult,
+				[]byte(`"description":"Display P3"`)) {
+				t.Error("profile was not serialized", string(encodedResult))
+			}
+		}
+	}
+
+	// Generations in sRGB can be attached to the source's profile.
+	profile, err := ParseICCProfile(displayP3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := EncodePng(flatImage(image.Point{X: 8, Y: 8},
+		color.NRGBA{213, 115, 42, 255}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attached, err := AttachICCProfile(generated, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _, err := image.Decode(bytes.NewReader(*attached))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if colorDistance(stored.At(4, 4), source) > 1 {
+		t.Error("attached profile stored", stored.At(4, 4))
+	}
+	if _, err = ParseICCProfile([]byte("not a profile")); !errors.Is(err,
+		ErrInvalidProfile) {
+		t.Error("invalid profile was not reported", err)
+	}
+}
@@ -2,15 +2,19 @@ package stability_image
 
 import (
 	"bytes"
+	"fmt"
 	"image"
 	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"log"
+	"math"
 	"math/rand"
 	"os"
+	"runtime"
 	"strconv"
+	"sync"
 
 	"github.com/disintegration/imaging"
 	"github.com/esimov/stackblur-go"
@@ -48,68 +52,244 @@ func EncodePng(
 	return encoded, nil
 }
 
+// ImageInfo is a decoded image, along with what it was decoded from.
+type ImageInfo struct {
+	// Image is the decoded image, turned upright.
+	Image image.Image
+	// Format is the format it was decoded from.
+	Format string
+	// Size is the size of Image, upright.
+	Size image.Point
+	// Orientation is the orientation the source was stored in, which Image
+	// has been corrected for.
+	Orientation Orientation
+	// Profile is the ICC profile embedded in the source, if any. Image has
+	// been converted from it to sRGB if it is Converted.
+	Profile *ICCProfile
+}
+
+// DecodeImageInfo decodes `raw` within DefaultDecodeLimits, as
+// DecodeImageInfoWithLimits does.
+func DecodeImageInfo(raw *[]byte) (*ImageInfo, error) {
+	return DecodeImageInfoWithLimits(raw, &DefaultDecodeLimits)
+}
+
+// DecodeImageInfoWithLimits decodes `raw` once its header is within
+// `limits`, converts it to sRGB from the ICC profile embedded in it, and
+// turns it upright according to the orientation in its EXIF metadata.
+// Profiles that cannot be read are ignored.
+func DecodeImageInfoWithLimits(
+	raw *[]byte,
+	limits *DecodeLimits,
+) (*ImageInfo, error) {
+	if _, _, err := CheckDecodeLimits(*raw, limits); err != nil {
+		return nil, err
+	}
+	i, format, err := image.Decode(bytes.NewReader(*raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+	info := &ImageInfo{
+		Image:       i,
+		Format:      format,
+		Orientation: ReadOrientation(*raw),
+	}
+	if profile, profileErr := ReadICCProfile(*raw); profileErr == nil &&
+		profile != nil {
+		info.Profile = profile
+		i = profile.ToSRGB(i)
+	}
+	info.Image = info.Orientation.Upright(i)
+	info.Size = info.Image.Bounds().Size()
+	return info, nil
+}
+
+// DecodeImage decodes `raw` as DecodeImageInfo does, upright.
 func DecodeImage(raw *[]byte) (
 	i image.Image,
 	format string,
 	dim *image.Point,
 	err error) {
-	i, format, err = image.Decode(bytes.NewReader(*raw))
+	info, err := DecodeImageInfo(raw)
 	if err != nil {
 		return nil, "", dim, err
 	}
-	dimVal := i.Bounds().Size()
-	return i, format, &dimVal, err
+	return info.Image, info.Format, &info.Size, nil
+}
+
+// parallelRows splits the rows from `minY` to `maxY` into contiguous bands
+// and calls `fn` on each band from its own goroutine, returning once all the
+// bands are done.
+func parallelRows(minY int, maxY int, fn func(y0 int, y1 int)) {
+	rows := maxY - minY
+	workers := runtime.GOMAXPROCS(0)
+	if workers > rows {
+		workers = rows
+	}
+	if workers <= 1 {
+		fn(minY, maxY)
+		return
+	}
+	band := (rows + workers - 1) / workers
+	var wg sync.WaitGroup
+	for y0 := minY; y0 < maxY; y0 += band {
+		wg.Add(1)
+		go func(y0 int, y1 int) {
+			defer wg.Done()
+			fn(y0, y1)
+		}(y0, min(y0+band, maxY))
+	}
+	wg.Wait()
 }
 
+// Fill sets every pixel of `img` to `col`.
 func Fill(img *image.RGBA, col *color.RGBA) {
 	bounds := img.Bounds()
-	for x := bounds.Min.X; x < bounds.Max.X; x++ {
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			img.Set(x, y, col)
+	if bounds.Empty() {
+		return
+	}
+	pixel := []byte{col.R, col.G, col.B, col.A}
+	parallelRows(bounds.Min.Y, bounds.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := img.Pix[img.PixOffset(bounds.Min.X, y):img.PixOffset(
+				bounds.Max.X, y)]
+			for x := 0; x < len(row); x += 4 {
+				copy(row[x:x+4], pixel)
+			}
 		}
+	})
+}
+
+// randIntn returns the `Intn` of `rng`, falling back to the global source
+// of math/rand if `rng` is nil.
+func randIntn(rng *rand.Rand) func(n int) int {
+	if rng == nil {
+		return rand.Intn
 	}
+	return rng.Intn
 }
 
-// CreateNoiseImage creates a noise image with the given dimensions.
-func CreateNoiseImage(width int, height int) (i *image.RGBA, err error) {
-	i = image.NewRGBA(image.Rect(0, 0, width, height))
-	for x := 0; x < i.Rect.Max.X; x++ {
-		for y := 0; y < i.Rect.Max.Y; y++ {
-			i.Set(x, y, color.RGBA{
-				R: uint8(rand.Intn(255)),
-				G: uint8(rand.Intn(255)),
-				B: uint8(rand.Intn(255)),
-				A: 255,
-			})
+// randSeed draws a seed for per-row sources from `rng`, falling back to the
+// global source of math/rand if `rng` is nil.
+func randSeed(rng *rand.Rand) int64 {
+	if rng == nil {
+		return rand.Int63()
+	}
+	return rng.Int63()
+}
+
+// NewSeed returns a random non-zero seed, for use when the caller did not
+// pick one.
+func NewSeed() int64 {
+	for {
+		if seed := rand.Int63(); seed != 0 {
+			return seed
 		}
 	}
-	return i, nil
 }
 
-// ShufflePixelsImage shuffles the pixels of an image within a given bounds.
+// CreateNoiseImage creates a noise image with the given dimensions, drawing
+// from the global source of math/rand.
+func CreateNoiseImage(width int, height int) (i *image.RGBA, err error) {
+	return CreateNoiseImageWithRand(width, height, nil)
+}
+
+// CreateNoiseImageWithRand is CreateNoiseImage drawing from `rng`. If `rng`
+// is nil the global source of math/rand is used.
+func CreateNoiseImageWithRand(
+	width int,
+	height int,
+	rng *rand.Rand,
+) (i *image.RGBA, err error) {
+	return createNoiseImage(width, height, randSeed(rng)), nil
+}
+
+// createNoiseImage fills a new image with noise, three channels per pixel.
+// Each row draws from its own source seeded from `seed`, so the rows are
+// filled in parallel and the same seed always gives the same image.
+func createNoiseImage(width int, height int, seed int64) *image.RGBA {
+	i := image.NewRGBA(image.Rect(0, 0, width, height))
+	parallelRows(0, height, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			rng := rowRand(seed, 0, y)
+			row := i.Pix[i.PixOffset(0, y):i.PixOffset(width, y)]
+			for offset := 0; offset < len(row); offset += 4 {
+				row[offset] = uint8(rng.Intn(255))
+				row[offset+1] = uint8(rng.Intn(255))
+				row[offset+2] = uint8(rng.Intn(255))
+				row[offset+3] = 255
+			}
+		}
+	})
+	return i
+}
+
+// ShufflePixelsImage replaces each pixel of an image within the given bounds
+// with a randomly chosen pixel, scattering the image's colors without
+// changing their distribution much. Pixels are chosen with the global source
+// of math/rand.
 func ShufflePixelsImage(i *image.NRGBA, bounds image.Rectangle) {
-	for x := bounds.Min.X; x < bounds.Max.X; x++ {
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			// Swap the pixel with a random pixel
-			x2 := rand.Intn(bounds.Max.X)
-			y2 := rand.Intn(bounds.Max.Y)
-			targetPixel := (*i).At(x2, y2)
-			(*i).Set(x, y, (*i).At(x2, y2))
-			(*i).Set(x2, y2, targetPixel)
+	ShufflePixelsImageWithRand(i, bounds, nil)
+}
+
+// ShufflePixelsImageWithRand is ShufflePixelsImage choosing pixels with
+// `rng`, or the global source of math/rand if it is nil.
+func ShufflePixelsImageWithRand(
+	i *image.NRGBA,
+	bounds image.Rectangle,
+	rng *rand.Rand,
+) {
+	shufflePixelsImage(i, bounds, randSeed(rng))
+}
+
+// shufflePixelsImage shuffles with each row of `bounds` drawing from its
+// own source seeded from `seed`. Pixels are copied from the image as it was
+// before the shuffle, so the rows are shuffled in parallel.
+func shufflePixelsImage(i *image.NRGBA, bounds image.Rectangle, seed int64) {
+	source := make([]uint8, len(i.Pix))
+	copy(source, i.Pix)
+	parallelRows(bounds.Min.Y, bounds.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			rng := rowRand(seed, 0, y)
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				// Copy a random pixel over this one. Pixels outside the
+				// image read as transparent and writes outside it are
+				// dropped.
+				x2 := rng.Intn(bounds.Max.X)
+				y2 := rng.Intn(bounds.Max.Y)
+				if !(image.Point{X: x, Y: y}).In(i.Rect) {
+					continue
+				}
+				dst := i.Pix[i.PixOffset(x, y):]
+				if (image.Point{X: x2, Y: y2}).In(i.Rect) {
+					copy(dst[:4], source[i.PixOffset(x2, y2):])
+				} else {
+					copy(dst[:4], []byte{0, 0, 0, 0})
+				}
+			}
 		}
-	}
+	})
 }
 
 // NoisePixelImage adds noise to an image within the given bounds sourced from
 // another bounds in the same image by copying random pixels from the source
-// bounds to the destination bounds.
+// bounds to the destination bounds. Pixels are chosen with the global source
+// of math/rand.
 func NoisePixelImage(img *image.RGBA, srcBounds image.Rectangle,
 	dstBounds image.Rectangle) {
+	NoisePixelImageWithRand(img, srcBounds, dstBounds, nil)
+}
+
+// NoisePixelImageWithRand is NoisePixelImage choosing pixels with `rng`, or
+// the global source of math/rand if it is nil.
+func NoisePixelImageWithRand(img *image.RGBA, srcBounds image.Rectangle,
+	dstBounds image.Rectangle, rng *rand.Rand) {
+	intn := randIntn(rng)
 	for x := dstBounds.Min.X; x < dstBounds.Max.X; x++ {
 		for y := dstBounds.Min.Y; y < dstBounds.Max.Y; y++ {
-			srcX := rand.Intn(srcBounds.Max.X-srcBounds.Min.X) +
+			srcX := intn(srcBounds.Max.X-srcBounds.Min.X) +
 				srcBounds.Min.X
-			srcY := rand.Intn(srcBounds.Max.Y-srcBounds.Min.Y) +
+			srcY := intn(srcBounds.Max.Y-srcBounds.Min.Y) +
 				srcBounds.Min.Y
 			img.Set(x, y, img.At(srcX, srcY))
 		}
@@ -123,17 +303,52 @@ func NoisePixelImage(img *image.RGBA, srcBounds image.Rectangle,
 // Optionally, the extended edges can be shuffled to further preserve the color
 // histogram without influencing the image's content. Additionally, the
 // reflection and a slight overlap can be blurred to maintain the image's
-// continuity.
+// continuity. Shuffling draws from the global source of math/rand. When
+// `conds` expands both axes, the source is anchored in its direction and
+// reflected on every exposed side.
 func ReflectImageEdges(
 	background *image.NRGBA,
 	source *image.NRGBA,
 	conds OutpaintCondition,
 	shuffle bool,
 	blur uint32,
+) (*image.NRGBA, error) {
+	return ReflectImageEdgesWithRand(background, source, conds, shuffle, blur,
+		nil)
+}
+
+// ReflectImageEdgesWithRand is ReflectImageEdges shuffling with `rng`, or the
+// global source of math/rand if it is nil.
+func ReflectImageEdgesWithRand(
+	background *image.NRGBA,
+	source *image.NRGBA,
+	conds OutpaintCondition,
+	shuffle bool,
+	blur uint32,
+	rng *rand.Rand,
 ) (*image.NRGBA, error) {
 	sourceDim := source.Bounds().Size()
 	targetDim := background.Bounds().Size()
 	target := background
+	if conds.IsBothAxes() {
+		// Expanding along both axes, possibly from a corner: mirror the
+		// source across every exposed edge around its anchored placement.
+		placement := AnchorPlacement(sourceDim, targetDim, conds.Direction())
+		target = imaging.Paste(target, source, placement.Min)
+		ReflectImageEdgesAt(target, placement)
+		if shuffle {
+			ShufflePixelsImageWithRand(target, target.Bounds(), rng)
+			target = imaging.Paste(target, source, placement.Min)
+		}
+		if blur > 0 {
+			var blurErr error
+			if target, blurErr = stackblur.Process(target,
+				blur); blurErr != nil {
+				return nil, blurErr
+			}
+		}
+		return target, nil
+	}
 	targetCenter := image.Point{
 		X: targetDim.X / 2,
 		Y: targetDim.Y / 2,
@@ -153,7 +368,8 @@ func ReflectImageEdges(
 		// This is a vertical resize
 		reflection := imaging.FlipV(source)
 		if shuffle {
-			ShufflePixelsImage(reflection, reflection.Bounds())
+			ShufflePixelsImageWithRand(reflection, reflection.Bounds(),
+				rng)
 		}
 		switch conds.Direction() {
 		case DirectionRight:
@@ -188,7 +404,8 @@ func ReflectImageEdges(
 		// This is a horizontal resize
 		reflection := imaging.FlipH(source)
 		if shuffle {
-			ShufflePixelsImage(reflection, reflection.Bounds())
+			ShufflePixelsImageWithRand(reflection, reflection.Bounds(),
+				rng)
 		}
 		switch conds.Direction() {
 		case DirectionUp:
@@ -234,7 +451,9 @@ func ReflectImageEdges(
 }
 
 func QuantizePng(old *[]byte, quantization int) (new *[]byte, err error) {
-	img, _, err := image.Decode(bytes.NewReader(*old))
+	// The quantized PNG carries no metadata, so it is stored upright and in
+	// sRGB.
+	img, _, _, err := DecodeImage(old)
 	if err != nil {
 		return nil, err
 	}
@@ -297,12 +516,69 @@ func CreateGradient(
 				return outpaintGradient.At(1 - scaled)
 			}
 		}
+	case DirectionUpLeft, DirectionUpRight, DirectionDownLeft,
+		DirectionDownRight:
+		// Corners ramp from both of their edges, the nearer edge winning,
+		// as CreatePlacementMask does.
+		corner := DirectionMatrix[gradientDirection]
+		gradientColorFn = func(x, y int) csscolorparser.Color {
+			scaledX := float64(x) / float64(gradientDim.Max.X)
+			if corner.X > 0 {
+				scaledX = 1 - scaledX
+			}
+			scaledY := float64(y) / float64(gradientDim.Max.Y)
+			if corner.Y > 0 {
+				scaledY = 1 - scaledY
+			}
+			return outpaintGradient.At(math.Min(scaledX, scaledY))
+		}
+	}
+	// Every direction but the corners varies along a single axis, so the
+	// gradient is sampled once per column or row, and the rows are filled
+	// in parallel.
+	varyXY := gradientDirection.IsCorner()
+	varyX := gradientDirection == DirectionLeft ||
+		gradientDirection == DirectionRight ||
+		(gradientDirection == DirectionCenter &&
+			gradientDim.Max.Y > gradientDim.Max.X)
+	bounds := i.Rect
+	if bounds.Empty() || gradientColorFn == nil {
+		return i
 	}
-	for x := 0; x < i.Rect.Max.X; x++ {
-		for y := 0; y < i.Rect.Max.Y; y++ {
-			i.Set(x, y, gradientColorFn(x, y))
+	sample := func(x, y int) [4]byte {
+		c := color.RGBAModel.Convert(gradientColorFn(x, y)).(color.RGBA)
+		return [4]byte{c.R, c.G, c.B, c.A}
+	}
+	var columns [][4]byte
+	if varyX {
+		columns = make([][4]byte, 0, bounds.Dx())
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			columns = append(columns, sample(x, bounds.Min.Y))
 		}
 	}
+	parallelRows(bounds.Min.Y, bounds.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := i.Pix[i.PixOffset(bounds.Min.X, y):i.PixOffset(
+				bounds.Max.X, y)]
+			if varyXY {
+				for x := 0; x < len(row); x += 4 {
+					pixel := sample(bounds.Min.X+x/4, y)
+					copy(row[x:x+4], pixel[:])
+				}
+				continue
+			}
+			if varyX {
+				for x, pixel := range columns {
+					copy(row[x*4:x*4+4], pixel[:])
+				}
+				continue
+			}
+			pixel := sample(bounds.Min.X, y)
+			for x := 0; x < len(row); x += 4 {
+				copy(row[x:x+4], pixel[:])
+			}
+		}
+	})
 	return i
 }
 
@@ -313,7 +589,8 @@ func CreateGradient(
 // maximum size, it is returned as-is.
 //
 // CoerceImage also takes care of encoding the image as a PNG if it is not
-// already a PNG.
+// already a PNG. It stretches the image to the dimensions; see
+// CoerceImageWithOpts to pad or crop it instead.
 func (ars *AspectRatios) CoerceImage(
 	raw *[]byte,
 ) (
@@ -323,27 +600,19 @@ func (ars *AspectRatios) CoerceImage(
 	scaledDim *image.Point,
 	err error,
 ) {
-	i, format, origDim, readErr := DecodeImage(raw)
-	if readErr != nil {
-		return nil, nil, format, nil, readErr
+	result, coerceErr := ars.CoerceImageWithOpts(raw, NewCoerceImageOpts())
+	if coerceErr != nil {
+		return nil, nil, "", nil, coerceErr
 	}
-	scaledDim = &image.Point{}
-	coerced = &[]byte{}
-	width := uint64(origDim.X)
-	height := uint64(origDim.Y)
-	scaledWidth, scaledHeight := ars.NearestAspectWH(width, height, MaxPixels)
-	if width != scaledWidth || height != scaledHeight {
-		i = imaging.Resize(i, int(scaledWidth), int(scaledHeight),
-			imaging.Lanczos)
-		*scaledDim = i.Bounds().Size()
+	origDim = &result.Source
+	if result.Coerced == raw {
+		return raw, origDim, result.Format, origDim, nil
 	}
-	if scaledWidth != width || scaledHeight != height || format != "png" {
-		var writeErr error
-		coerced, writeErr = EncodePng(i, png.BestSpeed)
-		return coerced, origDim, format, scaledDim, writeErr
-	} else {
-		return raw, origDim, format, origDim, nil
+	scaledDim = &image.Point{}
+	if result.Size != result.Source {
+		*scaledDim = result.Size
 	}
+	return result.Coerced, origDim, result.Format, scaledDim, nil
 }
 
 func parseEnvUint(key string, defaultValue uint64) uint64 {
@@ -381,6 +650,15 @@ func init() {
 	DefaultDimension = parseEnvUint("DEFAULT_DIMENSION", DefaultDimension)
 	DimensionStep = parseEnvUint("DIMENSION_STEP", DimensionStep)
 
+	DefaultDecodeLimits.MaxBytes = parseEnvUint("DECODE_MAX_BYTES",
+		DefaultDecodeLimits.MaxBytes)
+	DefaultDecodeLimits.MaxPixels = parseEnvUint("DECODE_MAX_PIXELS",
+		DefaultDecodeLimits.MaxPixels)
+	DefaultDecodeLimits.MaxDimension = parseEnvUint("DECODE_MAX_DIMENSION",
+		DefaultDecodeLimits.MaxDimension)
+	DefaultDecodeLimits.MaxFrames = parseEnvUint("DECODE_MAX_FRAMES",
+		DefaultDecodeLimits.MaxFrames)
+
 	DefaultAspectRatios := NewAspectRatios(MaxPixels,
 		DimensionStep,
 		MinDimension,
@@ -1,9 +1,17 @@
 package stability_image
 
 import (
+	"bytes"
+	"image"
+	"image/color"
 	"io/ioutil"
+	"math"
 	"os"
 	"testing"
+
+	"github.com/disintegration/imaging"
+	"github.com/mazznoer/colorgrad"
+	"github.com/mazznoer/csscolorparser"
 )
 
 type LetterboxTest struct {
@@ -75,7 +83,7 @@ func TestLetterboxImage(t *testing.T) {
 			t.Error(err)
 			return
 		}
-		for direction := Direction(0); direction < Direction(5); direction++ {
+		for direction := Direction(0); direction < DirectionCount; direction++ {
 			t.Log("Letterboxing", test.Title, test.Path, "to", test.Width, "x",
 				test.Height, "with direction", direction)
 			outpaintOpts := NewOutpaintImageOpts()
@@ -98,3 +106,197 @@ func TestLetterboxImage(t *testing.T) {
 		}
 	}
 }
+
+// The reference implementations below set pixels one at a time through the
+// image.Image interface, and are used to check the direct pixel access fast
+// paths against.
+
+func referenceFill(img *image.RGBA, col *color.RGBA) {
+	bounds := img.Bounds()
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			img.Set(x, y, col)
+		}
+	}
+}
+
+func referenceNoiseImage(width int, height int, seed int64) *image.RGBA {
+	i := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < i.Rect.Max.Y; y++ {
+		rng := rowRand(seed, 0, y)
+		for x := 0; x < i.Rect.Max.X; x++ {
+			i.Set(x, y, color.RGBA{
+				R: uint8(rng.Intn(255)),
+				G: uint8(rng.Intn(255)),
+				B: uint8(rng.Intn(255)),
+				A: 255,
+			})
+		}
+	}
+	return i
+}
+
+func referenceShufflePixelsImage(i *image.NRGBA, bounds image.Rectangle,
+	seed int64) {
+	source := imaging.Clone(i)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		rng := rowRand(seed, 0, y)
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			x2 := rng.Intn(bounds.Max.X)
+			y2 := rng.Intn(bounds.Max.Y)
+			(*i).Set(x, y, source.At(x2, y2))
+		}
+	}
+}
+
+func referenceGradient(
+	outpaintGradient colorgrad.Gradient,
+	gradientDim image.Rectangle,
+	gradientDirection Direction,
+) *image.RGBA {
+	i := image.NewRGBA(gradientDim)
+	for x := 0; x < i.Rect.Max.X; x++ {
+		for y := 0; y < i.Rect.Max.Y; y++ {
+			var scaled float64
+			switch {
+			case gradientDirection.IsCorner():
+				corner := DirectionMatrix[gradientDirection]
+				scaledX := float64(x) / float64(gradientDim.Max.X)
+				scaledY := float64(y) / float64(gradientDim.Max.Y)
+				if corner.X > 0 {
+					scaledX = 1 - scaledX
+				}
+				if corner.Y > 0 {
+					scaledY = 1 - scaledY
+				}
+				i.Set(x, y, outpaintGradient.At(math.Min(scaledX, scaledY)))
+				continue
+			case gradientDirection.IsVertical() ||
+				(gradientDirection == DirectionCenter &&
+					gradientDim.Max.Y <= gradientDim.Max.X):
+				scaled = float64(y) / float64(gradientDim.Max.Y)
+			default:
+				scaled = float64(x) / float64(gradientDim.Max.X)
+			}
+			if gradientDirection != DirectionUp &&
+				gradientDirection != DirectionLeft {
+				scaled = 1 - scaled
+			}
+			i.Set(x, y, outpaintGradient.At(scaled))
+		}
+	}
+	return i
+}
+
+func testGradient() colorgrad.Gradient {
+	gradient, _ := colorgrad.NewGradient().
+		Colors(
+			csscolorparser.Color{R: 1, G: 1, B: 1, A: 1},
+			csscolorparser.Color{R: 0.5, G: 0.5, B: 0.5, A: 1},
+			csscolorparser.Color{R: 0, G: 0, B: 0, A: 0},
+		).Domain(0, 0.2, 1).Build()
+	return gradient
+}
+
+func TestFastPathsMatchReference(t *testing.T) {
+	col := &color.RGBA{R: 10, G: 20, B: 30, A: 255}
+	filled := image.NewRGBA(image.Rect(3, 5, 301, 203))
+	Fill(filled, col)
+	expected := image.NewRGBA(filled.Rect)
+	referenceFill(expected, col)
+	if !bytes.Equal(filled.Pix, expected.Pix) {
+		t.Error("Fill does not match the reference")
+	}
+
+	noise := createNoiseImage(300, 200, 1)
+	expected = referenceNoiseImage(300, 200, 1)
+	if !bytes.Equal(noise.Pix, expected.Pix) {
+		t.Error("CreateNoiseImage does not match the reference")
+	}
+
+	source := imaging.Clone(noise)
+	shuffled := imaging.Clone(source)
+	shufflePixelsImage(shuffled, image.Rect(10, 20, 300, 200), 2)
+	expectedShuffle := imaging.Clone(source)
+	referenceShufflePixelsImage(expectedShuffle, image.Rect(10, 20, 300, 200),
+		2)
+	if !bytes.Equal(shuffled.Pix, expectedShuffle.Pix) {
+		t.Error("ShufflePixelsImage does not match the reference")
+	}
+
+	gradient := testGradient()
+	for direction := Direction(0); direction < Direction(5); direction++ {
+		for _, dim := range []image.Rectangle{
+			image.Rect(0, 0, 300, 64), image.Rect(0, 0, 64, 300)} {
+			created := CreateGradient(gradient, dim, direction)
+			expected = referenceGradient(gradient, dim, direction)
+			if !bytes.Equal(created.Pix, expected.Pix) {
+				t.Error("CreateGradient does not match the reference",
+					direction, dim)
+			}
+		}
+	}
+}
+
+const benchmarkDimension = 1536
+
+func BenchmarkFill(b *testing.B) {
+	img := image.NewRGBA(image.Rect(0, 0, benchmarkDimension,
+		benchmarkDimension))
+	col := &color.RGBA{A: 255}
+	b.Run("reference", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			referenceFill(img, col)
+		}
+	})
+	b.Run("fast", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			Fill(img, col)
+		}
+	})
+}
+
+func BenchmarkCreateNoiseImage(b *testing.B) {
+	b.Run("reference", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			referenceNoiseImage(benchmarkDimension, benchmarkDimension,
+				int64(n))
+		}
+	})
+	b.Run("fast", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			createNoiseImage(benchmarkDimension, benchmarkDimension,
+				int64(n))
+		}
+	})
+}
+
+func BenchmarkShufflePixelsImage(b *testing.B) {
+	img := imaging.New(benchmarkDimension, benchmarkDimension,
+		color.White)
+	b.Run("reference", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			referenceShufflePixelsImage(img, img.Rect, int64(n))
+		}
+	})
+	b.Run("fast", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			shufflePixelsImage(img, img.Rect, int64(n))
+		}
+	})
+}
+
+func BenchmarkCreateGradient(b *testing.B) {
+	gradient := testGradient()
+	dim := image.Rect(0, 0, benchmarkDimension, benchmarkDimension/2)
+	b.Run("reference", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			referenceGradient(gradient, dim, DirectionDown)
+		}
+	})
+	b.Run("fast", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			CreateGradient(gradient, dim, DirectionDown)
+		}
+	})
+}
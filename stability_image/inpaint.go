@@ -0,0 +1,383 @@
+package stability_image
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+)
+
+// DefaultInpaintRadius is the radius, in pixels, of the neighbourhood that
+// InpaintTelea draws each filled pixel from when none is given.
+const DefaultInpaintRadius = 5
+
+// Pixel states of the fast marching method.
+const (
+	fmmKnown uint8 = iota
+	fmmBand
+	fmmInside
+)
+
+// fmmInf is the arrival time of pixels the front has not reached yet.
+const fmmInf = 1e6
+
+type fmmItem struct {
+	t   float64
+	idx int
+}
+
+// fmmHeap is a min-heap of band pixels ordered by arrival time.
+type fmmHeap []fmmItem
+
+func (h fmmHeap) Len() int            { return len(h) }
+func (h fmmHeap) Less(i, j int) bool  { return h[i].t < h[j].t }
+func (h fmmHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fmmHeap) Push(x interface{}) { *h = append(*h, x.(fmmItem)) }
+func (h *fmmHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// teleaInpainter holds the state of a fast marching inpaint of an image.
+type teleaInpainter struct {
+	img    *image.NRGBA
+	width  int
+	height int
+	flags  []uint8
+	times  []float64
+	band   fmmHeap
+	// offsets are the vectors from the pixels within the radius to the
+	// pixel being inpainted.
+	offsets []teleaOffset
+}
+
+type teleaOffset struct {
+	dx       int
+	dy       int
+	invLen   float64
+	invLenSq float64
+}
+
+func teleaOffsets(radius int) []teleaOffset {
+	offsets := make([]teleaOffset, 0)
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			lenSq := dx*dx + dy*dy
+			if lenSq == 0 || lenSq > radius*radius {
+				continue
+			}
+			offsets = append(offsets, teleaOffset{
+				dx:       dx,
+				dy:       dy,
+				invLen:   1 / math.Sqrt(float64(lenSq)),
+				invLenSq: 1 / float64(lenSq),
+			})
+		}
+	}
+	return offsets
+}
+
+func (p *teleaInpainter) flag(x int, y int) uint8 {
+	if x < 0 || y < 0 || x >= p.width || y >= p.height {
+		return fmmInside
+	}
+	return p.flags[y*p.width+x]
+}
+
+func (p *teleaInpainter) time(x int, y int) float64 {
+	if x < 0 || y < 0 || x >= p.width || y >= p.height {
+		return fmmInf
+	}
+	return p.times[y*p.width+x]
+}
+
+// solve solves the eikonal equation |∇T| = 1 at a pixel from two of its
+// neighbours, one along each axis.
+func (p *teleaInpainter) solve(x1 int, y1 int, x2 int, y2 int) float64 {
+	t1, t2 := p.time(x1, y1), p.time(x2, y2)
+	known1 := p.flag(x1, y1) != fmmInside
+	known2 := p.flag(x2, y2) != fmmInside
+	switch {
+	case known1 && known2:
+		if math.Abs(t1-t2) >= 1 {
+			return 1 + math.Min(t1, t2)
+		}
+		return (t1 + t2 + math.Sqrt(2-(t1-t2)*(t1-t2))) / 2
+	case known1:
+		return 1 + t1
+	case known2:
+		return 1 + t2
+	}
+	return 1 + math.Min(t1, t2)
+}
+
+// timeGradient returns the gradient of the arrival time at a pixel, using
+// central differences where both neighbours are known and one-sided
+// differences where only one is.
+func (p *teleaInpainter) timeGradient(x int, y int) (gx float64, gy float64) {
+	axis := func(dx int, dy int) float64 {
+		before := p.flag(x-dx, y-dy) != fmmInside
+		after := p.flag(x+dx, y+dy) != fmmInside
+		switch {
+		case before && after:
+			return (p.time(x+dx, y+dy) - p.time(x-dx, y-dy)) / 2
+		case after:
+			return p.time(x+dx, y+dy) - p.time(x, y)
+		case before:
+			return p.time(x, y) - p.time(x-dx, y-dy)
+		}
+		return 0
+	}
+	return axis(1, 0), axis(0, 1)
+}
+
+// original returns whether a pixel was known before inpainting began.
+func (p *teleaInpainter) original(x int, y int) bool {
+	if x < 0 || y < 0 || x >= p.width || y >= p.height {
+		return false
+	}
+	return p.times[y*p.width+x] == 0
+}
+
+// imageGradient returns the gradient of each channel of the image at an
+// original pixel, differencing in the same way as timeGradient. Only original
+// pixels are differenced: extrapolating from the gradients of inpainted
+// pixels would feed back and overshoot.
+func (p *teleaInpainter) imageGradient(x int, y int) (gx, gy [4]float64) {
+	pix := p.img.Pix
+	axis := func(dx int, dy int, g *[4]float64) {
+		before := p.original(x-dx, y-dy)
+		after := p.original(x+dx, y+dy)
+		lo, hi, scale := 0, 0, 1.0
+		switch {
+		case before && after:
+			lo = p.img.PixOffset(x-dx, y-dy)
+			hi = p.img.PixOffset(x+dx, y+dy)
+			scale = 0.5
+		case after:
+			lo = p.img.PixOffset(x, y)
+			hi = p.img.PixOffset(x+dx, y+dy)
+		case before:
+			lo = p.img.PixOffset(x-dx, y-dy)
+			hi = p.img.PixOffset(x, y)
+		default:
+			return
+		}
+		for c := 0; c < 4; c++ {
+			g[c] = (float64(pix[hi+c]) - float64(pix[lo+c])) * scale
+		}
+	}
+	axis(1, 0, &gx)
+	axis(0, 1, &gy)
+	return gx, gy
+}
+
+// inpaint estimates a pixel from the known pixels within the radius, the
+// original ones extrapolated along their image gradient, each weighted by its
+// direction, distance and level set distance from the pixel.
+func (p *teleaInpainter) inpaint(x int, y int) {
+	t := p.time(x, y)
+	gtx, gty := p.timeGradient(x, y)
+	var sums [4]float64
+	weights := 0.0
+	for _, offset := range p.offsets {
+		nx, ny := x-offset.dx, y-offset.dy
+		if p.flag(nx, ny) == fmmInside {
+			continue
+		}
+		rx, ry := float64(offset.dx), float64(offset.dy)
+		dir := (rx*gtx + ry*gty) * offset.invLen
+		if math.Abs(dir) <= 0.01 {
+			dir = 0.000001
+		}
+		lev := 1 / (1 + math.Abs(p.times[ny*p.width+nx]-t))
+		w := math.Abs(dir * offset.invLenSq * lev)
+		pix := p.img.Pix[p.img.PixOffset(nx, ny):][:4]
+		if p.original(nx, ny) {
+			gx, gy := p.imageGradient(nx, ny)
+			for c := 0; c < 4; c++ {
+				sums[c] += w * (float64(pix[c]) + gx[c]*rx + gy[c]*ry)
+			}
+		} else {
+			for c := 0; c < 4; c++ {
+				sums[c] += w * float64(pix[c])
+			}
+		}
+		weights += w
+	}
+	if weights == 0 {
+		return
+	}
+	pix := p.img.Pix[p.img.PixOffset(x, y):][:4]
+	for c := 0; c < 4; c++ {
+		pix[c] = uint8(math.Round(math.Max(0, math.Min(255,
+			sums[c]/weights))))
+	}
+}
+
+// run marches the front inwards from the band until every pixel is known.
+func (p *teleaInpainter) run() {
+	for p.band.Len() > 0 {
+		item := heap.Pop(&p.band).(fmmItem)
+		if p.flags[item.idx] == fmmKnown {
+			continue
+		}
+		p.flags[item.idx] = fmmKnown
+		x, y := item.idx%p.width, item.idx/p.width
+		for _, n := range [4]image.Point{{x - 1, y}, {x, y - 1},
+			{x + 1, y}, {x, y + 1}} {
+			if n.X < 0 || n.Y < 0 || n.X >= p.width || n.Y >= p.height ||
+				p.flags[n.Y*p.width+n.X] != fmmInside {
+				continue
+			}
+			t := math.Min(math.Min(
+				p.solve(n.X-1, n.Y, n.X, n.Y-1),
+				p.solve(n.X+1, n.Y, n.X, n.Y-1)), math.Min(
+				p.solve(n.X-1, n.Y, n.X, n.Y+1),
+				p.solve(n.X+1, n.Y, n.X, n.Y+1)))
+			idx := n.Y*p.width + n.X
+			p.times[idx] = t
+			p.inpaint(n.X, n.Y)
+			p.flags[idx] = fmmBand
+			heap.Push(&p.band, fmmItem{t: t, idx: idx})
+		}
+	}
+}
+
+// inpaintTelea fills the pixels of `img` flagged in `unknown`, indexed by
+// row from the image's minimum point, in place.
+func inpaintTelea(img *image.NRGBA, unknown []bool, radius int) error {
+	bounds := img.Bounds()
+	if radius <= 0 {
+		radius = DefaultInpaintRadius
+	}
+	// Work on an image at the origin so pixels can be indexed directly.
+	origin := img
+	if bounds.Min != (image.Point{}) {
+		origin = &image.NRGBA{
+			Pix:    img.Pix,
+			Stride: img.Stride,
+			Rect:   image.Rectangle{Max: bounds.Size()},
+		}
+	}
+	p := &teleaInpainter{
+		img:     origin,
+		width:   bounds.Dx(),
+		height:  bounds.Dy(),
+		flags:   make([]uint8, bounds.Dx()*bounds.Dy()),
+		times:   make([]float64, bounds.Dx()*bounds.Dy()),
+		offsets: teleaOffsets(radius),
+	}
+	anyKnown := false
+	for idx, isUnknown := range unknown {
+		if isUnknown {
+			p.flags[idx] = fmmInside
+			p.times[idx] = fmmInf
+		} else {
+			anyKnown = true
+		}
+	}
+	if !anyKnown {
+		return errors.New("nothing to inpaint from: the mask covers " +
+			"the whole image")
+	}
+	// The band starts as the known pixels bordering the unknown ones.
+	for idx, flag := range p.flags {
+		if flag != fmmKnown {
+			continue
+		}
+		x, y := idx%p.width, idx/p.width
+		if p.flag(x-1, y) == fmmInside && x > 0 ||
+			p.flag(x+1, y) == fmmInside && x < p.width-1 ||
+			p.flag(x, y-1) == fmmInside && y > 0 ||
+			p.flag(x, y+1) == fmmInside && y < p.height-1 {
+			p.flags[idx] = fmmBand
+			p.band = append(p.band, fmmItem{idx: idx})
+		}
+	}
+	heap.Init(&p.band)
+	p.run()
+	return nil
+}
+
+// InpaintTelea fills the masked region of `img` inwards from its boundary
+// with Telea's fast marching method, returning the result as a new image.
+// Pixels where `mask` is under half of full intensity are filled, as
+// outpaint masks mark the area to generate black. `radius` is the size of
+// the neighbourhood each filled pixel is estimated from, defaulting to
+// DefaultInpaintRadius if not positive.
+func InpaintTelea(
+	img image.Image,
+	mask image.Image,
+	radius int,
+) (*image.NRGBA, error) {
+	bounds := img.Bounds()
+	if mask.Bounds().Size() != bounds.Size() {
+		return nil, fmt.Errorf("mask is %v, but the image is %v",
+			mask.Bounds().Size(), bounds.Size())
+	}
+	inpainted := image.NewNRGBA(image.Rectangle{Max: bounds.Size()})
+	draw.Draw(inpainted, inpainted.Bounds(), img, bounds.Min, draw.Src)
+	if inpaintErr := inpaintTelea(inpainted, maskGenerated(mask),
+		radius); inpaintErr != nil {
+		return nil, inpaintErr
+	}
+	return inpainted, nil
+}
+
+// InpaintImage decodes `src` and `mask`, fills the masked region of the image
+// with InpaintTelea, and returns it encoded as a PNG. This cleans up the
+// masked area of an image before it is used for img2img.
+func InpaintImage(
+	src *[]byte,
+	mask *[]byte,
+	radius int,
+) (inpainted *[]byte, err error) {
+	img, _, _, decodeErr := DecodeImage(src)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	maskImg, _, _, maskErr := DecodeImage(mask)
+	if maskErr != nil {
+		return nil, maskErr
+	}
+	filled, inpaintErr := InpaintTelea(img, maskImg, radius)
+	if inpaintErr != nil {
+		return nil, inpaintErr
+	}
+	return EncodePng(filled, png.BestSpeed)
+}
+
+// TeleaFiller inpaints the extended area inwards from the source's edges
+// with InpaintTelea, continuing the source's edges and colors without
+// duplicating its content.
+type TeleaFiller struct {
+	Radius int
+}
+
+func (TeleaFiller) Name() string { return "telea" }
+
+func (f TeleaFiller) Fill(ctx *OutpaintFillContext) (*image.NRGBA, error) {
+	bounds := ctx.Canvas.Bounds()
+	unknown := make([]bool, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			unknown[(y-bounds.Min.Y)*bounds.Dx()+x-bounds.Min.X] =
+				!(image.Point{X: x, Y: y}).In(ctx.Placement)
+		}
+	}
+	if inpaintErr := inpaintTelea(ctx.Canvas, unknown,
+		f.Radius); inpaintErr != nil {
+		return nil, inpaintErr
+	}
+	return finishFill(ctx, ctx.Canvas)
+}
+
+func init() {
+	RegisterOutpaintFiller(TeleaFiller{})
+}
@@ -0,0 +1,422 @@
+package stability_image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+var ErrEmptyMask = errors.New("mask has nothing to inpaint")
+
+const (
+	// DefaultInpaintPadding is how many pixels of context around the masked
+	// region are sent along with it.
+	DefaultInpaintPadding = 64
+	// DefaultInpaintFeather is the width in source pixels of the blend
+	// between the generated crop and the original around the mask.
+	DefaultInpaintFeather = 16
+	// DefaultInpaintMaxUpscale is how much the crop may be scaled up to its
+	// generation size before the window is grown to include more context.
+	DefaultInpaintMaxUpscale = 4.0
+)
+
+type InpaintCropOpts struct {
+	// Aspects are the sizes the crop may be generated at. If nil, the
+	// aspect ratios for MaxPixels are used.
+	Aspects *AspectRatios
+	// Padding is the context around the mask's bounding box to include in
+	// the crop.
+	Padding int
+	// Feather is the width in source pixels of the blend around the mask
+	// when the crop is pasted back. It is capped at Padding.
+	Feather int
+	// Falloff is the shape of the blend.
+	Falloff MaskFalloff
+	// MaxUpscale is how much the crop may be scaled up to its generation
+	// size.
+	MaxUpscale float64
+	// MaskBackground is the level the cropped mask keeps the crop with, as
+	// OutpaintImageOpts.MaskBackground is for outpaint masks.
+	MaskBackground uint16
+	// MaskInvert marks the pixels to inpaint with MaskBackground and the
+	// rest black in the cropped mask, rather than the other way around.
+	MaskInvert bool
+}
+
+func NewInpaintCropOpts() *InpaintCropOpts {
+	return &InpaintCropOpts{
+		Padding:        DefaultInpaintPadding,
+		Feather:        DefaultInpaintFeather,
+		MaxUpscale:     DefaultInpaintMaxUpscale,
+		MaskBackground: OutpaintBackground,
+	}
+}
+
+// InpaintCropGeometry describes the window of a source cropped around an
+// inpaint mask, so that the generated crop can be pasted back into it.
+type InpaintCropGeometry struct {
+	// Source is the size of the source.
+	Source image.Point `json:"source"`
+	// Bounds is the bounding box of the masked pixels.
+	Bounds image.Rectangle `json:"bounds"`
+	// Window is the crop of the source sent for generation.
+	Window image.Rectangle `json:"window"`
+	// Aspect is the label of the aspect ratio the crop is generated at, and
+	// Size its size.
+	Aspect string      `json:"aspect"`
+	Size   image.Point `json:"size"`
+	// Feather is the width in source pixels of the blend around the mask.
+	Feather int `json:"feather"`
+	// Falloff is the shape of the blend.
+	Falloff MaskFalloff `json:"falloff"`
+}
+
+// inpaintMasked returns which pixels of `mask`, a selection of the region
+// to inpaint, are selected, indexed by row from its minimum point: those at
+// least half of full intensity, as the region is painted white.
+func inpaintMasked(mask image.Image) []bool {
+	bounds := mask.Bounds()
+	masked := make([]bool, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray := color.Gray16Model.Convert(mask.At(x, y)).(color.Gray16)
+			masked[(y-bounds.Min.Y)*bounds.Dx()+x-bounds.Min.X] =
+				gray.Y >= 0x8000
+		}
+	}
+	return masked
+}
+
+// PlanInpaintCrop finds the window of a source the size of `mask` to
+// inpaint the masked region in: the mask's bounding box, padded with
+// context, grown to the aspect ratio from `opts.Aspects` that fits it in
+// the smallest window within the source. If no aspect ratio's window fits,
+// the whole source is used at the aspect ratio nearest its own.
+func PlanInpaintCrop(
+	mask image.Image,
+	opts *InpaintCropOpts,
+) (*InpaintCropGeometry, error) {
+	if opts == nil {
+		opts = NewInpaintCropOpts()
+	}
+	aspects := opts.Aspects
+	if aspects == nil {
+		defaults := NewAspectRatios(MaxPixels, DimensionStep, MinDimension,
+			MaxDimension)
+		aspects = &defaults
+	}
+	if len(aspects.Table) == 0 {
+		return nil, errors.New("no aspect ratios to inpaint at")
+	}
+	maxUpscale := opts.MaxUpscale
+	if maxUpscale <= 0 {
+		maxUpscale = DefaultInpaintMaxUpscale
+	}
+	padding := max(0, opts.Padding)
+
+	size := mask.Bounds().Size()
+	masked := inpaintMasked(mask)
+	bounds := image.Rectangle{}
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			if masked[y*size.X+x] {
+				bounds = bounds.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if bounds.Empty() {
+		return nil, ErrEmptyMask
+	}
+	geometry := &InpaintCropGeometry{
+		Source:  size,
+		Bounds:  bounds,
+		Feather: max(0, opts.Feather),
+		Falloff: opts.Falloff,
+	}
+	if padding > 0 {
+		geometry.Feather = min(geometry.Feather, padding)
+	}
+	padded := image.Rectangle{
+		Min: bounds.Min.Sub(image.Pt(padding, padding)),
+		Max: bounds.Max.Add(image.Pt(padding, padding)),
+	}.Intersect(image.Rectangle{Max: size})
+
+	labels := make([]string, 0, len(aspects.Table))
+	for label := range aspects.Table {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	var window image.Point
+	for _, label := range labels {
+		aspect := aspects.Table[label]
+		width := float64(aspect.WidthPixels)
+		height := float64(aspect.HeightPixels)
+		windowHeight := math.Max(float64(padded.Dy()), math.Max(
+			float64(padded.Dx())*height/width, height/maxUpscale))
+		candidate := image.Point{
+			X: int(math.Ceil(windowHeight * width / height)),
+			Y: int(math.Ceil(windowHeight)),
+		}
+		if candidate.X > size.X || candidate.Y > size.Y {
+			continue
+		}
+		if geometry.Aspect == "" || candidate.X*candidate.Y <
+			window.X*window.Y {
+			geometry.Aspect, window = label, candidate
+		}
+	}
+	if geometry.Aspect == "" {
+		// Nothing fits, so the whole source is generated at the aspect
+		// ratio nearest its own.
+		nearest, _ := aspects.NearestRatio(uint64(size.X), uint64(size.Y))
+		geometry.Aspect, window = nearest.Label, size
+	}
+	aspect := aspects.Table[geometry.Aspect]
+	geometry.Size = image.Point{X: int(aspect.WidthPixels),
+		Y: int(aspect.HeightPixels)}
+
+	// Center the window on the padded bounds, within the source.
+	center := padded.Min.Add(padded.Max).Div(2)
+	origin := image.Point{
+		X: max(0, min(size.X-window.X, center.X-window.X/2)),
+		Y: max(0, min(size.Y-window.Y, center.Y-window.Y/2)),
+	}
+	geometry.Window = image.Rectangle{Min: origin, Max: origin.Add(window)}
+	return geometry, nil
+}
+
+// PrepareInpaintCrop decodes `src` and its inpaint `mask`, and crops both to
+// the window PlanInpaintCrop finds for the mask, scaled to the window's
+// generation size. `mask` selects the region to inpaint white, and the
+// cropped mask marks it as outpaint masks mark the area to generate: black,
+// and the rest `opts.MaskBackground`, unless `opts.MaskInvert` is set. If
+// `opts` is nil, NewInpaintCropOpts is used. The returned geometry pastes
+// the generated crop back with
+// PasteInpaintResult. If `mask` is nil, it is derived from the source's
+// transparency with AlphaInpaintMask, and the crop is made opaque as
+// AlphaGenerate makes it.
+func PrepareInpaintCrop(
+	src *[]byte,
+	mask *[]byte,
+	opts *InpaintCropOpts,
+) (
+	crop *[]byte,
+	cropMask *[]byte,
+	geometry *InpaintCropGeometry,
+	err error,
+) {
+	if opts == nil {
+		opts = NewInpaintCropOpts()
+	}
+	source, _, srcDim, err := DecodeImage(src)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	maskImg, maskDim, err := decodeInpaintMask(source, mask)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if mask == nil {
+		source, _, _, _ = applyAlphaPolicy(source, AlphaGenerate, nil)
+	}
+	if *maskDim != *srcDim {
+		return nil, nil, nil, fmt.Errorf("%w: mask is %v, but the image is %v",
+			ErrGeometryMismatch, *maskDim, *srcDim)
+	}
+	geometry, err = PlanInpaintCrop(maskImg, opts)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	window := geometry.Window.Add(source.Bounds().Min)
+	cropped := imaging.Resize(imaging.Crop(source, window), geometry.Size.X,
+		geometry.Size.Y, imaging.Lanczos)
+	if crop, err = EncodePng(cropped, png.BestSpeed); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Scale the mask as it is, then threshold it again so that it stays
+	// crisp.
+	window = geometry.Window.Add(maskImg.Bounds().Min)
+	scaledMask := imaging.Resize(imaging.Crop(maskImg, window),
+		geometry.Size.X, geometry.Size.Y, imaging.Linear)
+	masked := inpaintMasked(scaledMask)
+	thresholded := image.NewGray16(image.Rectangle{Max: geometry.Size})
+	for idx, inpaint := range masked {
+		level := maskValue(1, opts.MaskBackground, opts.MaskInvert)
+		if inpaint {
+			level = maskValue(0, opts.MaskBackground, opts.MaskInvert)
+		}
+		thresholded.Pix[idx*2] = uint8(level >> 8)
+		thresholded.Pix[idx*2+1] = uint8(level)
+	}
+	if cropMask, err = EncodePng(thresholded, png.BestSpeed); err != nil {
+		return nil, nil, nil, err
+	}
+	return crop, cropMask, geometry, nil
+}
+
+// inpaintWeights returns how much of the generated crop to keep over the
+// window of `geometry`: all of it where `masked`, the inpaint mask of the
+// source, is set, falling off across the feather around it to none.
+func inpaintWeights(
+	masked []bool,
+	geometry *InpaintCropGeometry,
+) *image.Gray16 {
+	window := geometry.Window
+	width, height := window.Dx(), window.Dy()
+
+	// Chamfer the distance to the nearest masked pixel in two passes.
+	distances := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if !masked[(window.Min.Y+y)*geometry.Source.X+window.Min.X+x] {
+				distances[y*width+x] = math.Inf(1)
+			}
+		}
+	}
+	relax := func(x int, y int, dx int, dy int, cost float64) {
+		nx, ny := x+dx, y+dy
+		if nx < 0 || ny < 0 || nx >= width || ny >= height {
+			return
+		}
+		idx := y*width + x
+		distances[idx] = math.Min(distances[idx],
+			distances[ny*width+nx]+cost)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			relax(x, y, -1, 0, 1)
+			relax(x, y, 0, -1, 1)
+			relax(x, y, -1, -1, math.Sqrt2)
+			relax(x, y, 1, -1, math.Sqrt2)
+		}
+	}
+	for y := height - 1; y >= 0; y-- {
+		for x := width - 1; x >= 0; x-- {
+			relax(x, y, 1, 0, 1)
+			relax(x, y, 0, 1, 1)
+			relax(x, y, 1, 1, math.Sqrt2)
+			relax(x, y, -1, 1, math.Sqrt2)
+		}
+	}
+
+	weights := image.NewGray16(window)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			distance := distances[y*width+x]
+			var weight float64
+			switch {
+			case distance == 0:
+				weight = 1
+			case distance < float64(geometry.Feather):
+				weight = 1 - geometry.Falloff.Weight(
+					distance/float64(geometry.Feather))
+			}
+			value := uint16(math.Round(weight * 0xffff))
+			offset := weights.PixOffset(window.Min.X+x, window.Min.Y+y)
+			weights.Pix[offset] = uint8(value >> 8)
+			weights.Pix[offset+1] = uint8(value)
+		}
+	}
+	return weights
+}
+
+// PasteInpaintCrop pastes `generated`, the inpainting of the crop prepared
+// with `geometry`, back into `source` at full resolution. The generated
+// crop is scaled to the window, and replaces the source where `mask` marks
+// it to be inpainted, blending into it across the feather.
+func PasteInpaintCrop(
+	source image.Image,
+	mask image.Image,
+	generated image.Image,
+	geometry *InpaintCropGeometry,
+) (*image.NRGBA, error) {
+	if geometry == nil {
+		return nil, ErrNoGeometry
+	}
+	if size := source.Bounds().Size(); size != geometry.Source {
+		return nil, fmt.Errorf("%w: source is %v, not %v",
+			ErrGeometryMismatch, size, geometry.Source)
+	}
+	if size := mask.Bounds().Size(); size != geometry.Source {
+		return nil, fmt.Errorf("%w: mask is %v, not %v",
+			ErrGeometryMismatch, size, geometry.Source)
+	}
+	generatedDim := generated.Bounds().Size()
+	aspect := float64(geometry.Size.X) / float64(geometry.Size.Y)
+	if generatedDim.X <= 0 || generatedDim.Y <= 0 ||
+		math.Abs(float64(generatedDim.X)/float64(generatedDim.Y)-aspect) >
+			geometryAspectTolerance*aspect {
+		return nil, fmt.Errorf("%w: generated image is %v, not the aspect "+
+			"ratio of %v", ErrGeometryMismatch, generatedDim, geometry.Size)
+	}
+
+	pasted := imaging.Clone(source)
+	crop := imaging.Resize(generated, geometry.Window.Dx(),
+		geometry.Window.Dy(), imaging.Lanczos)
+	blendWeighted(pasted, crop, geometry.Window.Min,
+		inpaintWeights(inpaintMasked(mask), geometry), geometry.Window)
+	return pasted, nil
+}
+
+// decodeInpaintMask decodes `mask`, or derives it from the transparency of
+// `source` if it is nil.
+func decodeInpaintMask(
+	source image.Image,
+	mask *[]byte,
+) (image.Image, *image.Point, error) {
+	if mask == nil {
+		derived, err := AlphaInpaintMask(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Select the pixels the derived mask generates.
+		for idx := range derived.Pix {
+			derived.Pix[idx] = 0xff - derived.Pix[idx]
+		}
+		size := derived.Bounds().Size()
+		return derived, &size, nil
+	}
+	maskImg, _, maskDim, err := DecodeImage(mask)
+	return maskImg, maskDim, err
+}
+
+// PasteInpaintResult decodes the original `src`, its inpaint `mask` and the
+// `generated` inpainting of the crop prepared with `geometry`, and pastes
+// the crop back with PasteInpaintCrop into a PNG at full resolution. A nil
+// mask is derived as PrepareInpaintCrop derives it.
+func PasteInpaintResult(
+	src *[]byte,
+	mask *[]byte,
+	generated *[]byte,
+	geometry *InpaintCropGeometry,
+) (*[]byte, error) {
+	source, _, _, err := DecodeImage(src)
+	if err != nil {
+		return nil, err
+	}
+	maskImg, _, err := decodeInpaintMask(source, mask)
+	if err != nil {
+		return nil, err
+	}
+	if mask == nil {
+		// Blend the generation with colors rather than transparent black.
+		source = BleedAlpha(source)
+	}
+	generatedImage, _, _, err := DecodeImage(generated)
+	if err != nil {
+		return nil, err
+	}
+	pasted, err := PasteInpaintCrop(source, maskImg, generatedImage, geometry)
+	if err != nil {
+		return nil, err
+	}
+	return EncodePng(pasted, png.BestSpeed)
+}
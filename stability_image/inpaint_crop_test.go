@@ -0,0 +1,182 @@
+package stability_image
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// discMask returns a mask of `size` marking a disc of `radius` around
+// `center` to be inpainted.
+func discMask(size image.Point, center image.Point, radius int) *image.Gray {
+	mask := image.NewGray(image.Rectangle{Max: size})
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			dx, dy := x-center.X, y-center.Y
+			if dx*dx+dy*dy <= radius*radius {
+				mask.SetGray(x, y, color.Gray{Y: 0xff})
+			}
+		}
+	}
+	return mask
+}
+
+func TestInpaintCrop(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	square, _, _, err := DecodeImage(&imageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := imaging.Resize(square, 2304, 2048, imaging.Lanczos)
+	center := image.Point{X: 1700, Y: 500}
+	mask := discMask(source.Bounds().Size(), center, 60)
+	src, err := EncodePng(source, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maskData, err := EncodePng(mask, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aspects := NewAspectRatios(1048576, 64, 256, 1536)
+	opts := NewInpaintCropOpts()
+	opts.Aspects = &aspects
+	crop, cropMask, geometry, err := PrepareInpaintCrop(src, maskData, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The window holds the padded mask at the generation's aspect ratio,
+	// and is far smaller than the source.
+	padded := image.Rect(1640-DefaultInpaintPadding, 440-DefaultInpaintPadding,
+		1761+DefaultInpaintPadding, 561+DefaultInpaintPadding)
+	if geometry.Bounds != image.Rect(1640, 440, 1761, 561) ||
+		!padded.In(geometry.Window) ||
+		!geometry.Window.In(source.Bounds()) {
+		t.Error("unexpected window", geometry.Window, "for", geometry.Bounds)
+	}
+	aspect := float64(geometry.Size.X) / float64(geometry.Size.Y)
+	windowAspect := float64(geometry.Window.Dx()) /
+		float64(geometry.Window.Dy())
+	if math.Abs(aspect-windowAspect) > 0.01*aspect ||
+		geometry.Window.Dx()*4 < geometry.Size.X ||
+		geometry.Window.Dx() > source.Bounds().Dx()/2 {
+		t.Error("unexpected window", geometry.Window, "at", geometry.Size)
+	}
+	_, _, cropDim, err := DecodeImage(crop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	croppedMask, _, maskDim, err := DecodeImage(cropMask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cropDim != geometry.Size || *maskDim != geometry.Size {
+		t.Fatal("crop is", *cropDim, "and its mask", *maskDim)
+	}
+	middle := image.Point{
+		X: (center.X - geometry.Window.Min.X) * geometry.Size.X /
+			geometry.Window.Dx(),
+		Y: (center.Y - geometry.Window.Min.Y) * geometry.Size.Y /
+			geometry.Window.Dy(),
+	}
+	// The cropped mask marks the disc to generate as outpaint masks do.
+	if gray, _, _, _ := croppedMask.At(middle.X, middle.Y).RGBA(); gray !=
+		0 {
+		t.Error("mask is not set at the disc's center")
+	}
+	if gray, _, _, _ := croppedMask.At(0, 0).RGBA(); gray !=
+		uint32(OutpaintBackground) {
+		t.Error("mask is set at the window's corner")
+	}
+	opts.MaskInvert = true
+	_, invertedMask, _, err := PrepareInpaintCrop(src, maskData, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inverted, _, _, err := DecodeImage(invertedMask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gray, _, _, _ := inverted.At(middle.X, middle.Y).RGBA(); gray !=
+		uint32(OutpaintBackground) {
+		t.Error("inverted mask is not set at the disc's center")
+	}
+
+	// Pasting a red inpainting back replaces the disc, blends around it and
+	// leaves the rest of the source as it was.
+	red := image.NewNRGBA(image.Rectangle{Max: geometry.Size})
+	for idx := 0; idx < len(red.Pix); idx += 4 {
+		copy(red.Pix[idx:], []uint8{0xff, 0, 0, 0xff})
+	}
+	generated, err := EncodePng(red, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pastedData, err := PasteInpaintResult(src, maskData, generated, geometry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pasted, _, pastedDim, err := DecodeImage(pastedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pastedDim != source.Bounds().Size() {
+		t.Fatal("pasted at", *pastedDim)
+	}
+	if colorDistance(pasted.At(center.X, center.Y), red.At(0, 0)) > 0 {
+		t.Error("disc was not inpainted", pasted.At(center.X, center.Y))
+	}
+	edge := center.Add(image.Pt(60+DefaultInpaintFeather/2, 0))
+	if colorDistance(pasted.At(edge.X, edge.Y), red.At(0, 0)) == 0 ||
+		colorDistance(pasted.At(edge.X, edge.Y), source.At(edge.X,
+			edge.Y)) == 0 {
+		t.Error("feather was not blended", pasted.At(edge.X, edge.Y))
+	}
+	for _, point := range []image.Point{
+		center.Add(image.Pt(60+DefaultInpaintFeather+2, 0)),
+		center.Add(image.Pt(0, -60-DefaultInpaintFeather-2)),
+		{X: 10, Y: 10}, {X: 1000, Y: 1500},
+	} {
+		if colorDistance(pasted.At(point.X, point.Y), source.At(point.X,
+			point.Y)) > 0 {
+			t.Error("source was changed at", point)
+		}
+	}
+
+	os.MkdirAll(OutputDir, 0755)
+	if err = ioutil.WriteFile(OutputDir+"/inpaint_crop.png", *crop,
+		0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A mask too large for any window generates the whole source.
+	wide := discMask(image.Point{X: 576, Y: 512}, image.Point{X: 288,
+		Y: 256}, 250)
+	geometry, err = PlanInpaintCrop(wide, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geometry.Window != image.Rect(0, 0, 576, 512) ||
+		geometry.Aspect != "1:1" {
+		t.Error("unexpected fallback", geometry.Window, geometry.Aspect)
+	}
+
+	if _, err = PlanInpaintCrop(image.NewGray(image.Rect(0, 0, 64, 64)),
+		opts); !errors.Is(err, ErrEmptyMask) {
+		t.Error("empty mask was not reported", err)
+	}
+	if _, err = PasteInpaintCrop(source, mask, image.NewNRGBA(image.Rect(0,
+		0, 10, 30)), geometry); !errors.Is(err, ErrGeometryMismatch) {
+		t.Error("mismatched inpainting was not reported", err)
+	}
+}
@@ -0,0 +1,124 @@
+package stability_image
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+)
+
+// holeMask returns a mask of `bounds` that fills `hole`, black, and keeps
+// the rest, white, as outpaint masks mark them.
+func holeMask(bounds image.Rectangle, hole image.Rectangle) *image.Gray {
+	mask := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !(image.Point{X: x, Y: y}).In(hole) {
+				mask.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	return mask
+}
+
+func TestInpaintTelea(t *testing.T) {
+	// A smooth gradient with a hole in it should be filled back close to
+	// the original.
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	hole := image.Rect(20, 24, 44, 40)
+	mask := holeMask(img.Bounds(), hole)
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4),
+				B: 128, A: 255})
+		}
+	}
+	original := image.NewNRGBA(img.Bounds())
+	copy(original.Pix, img.Pix)
+	for y := hole.Min.Y; y < hole.Max.Y; y++ {
+		for x := hole.Min.X; x < hole.Max.X; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{})
+		}
+	}
+
+	inpainted, err := InpaintTelea(img, mask, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxDiff, sumDiff := 0.0, 0.0
+	for y := hole.Min.Y; y < hole.Max.Y; y++ {
+		for x := hole.Min.X; x < hole.Max.X; x++ {
+			got, want := inpainted.NRGBAAt(x, y), original.NRGBAAt(x, y)
+			if got.A != 255 {
+				t.Fatal("pixel", x, y, "was not filled")
+			}
+			diff := math.Max(math.Abs(float64(got.R)-float64(want.R)),
+				math.Abs(float64(got.G)-float64(want.G)))
+			maxDiff = math.Max(maxDiff, diff)
+			sumDiff += diff
+		}
+	}
+	// The fill is smoothed towards the middle of the hole, so only the
+	// average error is held tightly.
+	meanDiff := sumDiff / float64(hole.Dx()*hole.Dy())
+	if meanDiff > 6 || maxDiff > 24 {
+		t.Error("inpainted gradient is off by", meanDiff, "on average and",
+			maxDiff, "at most")
+	}
+	if inpainted.NRGBAAt(0, 0) != original.NRGBAAt(0, 0) {
+		t.Error("a known pixel was changed")
+	}
+
+	if _, err = InpaintTelea(img, image.NewGray(image.Rect(0, 0, 8, 8)),
+		0); err == nil {
+		t.Error("a mask of the wrong size was accepted")
+	}
+	full := image.NewGray(img.Bounds())
+	if _, err = InpaintTelea(img, full, 0); err == nil {
+		t.Error("a mask covering the whole image was accepted")
+	}
+}
+
+func TestInpaintImage(t *testing.T) {
+	os.MkdirAll(OutputDir, 0755)
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, _, err := DecodeImage(&imageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := img.Bounds().Size()
+	mask := holeMask(img.Bounds(), image.Rect(size.X/3, size.Y/3,
+		size.X*2/3, size.Y*2/3))
+	maskData, err := EncodePng(mask, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inpainted, err := InpaintImage(&imageData, maskData, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(OutputDir+"/inpaint_telea.png", *inpainted,
+		os.ModePerm)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func BenchmarkInpaintTelea(b *testing.B) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1024, 1024))
+	for idx := range img.Pix {
+		img.Pix[idx] = uint8(idx * 7)
+	}
+	mask := holeMask(img.Bounds(), image.Rect(256, 256, 768, 768))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := InpaintTelea(img, mask, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
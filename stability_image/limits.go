@@ -0,0 +1,189 @@
+package stability_image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+)
+
+var (
+	ErrFileTooLarge  = errors.New("image file is too large")
+	ErrImageTooLarge = errors.New("image is too large")
+	ErrTooManyFrames = errors.New("image has too many frames")
+	ErrInvalidImage  = errors.New("invalid image")
+)
+
+// DecodeLimits bound what is decoded from untrusted images, so that small
+// files declaring huge images cannot exhaust memory. The limits are checked
+// from the image's header before it is decoded. A limit of zero is not
+// checked.
+type DecodeLimits struct {
+	// MaxBytes is the largest encoded file.
+	MaxBytes uint64
+	// MaxPixels is the largest number of pixels in the image.
+	MaxPixels uint64
+	// MaxDimension is the largest width or height of the image.
+	MaxDimension uint64
+	// MaxFrames is the largest number of frames in an animated GIF.
+	MaxFrames uint64
+}
+
+// DefaultDecodeLimits are the limits DecodeImage and DecodeImageInfo check.
+// They can be set from the environment with DECODE_MAX_BYTES,
+// DECODE_MAX_PIXELS, DECODE_MAX_DIMENSION and DECODE_MAX_FRAMES.
+var DefaultDecodeLimits = DecodeLimits{
+	MaxBytes:     50 << 20,
+	MaxPixels:    50_000_000,
+	MaxDimension: 16384,
+	MaxFrames:    256,
+}
+
+// LimitError reports an image exceeding one of its DecodeLimits. It wraps
+// ErrFileTooLarge, ErrImageTooLarge or ErrTooManyFrames.
+type LimitError struct {
+	Err error
+	// Limit names the limit exceeded: "bytes", "pixels", "dimension" or
+	// "frames".
+	Limit string
+	Value uint64
+	Max   uint64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v: %d %s exceeds the limit of %d", e.Err, e.Value,
+		e.Limit, e.Max)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode returns the HTTP status to respond to the upload with: 413
+// for a file too large to accept, and 422 for an image too large to
+// process.
+func (e *LimitError) StatusCode() int {
+	if errors.Is(e.Err, ErrFileTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// HTTPStatus returns the HTTP status to respond to an upload that failed to
+// decode with `err`: as LimitError.StatusCode says for limits exceeded, and
+// 422 for invalid images. Other errors are not the upload's fault, and
+// return 0.
+func HTTPStatus(err error) int {
+	var limitErr *LimitError
+	switch {
+	case errors.As(err, &limitErr):
+		return limitErr.StatusCode()
+	case errors.Is(err, ErrInvalidImage):
+		return http.StatusUnprocessableEntity
+	}
+	return 0
+}
+
+// CheckDecodeLimits reads the header of `raw` and checks it against
+// `limits`, or DefaultDecodeLimits if nil, without decoding the image. It
+// returns the image's configuration and format, failing with a LimitError
+// if a limit is exceeded, or ErrInvalidImage if the header cannot be read.
+func CheckDecodeLimits(
+	raw []byte,
+	limits *DecodeLimits,
+) (config image.Config, format string, err error) {
+	if limits == nil {
+		limits = &DefaultDecodeLimits
+	}
+	exceeds := func(value uint64, max uint64) bool {
+		return max > 0 && value > max
+	}
+	if size := uint64(len(raw)); exceeds(size, limits.MaxBytes) {
+		return config, "", &LimitError{Err: ErrFileTooLarge, Limit: "bytes",
+			Value: size, Max: limits.MaxBytes}
+	}
+	config, format, err = image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return config, "", fmt.Errorf("%w: %w", ErrInvalidImage, err)
+	}
+	if config.Width < 0 || config.Height < 0 {
+		return config, format, fmt.Errorf("%w: %dx%d", ErrInvalidImage,
+			config.Width, config.Height)
+	}
+	dimension := uint64(max(config.Width, config.Height))
+	if exceeds(dimension, limits.MaxDimension) {
+		return config, format, &LimitError{Err: ErrImageTooLarge,
+			Limit: "dimension", Value: dimension, Max: limits.MaxDimension}
+	}
+	pixels := uint64(config.Width) * uint64(config.Height)
+	if exceeds(pixels, limits.MaxPixels) {
+		return config, format, &LimitError{Err: ErrImageTooLarge,
+			Limit: "pixels", Value: pixels, Max: limits.MaxPixels}
+	}
+	if format == "gif" && limits.MaxFrames > 0 {
+		frames, framesErr := countGifFrames(raw, limits.MaxFrames+1)
+		if framesErr != nil {
+			return config, format, framesErr
+		}
+		if exceeds(frames, limits.MaxFrames) {
+			return config, format, &LimitError{Err: ErrTooManyFrames,
+				Limit: "frames", Value: frames, Max: limits.MaxFrames}
+		}
+	}
+	return config, format, nil
+}
+
+// countGifFrames counts the frames of a GIF by walking its blocks, without
+// decompressing them, stopping once it has counted `stop`.
+func countGifFrames(raw []byte, stop uint64) (uint64, error) {
+	truncated := fmt.Errorf("%w: truncated GIF", ErrInvalidImage)
+	// colorTable returns the size of the color table a block's flags
+	// declare.
+	colorTable := func(flags byte) int {
+		if flags&0x80 == 0 {
+			return 0
+		}
+		return 3 << (flags&0x07 + 1)
+	}
+	// skipSubBlocks skips the data sub-blocks starting at `pos`, up to and
+	// including their terminator.
+	skipSubBlocks := func(pos int) int {
+		for pos < len(raw) && raw[pos] != 0 {
+			pos += int(raw[pos]) + 1
+		}
+		return pos + 1
+	}
+
+	// The header is followed by the logical screen descriptor, whose
+	// flags declare the global color table.
+	if len(raw) < 13 {
+		return 0, truncated
+	}
+	pos := 13 + colorTable(raw[10])
+	var frames uint64
+	for frames < stop {
+		if pos >= len(raw) {
+			return frames, truncated
+		}
+		switch raw[pos] {
+		case 0x21:
+			// An extension, its label and its data.
+			pos = skipSubBlocks(pos + 2)
+		case 0x2c:
+			// An image descriptor, its local color table, the LZW minimum
+			// code size and the image data.
+			if pos+10 > len(raw) {
+				return frames, truncated
+			}
+			frames++
+			pos = skipSubBlocks(pos + 10 + colorTable(raw[pos+9]) + 1)
+		case 0x3b:
+			return frames, nil
+		default:
+			return frames, fmt.Errorf("%w: unknown GIF block 0x%02x",
+				ErrInvalidImage, raw[pos])
+		}
+	}
+	return frames, nil
+}
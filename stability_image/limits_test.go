@@ -0,0 +1,111 @@
+package stability_image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"net/http"
+	"testing"
+)
+
+// withDeclaredSize returns the PNG `encoded` with the size its IHDR chunk
+// declares replaced by `size`, leaving its pixel data as it was.
+func withDeclaredSize(encoded []byte, size image.Point) []byte {
+	patched := append([]byte{}, encoded...)
+	ihdr := patched[len(pngSignature)+8:]
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(size.X))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(size.Y))
+	binary.BigEndian.PutUint32(ihdr[13:],
+		crc32.ChecksumIEEE(patched[len(pngSignature)+4:len(pngSignature)+21]))
+	return patched
+}
+
+func TestDecodeLimits(t *testing.T) {
+	tiny, err := EncodePng(flatImage(image.Point{X: 1, Y: 1},
+		color.NRGBA{A: 255}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A tiny PNG declaring a huge image is rejected from its header.
+	for _, test := range []struct {
+		size  image.Point
+		limit string
+	}{
+		{image.Point{X: 50000, Y: 50000}, "dimension"},
+		{image.Point{X: 16000, Y: 16000}, "pixels"},
+	} {
+		bomb := withDeclaredSize(*tiny, test.size)
+		_, _, _, decodeErr := DecodeImage(&bomb)
+		var limitErr *LimitError
+		if !errors.As(decodeErr, &limitErr) || limitErr.Limit != test.limit ||
+			!errors.Is(decodeErr, ErrImageTooLarge) {
+			t.Error(test.size, "was not rejected by", test.limit, decodeErr)
+			continue
+		}
+		if status := HTTPStatus(fmt.Errorf("upload: %w", decodeErr)); status !=
+			http.StatusUnprocessableEntity {
+			t.Error(test.size, "maps to", status)
+		}
+	}
+
+	// Files are limited before their headers are read.
+	limits := DefaultDecodeLimits
+	limits.MaxBytes = uint64(len(*tiny)) - 1
+	_, err = DecodeImageInfoWithLimits(tiny, &limits)
+	if !errors.Is(err, ErrFileTooLarge) ||
+		HTTPStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Error("large file was not rejected", err)
+	}
+	limits.MaxBytes = 0
+	if _, err = DecodeImageInfoWithLimits(tiny, &limits); err != nil {
+		t.Error("unlimited file was rejected", err)
+	}
+
+	// GIF frames are counted without being decoded.
+	animation := &gif.GIF{}
+	for frame := 0; frame < 5; frame++ {
+		paletted := image.NewPaletted(image.Rect(0, 0, 16, 16),
+			palette.Plan9)
+		paletted.Pix[frame] = 1
+		animation.Image = append(animation.Image, paletted)
+		animation.Delay = append(animation.Delay, 10)
+	}
+	buf := new(bytes.Buffer)
+	if err = gif.EncodeAll(buf, animation); err != nil {
+		t.Fatal(err)
+	}
+	animated := buf.Bytes()
+	if frames, countErr := countGifFrames(animated, 100); frames != 5 ||
+		countErr != nil {
+		t.Error("counted", frames, "frames", countErr)
+	}
+	limits.MaxFrames = 4
+	_, err = DecodeImageInfoWithLimits(&animated, &limits)
+	if !errors.Is(err, ErrTooManyFrames) ||
+		HTTPStatus(err) != http.StatusUnprocessableEntity {
+		t.Error("animation was not rejected", err)
+	}
+	limits.MaxFrames = 5
+	if _, err = DecodeImageInfoWithLimits(&animated, &limits); err != nil {
+		t.Error("animation was rejected", err)
+	}
+
+	// Files that are not images are invalid, and other errors are not the
+	// upload's fault.
+	garbage := []byte("not an image")
+	_, _, _, err = DecodeImage(&garbage)
+	if !errors.Is(err, ErrInvalidImage) || !errors.Is(err, image.ErrFormat) ||
+		HTTPStatus(err) != http.StatusUnprocessableEntity {
+		t.Error("garbage was not reported", err)
+	}
+	if status := HTTPStatus(ErrGeometryMismatch); status != 0 {
+		t.Error("unrelated error maps to", status)
+	}
+}
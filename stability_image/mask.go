@@ -0,0 +1,215 @@
+package stability_image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+
+	"github.com/mazznoer/colorgrad"
+	"github.com/mazznoer/csscolorparser"
+)
+
+var ErrUnknownMaskProfile = errors.New("unknown mask profile")
+
+// MaskProfile is the shape of an outpaint mask's falloff across its feather.
+type MaskProfile int
+
+const (
+	MaskProfileLinear MaskProfile = iota
+	MaskProfileSmoothstep
+	MaskProfileCosine
+	MaskProfileExponential
+	MaskProfileCustom
+)
+
+func (p MaskProfile) String() string {
+	return [...]string{"linear", "smoothstep", "cosine", "exponential",
+		"custom"}[p]
+}
+
+func (p *MaskProfile) FromString(s string) {
+	switch s {
+	case "linear":
+		*p = MaskProfileLinear
+	case "smoothstep":
+		*p = MaskProfileSmoothstep
+	case "cosine":
+		*p = MaskProfileCosine
+	case "exponential":
+		*p = MaskProfileExponential
+	case "custom":
+		*p = MaskProfileCustom
+	}
+}
+
+func (p MaskProfile) MarshalText() ([]byte, error) {
+	if p < MaskProfileLinear || p > MaskProfileCustom {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownMaskProfile, int(p))
+	}
+	return []byte(p.String()), nil
+}
+
+func (p *MaskProfile) UnmarshalText(text []byte) error {
+	parsed := MaskProfile(-1)
+	parsed.FromString(string(text))
+	if parsed < 0 {
+		return fmt.Errorf("%w: %q", ErrUnknownMaskProfile, text)
+	}
+	*p = parsed
+	return nil
+}
+
+// MaskExponent is the steepness of MaskProfileExponential.
+const MaskExponent = 4.0
+
+// maskProfileSamples is the number of segments smooth profiles are sampled
+// into when building a gradient.
+const maskProfileSamples = 16
+
+// MaskStop is a point on a custom falloff: at `Position` across the feather,
+// from the generated edge at 0 to the kept side at 1, the source is kept by
+// `Weight`, from 0 to 1.
+type MaskStop struct {
+	Position float64 `json:"position"`
+	Weight   float64 `json:"weight"`
+}
+
+// MaskFalloff describes how an outpaint mask ramps from generating the
+// extended area to keeping the source, across the feather along the source's
+// edge.
+type MaskFalloff struct {
+	Profile MaskProfile `json:"profile"`
+	// Stops are the falloff of MaskProfileCustom, interpolated linearly.
+	Stops []MaskStop `json:"stops,omitempty"`
+}
+
+// Weight returns how much of the source is kept at `t` across the feather,
+// from the generated edge at 0 to the kept side at 1.
+func (f MaskFalloff) Weight(t float64) float64 {
+	t = math.Max(0, math.Min(1, t))
+	switch f.Profile {
+	case MaskProfileSmoothstep:
+		return t * t * (3 - 2*t)
+	case MaskProfileCosine:
+		return (1 - math.Cos(math.Pi*t)) / 2
+	case MaskProfileExponential:
+		return math.Expm1(MaskExponent*t) / math.Expm1(MaskExponent)
+	case MaskProfileCustom:
+		return f.customWeight(t)
+	}
+	return t
+}
+
+func (f MaskFalloff) sortedStops() []MaskStop {
+	stops := append([]MaskStop(nil), f.Stops...)
+	sort.SliceStable(stops, func(i, j int) bool {
+		return stops[i].Position < stops[j].Position
+	})
+	return stops
+}
+
+func (f MaskFalloff) customWeight(t float64) float64 {
+	stops := f.sortedStops()
+	if len(stops) == 0 {
+		return t
+	}
+	clamp := func(w float64) float64 { return math.Max(0, math.Min(1, w)) }
+	if t <= stops[0].Position {
+		return clamp(stops[0].Weight)
+	}
+	for idx := 1; idx < len(stops); idx++ {
+		lo, hi := stops[idx-1], stops[idx]
+		if t <= hi.Position {
+			if hi.Position == lo.Position {
+				return clamp(hi.Weight)
+			}
+			frac := (t - lo.Position) / (hi.Position - lo.Position)
+			return clamp(lo.Weight + frac*(hi.Weight-lo.Weight))
+		}
+	}
+	return clamp(stops[len(stops)-1].Weight)
+}
+
+// samples returns the positions across the feather at which the falloff is
+// sampled to approximate it linearly, in ascending order. Linear and custom
+// falloffs are exact at their stops.
+func (f MaskFalloff) samples() []float64 {
+	switch f.Profile {
+	case MaskProfileLinear:
+		return []float64{0, 1}
+	case MaskProfileCustom:
+		positions := []float64{0}
+		for _, stop := range f.sortedStops() {
+			if stop.Position > 0 && stop.Position < 1 {
+				positions = append(positions, stop.Position)
+			}
+		}
+		return append(positions, 1)
+	}
+	positions := make([]float64, 0, maskProfileSamples+1)
+	for idx := 0; idx <= maskProfileSamples; idx++ {
+		positions = append(positions, float64(idx)/maskProfileSamples)
+	}
+	return positions
+}
+
+// maskValue returns the mask level for keeping the source by `weight`, out
+// of `background`. Inverted masks mark the kept source black instead.
+func maskValue(weight float64, background uint16, invert bool) uint16 {
+	if invert {
+		weight = 1 - weight
+	}
+	return uint16(math.Round(weight * float64(background)))
+}
+
+// maskGenerated returns which pixels of `mask` are generated, indexed by row
+// from its minimum point: those under half of full intensity, as outpaint
+// masks mark them black.
+func maskGenerated(mask image.Image) []bool {
+	bounds := mask.Bounds()
+	generated := make([]bool, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray := color.Gray16Model.Convert(mask.At(x, y)).(color.Gray16)
+			generated[(y-bounds.Min.Y)*bounds.Dx()+x-bounds.Min.X] =
+				gray.Y < 0x8000
+		}
+	}
+	return generated
+}
+
+// maskGradient returns the gradient of an outpaint mask that ramps from
+// keeping the source at 0 to generating at `featherDomain` following
+// `falloff`, and generates the rest of the way to 1.
+func maskGradient(
+	falloff MaskFalloff,
+	background uint16,
+	invert bool,
+	featherDomain float64,
+) (colorgrad.Gradient, error) {
+	gray := func(value uint16) csscolorparser.Color {
+		v := float64(value) / 0xffff
+		return csscolorparser.Color{R: v, G: v, B: v, A: 1}
+	}
+	samples := falloff.samples()
+	colors := make([]csscolorparser.Color, 0, len(samples)+1)
+	domain := make([]float64, 0, len(samples)+1)
+	// The gradient runs from the kept side to the generated side, the
+	// reverse of the falloff.
+	for idx := len(samples) - 1; idx >= 0; idx-- {
+		t := samples[idx]
+		colors = append(colors, gray(maskValue(falloff.Weight(t),
+			background, invert)))
+		domain = append(domain, featherDomain*(1-t))
+	}
+	colors = append(colors, gray(maskValue(0, background, invert)))
+	domain = append(domain, math.Max(1, featherDomain))
+	return colorgrad.NewGradient().
+		Colors(colors...).
+		Domain(domain...).
+		Interpolation(colorgrad.InterpolationLinear).
+		Build()
+}
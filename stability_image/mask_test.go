@@ -0,0 +1,178 @@
+package stability_image
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false,
+	"regenerate the golden images under ../resources/golden")
+
+const goldenDir = "../resources/golden"
+
+// checkGolden compares `mask` to the golden image `name`, rewriting the
+// golden instead when the tests are run with -update.
+func checkGolden(t *testing.T, name string, mask *[]byte) {
+	t.Helper()
+	path := filepath.Join(goldenDir, name)
+	if *updateGolden {
+		if err := os.MkdirAll(goldenDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, *mask, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	goldenData, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, _, _, err := DecodeImage(&goldenData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, _, err := DecodeImage(mask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Bounds() != golden.Bounds() {
+		t.Fatal("mask is", got.Bounds(), "but golden is", golden.Bounds())
+	}
+	bounds := golden.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			want := color.Gray16Model.Convert(golden.At(x, y))
+			if have := color.Gray16Model.Convert(got.At(x, y)); have !=
+				want {
+				t.Fatal("mask differs from", name, "at", x, y, ":", have,
+					"!=", want)
+			}
+		}
+	}
+}
+
+func TestMaskFalloffWeight(t *testing.T) {
+	for profile := MaskProfileLinear; profile < MaskProfileCustom; profile++ {
+		falloff := MaskFalloff{Profile: profile}
+		if falloff.Weight(0) != 0 || falloff.Weight(1) != 1 {
+			t.Error(profile, "does not span 0 to 1")
+		}
+		if falloff.Weight(-1) != 0 || falloff.Weight(2) != 1 {
+			t.Error(profile, "is not clamped")
+		}
+		for step := 1; step <= 100; step++ {
+			if falloff.Weight(float64(step)/100) <
+				falloff.Weight(float64(step-1)/100) {
+				t.Error(profile, "is not monotonic at", step)
+			}
+		}
+		var parsed MaskProfile
+		parsed.FromString(profile.String())
+		if parsed != profile {
+			t.Error(profile, "round trips to", parsed)
+		}
+	}
+	custom := MaskFalloff{Profile: MaskProfileCustom, Stops: []MaskStop{
+		{Position: 1, Weight: 1}, {Position: 0.5, Weight: 0.2},
+		{Position: 0, Weight: 0}}}
+	for _, check := range [][2]float64{{0, 0}, {0.25, 0.1}, {0.5, 0.2},
+		{0.75, 0.6}, {1, 1}} {
+		if weight := custom.Weight(check[0]); math.Abs(weight-check[1]) >
+			1e-9 {
+			t.Error("custom weight at", check[0], "is", weight)
+		}
+	}
+}
+
+func TestOutpaintMaskGolden(t *testing.T) {
+	imageData, err := os.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom := MaskFalloff{Profile: MaskProfileCustom, Stops: []MaskStop{
+		{Position: 0.25, Weight: 0}, {Position: 0.5, Weight: 0.75},
+		{Position: 1, Weight: 1}}}
+	cases := []struct {
+		name      string
+		width     int
+		height    int
+		direction Direction
+		falloff   MaskFalloff
+		feather   int
+		invert    bool
+		zoomOut   float64
+	}{
+		{"mask_linear_center.png", 384, 256, DirectionCenter,
+			MaskFalloff{}, 0, false, 0},
+		{"mask_smoothstep_left.png", 384, 256, DirectionLeft,
+			MaskFalloff{Profile: MaskProfileSmoothstep}, 0, false, 0},
+		{"mask_cosine_feather.png", 384, 256, DirectionRight,
+			MaskFalloff{Profile: MaskProfileCosine}, 48, false, 0},
+		{"mask_exponential_up.png", 256, 384, DirectionUp,
+			MaskFalloff{Profile: MaskProfileExponential}, 32, false, 0},
+		{"mask_custom_center.png", 384, 256, DirectionCenter, custom, 40,
+			false, 0},
+		{"mask_linear_inverted.png", 384, 256, DirectionCenter,
+			MaskFalloff{}, 0, true, 0},
+		{"mask_cosine_zoom.png", 384, 256, DirectionDownRight,
+			MaskFalloff{Profile: MaskProfileCosine}, 24, false, 0.5},
+		{"mask_smoothstep_zoom_inverted.png", 384, 256, DirectionCenter,
+			MaskFalloff{Profile: MaskProfileSmoothstep}, 0, true, 0.6},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := NewOutpaintImageOpts()
+			opts.Seed = 1
+			opts.AnchorDirection = c.direction
+			opts.MaskFalloff = c.falloff
+			opts.MaskFeather = c.feather
+			opts.MaskInvert = c.invert
+			opts.ZoomOut = c.zoomOut
+			_, masked, _, _, _, prepareErr := PrepareOutpaintImage(
+				&imageData, c.width, c.height, opts)
+			if prepareErr != nil {
+				t.Fatal(prepareErr)
+			}
+			checkGolden(t, c.name, masked)
+		})
+	}
+}
+
+func TestCreatePlacementMask(t *testing.T) {
+	placement := image.Rect(32, 16, 96, 64)
+	falloff := MaskFalloff{Profile: MaskProfileSmoothstep}
+	mask := CreatePlacementMask(image.Point{X: 128, Y: 64}, placement, 8,
+		OutpaintBackground, falloff, false)
+	inverted := CreatePlacementMask(image.Point{X: 128, Y: 64}, placement, 8,
+		OutpaintBackground, falloff, true)
+	if mask.Gray16At(0, 0).Y != 0 ||
+		inverted.Gray16At(0, 0).Y != OutpaintBackground {
+		t.Error("outside of the placement is not generated")
+	}
+	if mask.Gray16At(64, 50).Y != OutpaintBackground ||
+		inverted.Gray16At(64, 50).Y != 0 {
+		t.Error("inside of the placement is not kept")
+	}
+	// The bottom edge touches the canvas border, so it is not feathered.
+	if mask.Gray16At(64, 63).Y != OutpaintBackground {
+		t.Error("the edge on the canvas border is feathered")
+	}
+	for distance := 0; distance < 8; distance++ {
+		weight := falloff.Weight((float64(distance) + 0.5) / 8)
+		want := uint16(math.Round(weight * float64(OutpaintBackground)))
+		if have := mask.Gray16At(32+distance, 40).Y; have != want {
+			t.Error("feather at", distance, "is", have, "not", want)
+		}
+		if sum := uint32(mask.Gray16At(32+distance, 40).Y) +
+			uint32(inverted.Gray16At(32+distance, 40).Y); sum !=
+			uint32(OutpaintBackground) {
+			t.Error("inverted feather at", distance, "does not complement")
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package stability_image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+var ErrUnknownOrientation = errors.New("unknown orientation")
+
+// Orientation is how an image is stored relative to how it is meant to be
+// displayed, as recorded by its EXIF Orientation tag. Each orientation is
+// named for the transform that turns the stored image upright, and is one
+// less than its EXIF value.
+type Orientation int
+
+const (
+	// OrientationNormal is stored upright, and is also assumed for images
+	// without an orientation.
+	OrientationNormal Orientation = iota
+	// OrientationFlipHorizontal is mirrored left to right.
+	OrientationFlipHorizontal
+	// OrientationRotate180 is upside down.
+	OrientationRotate180
+	// OrientationFlipVertical is mirrored top to bottom.
+	OrientationFlipVertical
+	// OrientationTranspose is mirrored across its top-left to bottom-right
+	// diagonal.
+	OrientationTranspose
+	// OrientationRotate90 is rotated counter-clockwise, and is turned
+	// upright by rotating it 90° clockwise. Phone cameras held upright
+	// store this.
+	OrientationRotate90
+	// OrientationTransverse is mirrored across its top-right to bottom-left
+	// diagonal.
+	OrientationTransverse
+	// OrientationRotate270 is rotated clockwise, and is turned upright by
+	// rotating it 270° clockwise.
+	OrientationRotate270
+)
+
+const (
+	// exifOrientationTag is the TIFF tag of the orientation in IFD0.
+	exifOrientationTag = 0x0112
+	// exifShort is the TIFF type of the orientation's value.
+	exifShort = 3
+)
+
+// exifHeader starts the EXIF APP1 segment of a JPEG, and may start the EXIF
+// chunk of a WebP.
+var exifHeader = []byte("Exif\x00\x00")
+
+func (o Orientation) String() string {
+	return [...]string{"normal", "flip-horizontal", "rotate-180",
+		"flip-vertical", "transpose", "rotate-90", "transverse",
+		"rotate-270"}[o]
+}
+
+func (o *Orientation) FromString(s string) {
+	switch s {
+	case "normal":
+		*o = OrientationNormal
+	case "flip-horizontal":
+		*o = OrientationFlipHorizontal
+	case "rotate-180":
+		*o = OrientationRotate180
+	case "flip-vertical":
+		*o = OrientationFlipVertical
+	case "transpose":
+		*o = OrientationTranspose
+	case "rotate-90":
+		*o = OrientationRotate90
+	case "transverse":
+		*o = OrientationTransverse
+	case "rotate-270":
+		*o = OrientationRotate270
+	}
+}
+
+func (o Orientation) MarshalText() ([]byte, error) {
+	if o < OrientationNormal || o > OrientationRotate270 {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownOrientation, int(o))
+	}
+	return []byte(o.String()), nil
+}
+
+func (o *Orientation) UnmarshalText(text []byte) error {
+	parsed := Orientation(-1)
+	parsed.FromString(string(text))
+	if parsed < 0 {
+		return fmt.Errorf("%w: %q", ErrUnknownOrientation, text)
+	}
+	*o = parsed
+	return nil
+}
+
+// OrientationFromExif returns the orientation of an EXIF Orientation value,
+// taking values out of range as OrientationNormal.
+func OrientationFromExif(value int) Orientation {
+	if value < 1 || value > 8 {
+		return OrientationNormal
+	}
+	return Orientation(value - 1)
+}
+
+// Exif returns the EXIF Orientation value of the orientation.
+func (o Orientation) Exif() int {
+	return int(o) + 1
+}
+
+// Swapped reports whether the stored image's width is its upright height.
+func (o Orientation) Swapped() bool {
+	return o >= OrientationTranspose && o <= OrientationRotate270
+}
+
+// Upright turns `img`, stored in the orientation, upright. Normal images are
+// returned as they are.
+func (o Orientation) Upright(img image.Image) image.Image {
+	switch o {
+	case OrientationFlipHorizontal:
+		return imaging.FlipH(img)
+	case OrientationRotate180:
+		return imaging.Rotate180(img)
+	case OrientationFlipVertical:
+		return imaging.FlipV(img)
+	case OrientationTranspose:
+		return imaging.Transpose(img)
+	case OrientationRotate90:
+		// imaging rotates counter-clockwise.
+		return imaging.Rotate270(img)
+	case OrientationTransverse:
+		return imaging.Transverse(img)
+	case OrientationRotate270:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
+
+// ReadOrientation returns the orientation recorded in the EXIF metadata of
+// an encoded JPEG, PNG or WebP, without decoding it. Images without an
+// orientation, or whose metadata cannot be read, are OrientationNormal.
+func ReadOrientation(raw []byte) Orientation {
+	orientation := OrientationNormal
+	switch {
+	case isJpeg(raw):
+		jpegSegments(raw, func(marker byte, data []byte) bool {
+			if marker == 0xe1 && bytes.HasPrefix(data, exifHeader) {
+				orientation = exifOrientation(data[len(exifHeader):])
+				return false
+			}
+			return true
+		})
+	case isPng(raw):
+		pngChunks(raw, func(chunk string, data []byte) bool {
+			if chunk == "eXIf" {
+				orientation = exifOrientation(data)
+				return false
+			}
+			return true
+		})
+	case isWebp(raw):
+		webpChunks(raw, func(chunk string, data []byte) bool {
+			if chunk == "EXIF" {
+				orientation = exifOrientation(bytes.TrimPrefix(data,
+					exifHeader))
+				return false
+			}
+			return true
+		})
+	}
+	return orientation
+}
+
+// exifOrientation reads the Orientation tag from IFD0 of the TIFF structure
+// EXIF metadata is stored as.
+func exifOrientation(tiff []byte) Orientation {
+	if len(tiff) < 8 {
+		return OrientationNormal
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return OrientationNormal
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return OrientationNormal
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return OrientationNormal
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for entry := 0; entry < entries; entry++ {
+		// Entries are a tag, a type, a count and the value, which a single
+		// short fits in.
+		pos := ifd + 2 + entry*12
+		if pos+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[pos:]) != exifOrientationTag {
+			continue
+		}
+		if order.Uint16(tiff[pos+2:]) != exifShort {
+			break
+		}
+		return OrientationFromExif(int(order.Uint16(tiff[pos+8:])))
+	}
+	return OrientationNormal
+}
@@ -0,0 +1,182 @@
+package stability_image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// exifTiff returns EXIF metadata holding just an EXIF Orientation `value`,
+// in the given byte order.
+func exifTiff(order binary.ByteOrder, value int) []byte {
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], exifOrientationTag)
+	order.PutUint16(tiff[12:], exifShort)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(value))
+	return tiff
+}
+
+// jpegWithSegment returns an encoded JPEG with an APP segment of `marker`
+// holding `data` inserted at its start.
+func jpegWithSegment(encoded []byte, marker byte, data []byte) []byte {
+	embedded := []byte{0xff, 0xd8, 0xff, marker}
+	embedded = binary.BigEndian.AppendUint16(embedded, uint16(len(data)+2))
+	embedded = append(embedded, data...)
+	return append(embedded, encoded[2:]...)
+}
+
+// withExif returns an encoded JPEG or PNG with `tiff` embedded as its EXIF
+// metadata.
+func withExif(encoded []byte, tiff []byte) []byte {
+	if isJpeg(encoded) {
+		return jpegWithSegment(encoded, 0xe1, append(append([]byte{},
+			exifHeader...), tiff...))
+	}
+	return pngWithChunk(encoded, "eXIf", tiff)
+}
+
+func TestDecodeImageOrientation(t *testing.T) {
+	// The upright image has a color in each quadrant, in the order of
+	// `corners`.
+	upright := image.Point{X: 64, Y: 48}
+	colors := []color.NRGBA{{255, 0, 0, 255}, {0, 255, 0, 255},
+		{0, 0, 255, 255}, {255, 255, 255, 255}}
+	corners := []image.Point{{16, 12}, {48, 12}, {16, 36}, {48, 36}}
+	// stored lists, for each EXIF value, the quadrant each upright
+	// quadrant is stored in: top-left, top-right, bottom-left and then
+	// bottom-right.
+	stored := map[int][4]int{
+		1: {0, 1, 2, 3},
+		2: {1, 0, 3, 2},
+		3: {3, 2, 1, 0},
+		4: {2, 3, 0, 1},
+		5: {0, 2, 1, 3},
+		6: {2, 0, 3, 1},
+		7: {3, 1, 2, 0},
+		8: {1, 3, 0, 2},
+	}
+	for value := 1; value <= 8; value++ {
+		orientation := OrientationFromExif(value)
+		size := upright
+		if orientation.Swapped() {
+			size = image.Point{X: upright.Y, Y: upright.X}
+		}
+		img := image.NewNRGBA(image.Rectangle{Max: size})
+		for quadrant, to := range stored[value] {
+			half := size.Div(2)
+			rect := image.Rectangle{Max: half}.Add(image.Point{
+				X: to % 2 * half.X, Y: to / 2 * half.Y})
+			for y := rect.Min.Y; y < rect.Max.Y; y++ {
+				for x := rect.Min.X; x < rect.Max.X; x++ {
+					img.SetNRGBA(x, y, colors[quadrant])
+				}
+			}
+		}
+		var order binary.ByteOrder = binary.LittleEndian
+		if value%2 == 1 {
+			order = binary.BigEndian
+		}
+		pngData, err := EncodePng(img, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var jpegData bytes.Buffer
+		if err = jpeg.Encode(&jpegData, img, &jpeg.Options{
+			Quality: 95}); err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			encoded   []byte
+			tolerance int
+		}{
+			{withExif(*pngData, exifTiff(order, value)), 0},
+			{withExif(jpegData.Bytes(), exifTiff(order, value)), 16},
+		} {
+			if read := ReadOrientation(test.encoded); read != orientation ||
+				read.Exif() != value {
+				t.Error(value, "was read as", read)
+			}
+			info, decodeErr := DecodeImageInfo(&test.encoded)
+			if decodeErr != nil {
+				t.Fatal(value, decodeErr)
+			}
+			if info.Size != upright || info.Orientation != orientation {
+				t.Error(value, info.Format, "decoded to", info.Size,
+					info.Orientation)
+				continue
+			}
+			for quadrant, corner := range corners {
+				if colorDistance(info.Image.At(corner.X, corner.Y),
+					colors[quadrant]) > test.tolerance {
+					t.Error(value, info.Format, "has",
+						info.Image.At(corner.X, corner.Y), "at", corner)
+				}
+			}
+		}
+	}
+
+	// Images stored on their side are coerced and outpainted upright, and
+	// never passed through as they are.
+	img := image.NewNRGBA(image.Rect(0, 0, 1024, 768))
+	encoded, err := EncodePng(img, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sideways := withExif(*encoded, exifTiff(binary.LittleEndian, 6))
+	aspects := NewAspectRatios(1048576, 64, 256, 1536)
+	result, err := aspects.CoerceImageWithOpts(&sideways, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Source != (image.Point{X: 768, Y: 1024}) ||
+		result.Orientation != OrientationRotate90 ||
+		result.Size.X >= result.Size.Y {
+		t.Error("coerced", result.Source, result.Orientation, "to",
+			result.Size)
+	}
+	plan, err := PlanOutpaint(&sideways, 768, 1024, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Coerced == &sideways || plan.Orientation != OrientationRotate90 ||
+		plan.Source != (image.Point{X: 768, Y: 1024}) {
+		t.Error("planned", plan.Source, plan.Orientation)
+	}
+	encodedPlan, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(encodedPlan, []byte(`"orientation":"rotate-90"`)) {
+		t.Error("orientation was not serialized", string(encodedPlan))
+	}
+
+	// Broken metadata is ignored.
+	for _, broken := range [][]byte{
+		withExif(*encoded, exifTiff(binary.BigEndian, 6)[:16]),
+		withExif(*encoded, exifTiff(binary.BigEndian, 9)),
+		withExif(*encoded, []byte("XX*\x00\x08\x00\x00\x00")),
+	} {
+		if read := ReadOrientation(broken); read != OrientationNormal {
+			t.Error("broken metadata was read as", read)
+		}
+	}
+	var orientation Orientation
+	if err = json.Unmarshal([]byte(`"sideways"`), &orientation); !errors.Is(
+		err, ErrUnknownOrientation) {
+		t.Error("unknown orientation was not reported", err)
+	}
+}
@@ -5,11 +5,10 @@ import (
 	"image"
 	"image/color"
 	"image/png"
+	"math/rand"
 	"strings"
 
 	"github.com/disintegration/imaging"
-	"github.com/mazznoer/colorgrad"
-	"github.com/mazznoer/csscolorparser"
 )
 
 var (
@@ -124,39 +123,71 @@ func (c *OutpaintCondition) FromPoints(a image.Point, b image.Point) {
 	c.String()) */
 }
 
-// SetDirection sets direction of the outpaint.
+// FromPlacement sets the outpaint condition from where a source is placed
+// on the canvas: each axis the placement does not fill is a target axis, and
+// the placement is anchored to the canvas edges it touches.
+func (c *OutpaintCondition) FromPlacement(
+	canvas image.Point,
+	placement image.Rectangle,
+) {
+	*c = CondNone
+	anchor := image.Point{}
+	if placement.Dx() < canvas.X {
+		*c |= CondTargetX
+		if placement.Min.X <= 0 {
+			anchor.X = -1
+		} else if placement.Max.X >= canvas.X {
+			anchor.X = 1
+		}
+	}
+	if placement.Dy() < canvas.Y {
+		*c |= CondTargetY
+		if placement.Min.Y <= 0 {
+			anchor.Y = -1
+		} else if placement.Max.Y >= canvas.Y {
+			anchor.Y = 1
+		}
+	}
+	c.SetDirection(DirectionFromMatrix(anchor))
+}
+
+// SetDirection sets direction of the outpaint. Corner directions set both
+// of their anchors.
 func (c *OutpaintCondition) SetDirection(direction Direction) {
 	*c &= ^(CondAnchorCenter | CondAnchorLeft | CondAnchorRight | CondAnchorTop | CondAnchorBottom)
-	switch direction {
-	case DirectionCenter:
-		*c |= CondAnchorCenter
-	case DirectionLeft:
+	v := DirectionMatrix[direction]
+	switch {
+	case v.X < 0:
 		*c |= CondAnchorLeft
-	case DirectionRight:
+	case v.X > 0:
 		*c |= CondAnchorRight
-	case DirectionUp:
+	}
+	switch {
+	case v.Y < 0:
 		*c |= CondAnchorTop
-	case DirectionDown:
+	case v.Y > 0:
 		*c |= CondAnchorBottom
 	}
+	if v.X == 0 && v.Y == 0 {
+		*c |= CondAnchorCenter
+	}
 }
 
 // Direction returns the Direction of the OutpaintCondition, converted from
 // the condition's flags.
 func (c OutpaintCondition) Direction() Direction {
+	v := image.Point{}
 	if c&CondAnchorLeft != 0 {
-		return DirectionLeft
-	}
-	if c&CondAnchorRight != 0 {
-		return DirectionRight
+		v.X = -1
+	} else if c&CondAnchorRight != 0 {
+		v.X = 1
 	}
 	if c&CondAnchorTop != 0 {
-		return DirectionUp
+		v.Y = -1
+	} else if c&CondAnchorBottom != 0 {
+		v.Y = 1
 	}
-	if c&CondAnchorBottom != 0 {
-		return DirectionDown
-	}
-	return DirectionCenter
+	return DirectionFromMatrix(v)
 }
 
 func (c OutpaintCondition) IsSameAspect() bool {
@@ -175,6 +206,12 @@ func (c OutpaintCondition) IsVerticalScale() bool {
 	return c&CondTargetY != 0
 }
 
+// IsBothAxes returns true if the outpaint extends the canvas horizontally
+// and vertically at once.
+func (c OutpaintCondition) IsBothAxes() bool {
+	return c&CondTargetXY == CondTargetXY
+}
+
 // OutpaintAction is an enum that describes the action to take when an
 // outpaint is triggered.
 type OutpaintAction int
@@ -189,6 +226,14 @@ const (
 	OutpaintToLeft
 	OutpaintToTop
 	OutpaintToBottom
+	OutpaintAllSides
+	OutpaintToTopLeft
+	OutpaintToTopRight
+	OutpaintToBottomLeft
+	OutpaintToBottomRight
+	// OutpaintSeamCarve retargets the image with SeamCarve rather than
+	// outpainting it. It is only offered by FilterByOutpaintWithOpts.
+	OutpaintSeamCarve
 )
 
 func (oa OutpaintAction) String() string {
@@ -201,7 +246,13 @@ func (oa OutpaintAction) String() string {
 		"OutpaintToRight",
 		"OutpaintToLeft",
 		"OutpaintToTop",
-		"OutpaintToBottom"}[oa]
+		"OutpaintToBottom",
+		"OutpaintAllSides",
+		"OutpaintToTopLeft",
+		"OutpaintToTopRight",
+		"OutpaintToBottomLeft",
+		"OutpaintToBottomRight",
+		"OutpaintSeamCarve"}[oa]
 }
 
 type OutpaintConditionActionsMap map[OutpaintCondition]OutpaintAction
@@ -210,32 +261,42 @@ type OutpaintConditionActionsMap map[OutpaintCondition]OutpaintAction
 // describing how to outpaint an image. It also acts as a filter, only
 // allowing outpainting of images that match the condition.
 var outpaintActions = OutpaintConditionActionsMap{
-	CondAspectSame | CondBigger | CondAnchorCenter:  OutpaintScaleUp,
-	CondAspectSame | CondBigger | CondAnchorLeft:    OutpaintNone,
-	CondAspectSame | CondBigger | CondAnchorRight:   OutpaintNone,
-	CondAspectSame | CondBigger | CondAnchorTop:     OutpaintNone,
-	CondAspectSame | CondBigger | CondAnchorBottom:  OutpaintNone,
-	CondAspectSame | CondSmaller | CondAnchorCenter: OutpaintScaleDown,
-	CondAspectSame | CondSmaller | CondAnchorLeft:   OutpaintNone,
-	CondAspectSame | CondSmaller | CondAnchorRight:  OutpaintNone,
-	CondAspectSame | CondSmaller | CondAnchorTop:    OutpaintNone,
-	CondAspectSame | CondSmaller | CondAnchorBottom: OutpaintNone,
-	CondTargetY | CondAnchorCenter:                  OutpaintCenterVertical,
-	CondTargetY | CondAnchorRight:                   OutpaintNone,
-	CondTargetY | CondAnchorLeft:                    OutpaintNone,
-	CondTargetY | CondAnchorTop:                     OutpaintToBottom,
-	CondTargetY | CondAnchorBottom:                  OutpaintToTop,
-	CondTargetX | CondAnchorCenter:                  OutpaintCenterHorizontal,
-	CondTargetX | CondAnchorRight:                   OutpaintToLeft,
-	CondTargetX | CondAnchorLeft:                    OutpaintToRight,
-	CondTargetX | CondAnchorTop:                     OutpaintNone,
-	CondTargetX | CondAnchorBottom:                  OutpaintNone,
+	CondAspectSame | CondBigger | CondAnchorCenter:                    OutpaintScaleUp,
+	CondAspectSame | CondBigger | CondAnchorLeft:                      OutpaintNone,
+	CondAspectSame | CondBigger | CondAnchorRight:                     OutpaintNone,
+	CondAspectSame | CondBigger | CondAnchorTop:                       OutpaintNone,
+	CondAspectSame | CondBigger | CondAnchorBottom:                    OutpaintNone,
+	CondAspectSame | CondSmaller | CondAnchorCenter:                   OutpaintScaleDown,
+	CondAspectSame | CondSmaller | CondAnchorLeft:                     OutpaintScaleDown,
+	CondAspectSame | CondSmaller | CondAnchorRight:                    OutpaintScaleDown,
+	CondAspectSame | CondSmaller | CondAnchorTop:                      OutpaintScaleDown,
+	CondAspectSame | CondSmaller | CondAnchorBottom:                   OutpaintScaleDown,
+	CondAspectSame | CondSmaller | CondAnchorTop | CondAnchorLeft:     OutpaintScaleDown,
+	CondAspectSame | CondSmaller | CondAnchorTop | CondAnchorRight:    OutpaintScaleDown,
+	CondAspectSame | CondSmaller | CondAnchorBottom | CondAnchorLeft:  OutpaintScaleDown,
+	CondAspectSame | CondSmaller | CondAnchorBottom | CondAnchorRight: OutpaintScaleDown,
+	CondTargetY | CondAnchorCenter:                                    OutpaintCenterVertical,
+	CondTargetY | CondAnchorRight:                                     OutpaintNone,
+	CondTargetY | CondAnchorLeft:                                      OutpaintNone,
+	CondTargetY | CondAnchorTop:                                       OutpaintToBottom,
+	CondTargetY | CondAnchorBottom:                                    OutpaintToTop,
+	CondTargetX | CondAnchorCenter:                                    OutpaintCenterHorizontal,
+	CondTargetX | CondAnchorRight:                                     OutpaintToLeft,
+	CondTargetX | CondAnchorLeft:                                      OutpaintToRight,
+	CondTargetX | CondAnchorTop:                                       OutpaintNone,
+	CondTargetX | CondAnchorBottom:                                    OutpaintNone,
+	CondTargetXY | CondAnchorCenter:                                   OutpaintAllSides,
+	CondTargetXY | CondAnchorTop | CondAnchorLeft:                     OutpaintToBottomRight,
+	CondTargetXY | CondAnchorTop | CondAnchorRight:                    OutpaintToBottomLeft,
+	CondTargetXY | CondAnchorBottom | CondAnchorLeft:                  OutpaintToTopRight,
+	CondTargetXY | CondAnchorBottom | CondAnchorRight:                 OutpaintToTopLeft,
 }
 
 // OutpaintDescription contains user-friendly description of the outpaint
 // action, as well as the action data itself (e.g. the direction of the
 // outpaint.)
 type OutpaintDescription struct {
+	Action       OutpaintAction
 	Condition    OutpaintCondition
 	Anchor       Direction
 	ExpandDir    []Direction
@@ -344,6 +405,70 @@ var OutpaintDescriptions = OutpaintDescriptionsMap{
 		SourceGlyphs: "▄",
 		DestGlyphs:   "█",
 	},
+	OutpaintAllSides: OutpaintDescription{
+		Anchor: DirectionCenter,
+		ExpandDir: []Direction{
+			DirectionUp,
+			DirectionDown,
+			DirectionLeft,
+			DirectionRight,
+		},
+		ScaleStr:     "Outpaint all sides",
+		ScaleGlyphs:  "✥",
+		SourceGlyphs: "▪",
+		DestGlyphs:   "█",
+	},
+	OutpaintToTopLeft: OutpaintDescription{
+		Anchor: DirectionDownRight,
+		ExpandDir: []Direction{
+			DirectionUp,
+			DirectionLeft,
+		},
+		ScaleStr:     "Outpaint up & left",
+		ScaleGlyphs:  "↖",
+		SourceGlyphs: "▗",
+		DestGlyphs:   "█",
+	},
+	OutpaintToTopRight: OutpaintDescription{
+		Anchor: DirectionDownLeft,
+		ExpandDir: []Direction{
+			DirectionUp,
+			DirectionRight,
+		},
+		ScaleStr:     "Outpaint up & right",
+		ScaleGlyphs:  "↗",
+		SourceGlyphs: "▖",
+		DestGlyphs:   "█",
+	},
+	OutpaintToBottomLeft: OutpaintDescription{
+		Anchor: DirectionUpRight,
+		ExpandDir: []Direction{
+			DirectionDown,
+			DirectionLeft,
+		},
+		ScaleStr:     "Outpaint down & left",
+		ScaleGlyphs:  "↙",
+		SourceGlyphs: "▝",
+		DestGlyphs:   "█",
+	},
+	OutpaintToBottomRight: OutpaintDescription{
+		Anchor: DirectionUpLeft,
+		ExpandDir: []Direction{
+			DirectionDown,
+			DirectionRight,
+		},
+		ScaleStr:     "Outpaint down & right",
+		ScaleGlyphs:  "↘",
+		SourceGlyphs: "▘",
+		DestGlyphs:   "█",
+	},
+	OutpaintSeamCarve: OutpaintDescription{
+		Anchor:       DirectionCenter,
+		ScaleStr:     "Retarget by seam carving",
+		ScaleGlyphs:  "⋮",
+		SourceGlyphs: "▮",
+		DestGlyphs:   "█",
+	},
 }
 
 type OutpaintImageOpts struct {
@@ -352,6 +477,41 @@ type OutpaintImageOpts struct {
 	OutpaintBlurEdge uint32
 	OutpaintNoise    bool
 	AnchorDirection  Direction
+	// Seed seeds the randomness of the preparation, such as the shuffling
+	// of OutpaintNoise. If it is zero, PrepareOutpaintImage picks a seed
+	// and records it here, so that the preparation can be replayed.
+	Seed int64
+	// ZoomOut, if non-zero, zooms out instead of extending one axis: the
+	// source is fitted inside the target, shrunk by this factor, anchored
+	// by AnchorDirection, and all exposed borders are filled.
+	ZoomOut float64
+	// ZoomFillColor fills the borders exposed by ZoomOut with a solid
+	// color rather than reflections of the source.
+	ZoomFillColor *color.NRGBA
+	// AnchorOffset, if set, places the top-left corner of the scaled source
+	// at this pixel offset on the target canvas instead of anchoring it by
+	// AnchorDirection. The source is kept within the canvas.
+	AnchorOffset *image.Point
+	// Filler pre-fills the extended area. If nil, ReflectFiller is used.
+	Filler OutpaintFiller
+	// MaskFalloff shapes the mask's ramp from the generated area into the
+	// source. The zero value is linear.
+	MaskFalloff MaskFalloff
+	// MaskFeather is the width of the mask's ramp in target pixels. If it
+	// is zero, OutpaintOffset scaled to the target is used.
+	MaskFeather int
+	// MaskInvert marks the area to generate with MaskBackground and the
+	// source to keep black, rather than the other way around.
+	MaskInvert bool
+	// Alpha is how a source with transparency is prepared. With
+	// AlphaGenerate, its transparent pixels are masked to be generated.
+	Alpha AlphaPolicy
+	// AlphaColor is the color AlphaFlatten flattens onto. If nil,
+	// DefaultAlphaColor is used.
+	AlphaColor color.Color
+	// Geometry is set by PrepareOutpaintImage to the layout of the images
+	// it prepared, for CompositeOutpaintResult.
+	Geometry *OutpaintGeometry
 }
 
 func NewOutpaintImageOpts() *OutpaintImageOpts {
@@ -367,7 +527,8 @@ func NewOutpaintImageOpts() *OutpaintImageOpts {
 // PrepareOutpaintImage adds a letterbox or pillarbox to the image to make it
 // fit specified aspect ratio, and scales it to fit the specified dimensions.
 // It also adds reflections to the extended areas, and creates a gradient mask
-// to allow Stable Diffusion to replace the reflections.
+// to allow Stable Diffusion to replace the reflections. PlanOutpaint returns
+// the same images along with how they were laid out.
 func PrepareOutpaintImage(
 	src *[]byte,
 	targetWidth int,
@@ -380,32 +541,112 @@ func PrepareOutpaintImage(
 	format string,
 	scaledDim *image.Point,
 	err error,
+) {
+	plan, err := PlanOutpaint(src, targetWidth, targetHeight, opts)
+	return plan.Coerced, plan.Masked, plan.srcDim, plan.Format,
+		plan.scaledDim, err
+}
+
+// prepareOutpaintImage implements PrepareOutpaintImage and PlanOutpaint.
+func prepareOutpaintImage(
+	src *[]byte,
+	targetWidth int,
+	targetHeight int,
+	opts *OutpaintImageOpts,
+) (
+	coerced *[]byte,
+	masked *[]byte,
+	srcDim *image.Point,
+	format string,
+	scaledDim *image.Point,
+	err error,
 ) {
 	if opts == nil {
 		opts = NewOutpaintImageOpts()
 	}
+	if opts.Seed == 0 {
+		opts.Seed = NewSeed()
+	}
+	// Decode the image
+	info, readErr := DecodeImageInfo(src)
+	if readErr != nil {
+		return src, nil, nil, format, nil, readErr
+	}
+	i, alpha, alphaApplied, alphaErr := applyAlphaPolicy(info.Image,
+		opts.Alpha, opts.AlphaColor)
+	if alphaErr != nil {
+		return nil, nil, &info.Size, info.Format, nil, alphaErr
+	}
+	// The source can only be passed through if it is a PNG decoded as it
+	// is stored.
+	passthrough := info.Format == "png" &&
+		info.Orientation == OrientationNormal &&
+		(info.Profile == nil || !info.Profile.Converted) && !alphaApplied
+
+	coerced, masked, srcDim, format, scaledDim, err = prepareOutpaintDecoded(
+		src, i, info, passthrough, targetWidth, targetHeight, opts)
+	if err != nil || alpha == nil {
+		return coerced, masked, srcDim, format, scaledDim, err
+	}
+	masked, err = maskTransparent(masked, alpha, opts.Geometry, opts)
+	return coerced, masked, srcDim, format, scaledDim, err
+}
+
+// prepareOutpaintDecoded prepares `i`, decoded from `src` as `info` says,
+// for prepareOutpaintImage. `src` is returned as it is if it already fits
+// the target and `passthrough` allows it.
+func prepareOutpaintDecoded(
+	src *[]byte,
+	i image.Image,
+	info *ImageInfo,
+	passthrough bool,
+	targetWidth int,
+	targetHeight int,
+	opts *OutpaintImageOpts,
+) (
+	coerced *[]byte,
+	masked *[]byte,
+	srcDim *image.Point,
+	format string,
+	scaledDim *image.Point,
+	err error,
+) {
+	rng := rand.New(rand.NewSource(opts.Seed))
 	var (
 		scaledHeight, scaledWidth int
 		scaledRatio               float64
 		outpaintEdge              = opts.OutpaintOffset
 		outpaintBlurEdge          = opts.OutpaintBlurEdge
 		outpaintNoise             = opts.OutpaintNoise
-		extensionSize             int
 		gradientSize              int
 		dimensionSize             int
 	)
 	scaledDim = &image.Point{}
-	// Decode the image
-	i, format, srcDim, readErr := DecodeImage(src)
-	if readErr != nil {
-		return src, nil, nil, format, nil, readErr
+	format, srcDim = info.Format, &info.Size
+
+	geometry, geometryErr := NewOutpaintGeometry(*srcDim, targetWidth,
+		targetHeight, opts)
+	if geometryErr != nil {
+		return nil, nil, srcDim, format, nil, geometryErr
+	}
+	opts.Geometry = geometry
+
+	if opts.ZoomOut > 0 {
+		var zoomErr error
+		coerced, masked, scaledDim, zoomErr = prepareZoomOutImage(i, geometry,
+			opts, rng)
+		if zoomErr != nil {
+			return nil, nil, srcDim, format, nil, zoomErr
+		}
+		return coerced, masked, srcDim, format, scaledDim, nil
 	}
 
 	// Determine if we don't need to do anything. If the image is already
-	// the correct size and format, just return the original image.
+	// the correct size and can be passed through, just return the original
+	// image.
 	if targetWidth == srcDim.X &&
 		targetHeight == srcDim.Y &&
-		format == "png" {
+		passthrough {
 		return src, nil, srcDim, format, srcDim, nil
 	} else if targetWidth == srcDim.X &&
 		targetHeight == srcDim.Y {
@@ -442,7 +683,8 @@ func PrepareOutpaintImage(
 
 	// Resize the original image to the maximum size we can scale it to and
 	// still preserve the aspect ratio within the target dimensions.
-	resized := imaging.Resize(i, scaledWidth, scaledHeight, imaging.Lanczos)
+	resized := resizeWithAlpha(i, scaledWidth, scaledHeight, imaging.Lanczos,
+		opts.Alpha)
 	*scaledDim = resized.Bounds().Size()
 
 	if scaledDim.X == targetWidth && scaledDim.Y == targetHeight {
@@ -464,9 +706,26 @@ func PrepareOutpaintImage(
 	// i.e. if the image is taller than it is wide, we can only scale it
 	// vertically, so we can't scale it horizontally -- making DirectionLeft
 	// and DirectionRight impossible.
-	if (scaledVertical && conds.Direction().IsHorizontal()) ||
-		(scaledHorizontal && conds.Direction().IsVertical()) {
-		conds.SetDirection(DirectionCenter) // Default to center
+	//
+	// Corner directions are reduced to their component along the scaled
+	// axis, so DirectionUpLeft becomes DirectionUp when scaling vertically.
+	if scaledVertical {
+		conds.SetDirection(conds.Direction().Vertical())
+	} else if scaledHorizontal {
+		conds.SetDirection(conds.Direction().Horizontal())
+	}
+
+	// An arbitrary offset can place the source anywhere along the scaled
+	// axis, so it is filled and masked around its placement.
+	if opts.AnchorOffset != nil {
+		var placeErr error
+		coerced, masked, placeErr = preparePlacedImage(resized, geometry,
+			opts, rng)
+		if placeErr != nil {
+			return nil, nil, srcDim, format, nil, placeErr
+		}
+		return coerced, masked, srcDim, format, &image.Point{X: targetWidth,
+			Y: targetHeight}, nil
 	}
 
 	// Now that we have our scaled image, we need to determine how much
@@ -475,13 +734,11 @@ func PrepareOutpaintImage(
 	if scaledVertical {
 		scaledHeight = scaledDim.Y
 		scaledRatio = float64(targetHeight) / float64(scaledHeight)
-		extensionSize = targetHeight - scaledDim.Y
 		gradientSize = dimensionSize - scaledDim.Y
 		dimensionSize = targetHeight
 	} else {
 		scaledWidth = scaledDim.X
 		scaledRatio = float64(targetWidth) / float64(scaledWidth)
-		extensionSize = targetWidth - scaledDim.X
 		gradientSize = dimensionSize - scaledDim.X
 		dimensionSize = targetWidth
 	}
@@ -494,25 +751,21 @@ func PrepareOutpaintImage(
 	background := image.NewNRGBA(
 		image.Rect(0, 0, targetWidth, targetHeight),
 	)
-	//shufflePixelsImage(background)
-	var overlaid *image.NRGBA
-	if conds.Direction() == DirectionCenter {
-		overlaid = imaging.OverlayCenter(background, resized, 1.0)
-	} else if conds.Direction().IsUpperOrLeft() {
-		overlaid = imaging.Overlay(background, resized,
-			image.Pt(0, 0), 1.0)
-	} else if conds.Direction().IsLowerOrRight() {
-		overlaid = imaging.Overlay(background, resized,
-			image.Pt(targetWidth-scaledDim.X,
-				targetHeight-scaledDim.Y), 1.0)
-	}
-	reflected, reflectErr := ReflectImageEdges(
-		overlaid,
-		resized,
-		conds,
-		outpaintNoise,
-		outpaintBlurEdge,
-	)
+	placement := geometry.Placement
+	overlaid := imaging.Overlay(background, resized, placement.Min, 1.0)
+	filler := opts.Filler
+	if filler == nil {
+		filler = ReflectFiller{}
+	}
+	reflected, reflectErr := filler.Fill(&OutpaintFillContext{
+		Canvas:    overlaid,
+		Source:    resized,
+		Placement: placement,
+		Conds:     conds,
+		Shuffle:   outpaintNoise,
+		Blur:      outpaintBlurEdge,
+		Rand:      rng,
+	})
 	if reflectErr != nil {
 		return nil, nil, nil, format, nil,
 			reflectErr
@@ -521,33 +774,30 @@ func PrepareOutpaintImage(
 	// For the case of gaussian blur, we need to re-layer the original image
 	// on. This is because the gaussian blur is applied to the entire image,
 	// and we don't want the main body of the image to be blurred or noised.
-	if opts.OutpaintBlurEdge > 0 {
-		var cropRectangle image.Rectangle
+	if opts.OutpaintNoise || opts.OutpaintBlurEdge > 0 {
+		inset := placement
 		if scaledVertical {
-			cropRectangle = image.Rectangle{
-				Min: image.Point{X: 0, Y: outpaintEdge},
-				Max: image.Point{X: scaledDim.X, Y: scaledDim.Y - outpaintEdge},
-			}
+			inset.Min.Y += outpaintEdge
+			inset.Max.Y -= outpaintEdge
 		} else {
-			cropRectangle = image.Rectangle{
-				Min: image.Point{X: outpaintEdge, Y: 0},
-				Max: image.Point{X: scaledDim.X - outpaintEdge, Y: scaledDim.Y},
-			}
+			inset.Min.X += outpaintEdge
+			inset.Max.X -= outpaintEdge
 		}
-		overlaid = imaging.OverlayCenter(overlaid, imaging.Crop(resized,
-			cropRectangle), 1.0)
+		reflected = relayerSource(reflected, resized, placement, inset)
 	}
 
-	// Create our gradient mask.
+	// Create our gradient mask. The feather runs from the source's edge into
+	// the source, and the mask keeps the source beyond it.
+	feather := geometry.Feather
 	mask := imaging.New(targetWidth, targetHeight,
-		color.Gray16{Y: opts.MaskBackground})
+		color.Gray16{Y: maskValue(1, opts.MaskBackground, opts.MaskInvert)})
 
 	// Determine the dimensions of our gradient image.
 	var gradientDim image.Rectangle
 	if conds.Direction() == DirectionCenter {
 		gradientSize = gradientSize / 2
 	}
-	gradientSize = gradientSize + outpaintEdge
+	gradientSize = gradientSize + feather
 	gradientDomain := float64(gradientSize)
 	if scaledVertical {
 		gradientDim = image.Rectangle{
@@ -559,22 +809,12 @@ func PrepareOutpaintImage(
 			Max: image.Point{X: gradientSize, Y: targetHeight}}
 	}
 
-	extDomain := float64(extensionSize) / gradientDomain
-	outpaintDomain := float64(outpaintEdge) / gradientDomain
-
-	r, g, b, a := color.Gray16{Y: opts.MaskBackground}.RGBA()
-	r2, g2, b2, a2 := color.Gray16{Y: 128}.RGBA()
-
-	outpaintGradients, _ := colorgrad.NewGradient().
-		Colors(
-			csscolorparser.Color{R: float64(r), G: float64(g), B: float64(b), A: float64(a)},
-			csscolorparser.Color{R: float64(r2), G: float64(g2), B: float64(b2), A: float64(a2)},
-			csscolorparser.Color{R: 0, G: 0, B: 0, A: 0},
-		).Domain(
-		0,
-		outpaintDomain,
-		extDomain,
-	).Interpolation(colorgrad.InterpolationLinear).Build()
+	outpaintGradients, gradientErr := maskGradient(opts.MaskFalloff,
+		opts.MaskBackground, opts.MaskInvert,
+		float64(feather)/gradientDomain)
+	if gradientErr != nil {
+		return nil, nil, srcDim, format, nil, gradientErr
+	}
 
 	var gradientDirection Direction
 	if conds.Direction() == DirectionCenter {
@@ -635,5 +875,5 @@ func PrepareOutpaintImage(
 	// Return the image and mask along with the original dimensions and
 	// format.
 	return coerced, masked, srcDim, format, &image.Point{X: targetWidth,
-		Y: targetHeight}, readErr
+		Y: targetHeight}, nil
 }
@@ -0,0 +1,258 @@
+package stability_image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+var (
+	ErrNoGeometry       = errors.New("no outpaint geometry")
+	ErrGeometryMismatch = errors.New("image does not match outpaint geometry")
+)
+
+// geometryAspectTolerance is how far, relative to the target's aspect ratio,
+// a generated image's aspect ratio may be off and still be composited.
+const geometryAspectTolerance = 0.01
+
+// OutpaintGeometry describes how PrepareOutpaintImage laid a source out on
+// its target canvas, so that the generated image can be mapped back onto
+// the source.
+type OutpaintGeometry struct {
+	// Source is the size of the original source image.
+	Source image.Point `json:"source"`
+	// Target is the size of the prepared canvas.
+	Target image.Point `json:"target"`
+	// Placement is where the scaled source sits on the canvas.
+	Placement image.Rectangle `json:"placement"`
+	// Anchor is the direction the source was anchored in, after it was
+	// corrected for the scaled axis.
+	Anchor Direction `json:"anchor"`
+	// Feather is the width in canvas pixels of the mask's ramp along the
+	// exposed edges of the placement.
+	Feather int `json:"feather"`
+	// Falloff is the shape of the mask's ramp.
+	Falloff MaskFalloff `json:"falloff"`
+}
+
+// fitLength returns the length a side of `length` is scaled to when its
+// other side of `other` is scaled to `fitted`, rounding as imaging.Resize
+// does when preserving the aspect ratio.
+func fitLength(fitted int, length int, other int) int {
+	return int(math.Max(1, math.Floor(
+		float64(fitted)*float64(length)/float64(other)+0.5)))
+}
+
+// NewOutpaintGeometry returns the geometry PrepareOutpaintImage lays a
+// source of `srcDim` out with on a canvas of `targetWidth` by
+// `targetHeight`, given `opts`. It only computes the layout, so it is cheap
+// enough to call ahead of preparation.
+func NewOutpaintGeometry(
+	srcDim image.Point,
+	targetWidth int,
+	targetHeight int,
+	opts *OutpaintImageOpts,
+) (*OutpaintGeometry, error) {
+	if opts == nil {
+		opts = NewOutpaintImageOpts()
+	}
+	if srcDim.X <= 0 || srcDim.Y <= 0 || targetWidth <= 0 ||
+		targetHeight <= 0 {
+		return nil, fmt.Errorf("cannot outpaint %v onto %vx%v", srcDim,
+			targetWidth, targetHeight)
+	}
+	targetDim := image.Point{X: targetWidth, Y: targetHeight}
+	geometry := &OutpaintGeometry{
+		Source:    srcDim,
+		Target:    targetDim,
+		Placement: image.Rectangle{Max: targetDim},
+		Anchor:    DirectionCenter,
+		Falloff:   opts.MaskFalloff,
+	}
+	feather := opts.OutpaintOffset
+	if opts.MaskFeather > 0 {
+		feather = opts.MaskFeather
+	}
+
+	// Zooming out and offsets place the source on the canvas, feathering
+	// every exposed edge.
+	placed := func(placement image.Rectangle) *OutpaintGeometry {
+		conds := CondNone
+		conds.FromPlacement(targetDim, placement)
+		geometry.Placement = placement
+		geometry.Anchor = conds.Direction()
+		geometry.Feather = feather
+		return geometry
+	}
+	if opts.ZoomOut > 0 {
+		if opts.ZoomOut > 1 {
+			return nil, fmt.Errorf("zoom out factor %v is larger than 1",
+				opts.ZoomOut)
+		}
+		placement := ZoomPlacement(srcDim, targetDim, opts.ZoomOut,
+			opts.AnchorDirection)
+		if opts.AnchorOffset != nil {
+			placement = OffsetPlacement(placement.Size(), targetDim,
+				*opts.AnchorOffset)
+		}
+		return placed(placement), nil
+	}
+	if srcDim == targetDim {
+		return geometry, nil
+	}
+
+	// Otherwise the source fills one axis of the canvas and is extended
+	// along the other.
+	conds := OutpaintCondition(0)
+	conds.FromPoints(srcDim, targetDim)
+	conds.SetDirection(opts.AnchorDirection)
+	var scaledDim image.Point
+	if conds.IsVerticalScale() {
+		scaledDim = image.Point{X: targetWidth,
+			Y: fitLength(targetWidth, srcDim.Y, srcDim.X)}
+		conds.SetDirection(conds.Direction().Vertical())
+	} else {
+		scaledDim = image.Point{X: fitLength(targetHeight, srcDim.X,
+			srcDim.Y), Y: targetHeight}
+		conds.SetDirection(conds.Direction().Horizontal())
+	}
+	if scaledDim == targetDim {
+		return geometry, nil
+	}
+	if opts.AnchorOffset != nil {
+		return placed(OffsetPlacement(scaledDim, targetDim,
+			*opts.AnchorOffset)), nil
+	}
+
+	// The feather defaults to OutpaintOffset scaled by how much the canvas
+	// extends the source, and fits within the source.
+	var scaledRatio float64
+	var featherLimit int
+	if conds.IsVerticalScale() {
+		scaledRatio = float64(targetHeight) / float64(scaledDim.Y)
+		featherLimit = scaledDim.Y
+	} else {
+		scaledRatio = float64(targetWidth) / float64(scaledDim.X)
+		featherLimit = scaledDim.X
+	}
+	if opts.MaskFeather <= 0 {
+		feather = int(float64(opts.OutpaintOffset) * scaledRatio)
+	}
+	if conds.Direction() == DirectionCenter {
+		featherLimit /= 2
+	}
+	geometry.Placement = AnchorPlacement(scaledDim, targetDim,
+		conds.Direction())
+	geometry.Anchor = conds.Direction()
+	geometry.Feather = max(1, min(feather, featherLimit))
+	return geometry, nil
+}
+
+// CompositeOutpaint maps `generated`, the result of outpainting the images
+// prepared with `geometry`, back onto `source`. The generated image is
+// scaled to the source's scale, the source is restored where the mask kept
+// it, and the two are blended across the mask's feather.
+func CompositeOutpaint(
+	source image.Image,
+	generated image.Image,
+	geometry *OutpaintGeometry,
+) (*image.NRGBA, error) {
+	if geometry == nil {
+		return nil, ErrNoGeometry
+	}
+	if size := source.Bounds().Size(); size != geometry.Source {
+		return nil, fmt.Errorf("%w: source is %v, not %v",
+			ErrGeometryMismatch, size, geometry.Source)
+	}
+	generatedDim := generated.Bounds().Size()
+	targetAspect := float64(geometry.Target.X) / float64(geometry.Target.Y)
+	if generatedDim.X <= 0 || generatedDim.Y <= 0 ||
+		math.Abs(float64(generatedDim.X)/float64(generatedDim.Y)-
+			targetAspect) > geometryAspectTolerance*targetAspect {
+		return nil, fmt.Errorf("%w: generated image is %v, not the aspect "+
+			"ratio of %v", ErrGeometryMismatch, generatedDim, geometry.Target)
+	}
+
+	// Scale the canvas so that the placement matches the source pixel for
+	// pixel.
+	scaleX := float64(geometry.Source.X) / float64(geometry.Placement.Dx())
+	scaleY := float64(geometry.Source.Y) / float64(geometry.Placement.Dy())
+	size := image.Point{
+		X: max(geometry.Source.X,
+			int(math.Round(float64(geometry.Target.X)*scaleX))),
+		Y: max(geometry.Source.Y,
+			int(math.Round(float64(geometry.Target.Y)*scaleY))),
+	}
+	origin := image.Point{
+		X: max(0, min(size.X-geometry.Source.X,
+			int(math.Round(float64(geometry.Placement.Min.X)*scaleX)))),
+		Y: max(0, min(size.Y-geometry.Source.Y,
+			int(math.Round(float64(geometry.Placement.Min.Y)*scaleY)))),
+	}
+	placement := image.Rectangle{Min: origin,
+		Max: origin.Add(geometry.Source)}
+	feather := int(math.Round(float64(geometry.Feather) *
+		(scaleX + scaleY) / 2))
+
+	canvas := imaging.Resize(generated, size.X, size.Y, imaging.Lanczos)
+	original := imaging.Clone(source)
+	weights := CreatePlacementMask(size, placement, feather, 0xffff,
+		geometry.Falloff, false)
+	blendWeighted(canvas, original, origin, weights, placement)
+	return canvas, nil
+}
+
+// blendWeighted blends `keep`, whose origin sits at `keepOrigin` on `dst`,
+// into `dst` within `rect` by `weights`: where a weight is 0xffff `keep` is
+// kept, and where it is 0 `dst` is.
+func blendWeighted(
+	dst *image.NRGBA,
+	keep *image.NRGBA,
+	keepOrigin image.Point,
+	weights *image.Gray16,
+	rect image.Rectangle,
+) {
+	parallelRows(rect.Min.Y, rect.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				offset := weights.PixOffset(x, y)
+				weight := uint32(weights.Pix[offset])<<8 |
+					uint32(weights.Pix[offset+1])
+				to := dst.Pix[dst.PixOffset(x, y):][:4]
+				from := keep.Pix[keep.PixOffset(x-keepOrigin.X,
+					y-keepOrigin.Y):][:4]
+				for c := range to {
+					to[c] = uint8((uint32(from[c])*weight +
+						uint32(to[c])*(0xffff-weight) + 0x7fff) / 0xffff)
+				}
+			}
+		}
+	})
+}
+
+// CompositeOutpaintResult decodes the original `src` and the `generated`
+// outpainting of the images prepared with `geometry`, and composites them
+// with CompositeOutpaint into a PNG at the source's scale.
+func CompositeOutpaintResult(
+	src *[]byte,
+	generated *[]byte,
+	geometry *OutpaintGeometry,
+) (*[]byte, error) {
+	source, _, _, err := DecodeImage(src)
+	if err != nil {
+		return nil, err
+	}
+	generatedImage, _, _, err := DecodeImage(generated)
+	if err != nil {
+		return nil, err
+	}
+	composited, err := CompositeOutpaint(source, generatedImage, geometry)
+	if err != nil {
+		return nil, err
+	}
+	return EncodePng(composited, png.BestSpeed)
+}
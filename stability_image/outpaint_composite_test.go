@@ -0,0 +1,203 @@
+package stability_image
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestNewOutpaintGeometryMatchesPreparation(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, _, srcDim, err := DecodeImage(&imageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		width, height int
+		configure     func(opts *OutpaintImageOpts)
+	}{
+		{768, 512, func(opts *OutpaintImageOpts) {}},
+		{768, 512, func(opts *OutpaintImageOpts) {
+			opts.AnchorDirection = DirectionUpLeft
+		}},
+		{512, 768, func(opts *OutpaintImageOpts) {
+			opts.AnchorDirection = DirectionDown
+			opts.MaskFeather = 20
+		}},
+		{768, 512, func(opts *OutpaintImageOpts) {
+			opts.AnchorOffset = &image.Point{X: 40}
+		}},
+		{768, 512, func(opts *OutpaintImageOpts) {
+			opts.ZoomOut = 0.5
+			opts.AnchorDirection = DirectionDownRight
+		}},
+		{srcDim.X, srcDim.Y, func(opts *OutpaintImageOpts) {}},
+	} {
+		opts := NewOutpaintImageOpts()
+		opts.OutpaintNoise = false
+		test.configure(opts)
+		expected, geometryErr := NewOutpaintGeometry(*srcDim, test.width,
+			test.height, opts)
+		if geometryErr != nil {
+			t.Fatal(geometryErr)
+		}
+		coerced, _, _, _, _, prepareErr := PrepareOutpaintImage(&imageData,
+			test.width, test.height, opts)
+		if prepareErr != nil {
+			t.Fatal(prepareErr)
+		}
+		if !reflect.DeepEqual(opts.Geometry, expected) {
+			t.Error("prepared geometry", opts.Geometry, "is not", expected)
+			continue
+		}
+		// The prepared image holds the scaled source at its placement.
+		prepared, _, _, decodeErr := DecodeImage(coerced)
+		if decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+		scaled := imaging.Resize(source, expected.Placement.Dx(),
+			expected.Placement.Dy(), imaging.Lanczos)
+		center := expected.Placement.Min.Add(expected.Placement.Size().
+			Div(2))
+		if colorDistance(prepared.At(center.X, center.Y),
+			scaled.At(center.X-expected.Placement.Min.X,
+				center.Y-expected.Placement.Min.Y)) > 0 {
+			t.Error("source is not at", expected.Placement)
+		}
+	}
+}
+
+// colorDistance returns the largest difference between the 8-bit channels
+// of `a` and `b`.
+func colorDistance(a color.Color, b color.Color) int {
+	ca := color.NRGBAModel.Convert(a).(color.NRGBA)
+	cb := color.NRGBAModel.Convert(b).(color.NRGBA)
+	distance := 0
+	for _, pair := range [][2]uint8{{ca.R, cb.R}, {ca.G, cb.G},
+		{ca.B, cb.B}, {ca.A, cb.A}} {
+		distance = max(distance, abs(int(pair[0])-int(pair[1])))
+	}
+	return distance
+}
+
+func TestCompositeOutpaint(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, _, srcDim, err := DecodeImage(&imageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := NewOutpaintImageOpts()
+	_, _, _, _, _, err = PrepareOutpaintImage(&imageData, 384, 256, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	geometry := opts.Geometry
+
+	// Stand in for the generated image with a solid color, so that it is
+	// easy to tell apart from the source.
+	red := color.NRGBA{R: 255, A: 255}
+	generated := imaging.New(geometry.Target.X, geometry.Target.Y, red)
+	composited, err := CompositeOutpaint(source, generated, geometry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 576x512 source was prepared at half scale, so the result is
+	// twice the target's size, with the source in the middle.
+	if size := composited.Bounds().Size(); size !=
+		(image.Point{X: 768, Y: 512}) {
+		t.Fatal("unexpected composited size", size)
+	}
+	origin := image.Point{X: 96}
+	if colorDistance(composited.At(10, 100), red) > 1 ||
+		colorDistance(composited.At(757, 100), red) > 1 {
+		t.Error("generated borders were not kept")
+	}
+	for _, p := range []image.Point{{300, 100}, {96 + 200, 500},
+		{96 + 575 - 100, 0}} {
+		if colorDistance(composited.At(p.X, p.Y),
+			source.At(p.X-origin.X, p.Y-origin.Y)) > 0 {
+			t.Error("source was not restored at", p)
+		}
+	}
+	// Across the feather, the result blends from the generated image into
+	// the source.
+	feather := geometry.Feather * 2
+	edge := composited.NRGBAAt(origin.X, 256)
+	inner := composited.NRGBAAt(origin.X+feather-2, 256)
+	if edge.R < 240 || colorDistance(inner, source.At(feather-2, 256)) > 24 {
+		t.Error("feather does not blend from", edge, "to", inner)
+	}
+
+	if _, err = CompositeOutpaint(source, generated, nil); !errors.Is(err,
+		ErrNoGeometry) {
+		t.Error("missing geometry was not reported", err)
+	}
+	if _, err = CompositeOutpaint(imaging.Resize(source, 100, 0,
+		imaging.Box), generated, geometry); !errors.Is(err,
+		ErrGeometryMismatch) {
+		t.Error("wrong source size was not reported", err)
+	}
+	if _, err = CompositeOutpaint(source, imaging.New(256, 256, red),
+		geometry); !errors.Is(err, ErrGeometryMismatch) {
+		t.Error("wrong generated aspect was not reported", err)
+	}
+	if *srcDim != geometry.Source {
+		t.Error("geometry source is", geometry.Source)
+	}
+}
+
+func TestCompositeOutpaintResult(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := NewOutpaintImageOpts()
+	opts.ZoomOut = 0.5
+	coerced, _, _, _, _, err := PrepareOutpaintImage(&imageData, 512, 512,
+		opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generated image may come back at a higher resolution than the
+	// prepared one.
+	prepared, _, _, err := DecodeImage(coerced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := EncodePng(imaging.Resize(prepared, 1024, 1024,
+		imaging.Lanczos), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	composited, err := CompositeOutpaintResult(&imageData, generated,
+		opts.Geometry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _, resultDim, err := DecodeImage(composited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Zooming out by half puts the source at half the canvas' width.
+	if resultDim.X != 2*576 || result.Bounds().Dy() < 2*512 {
+		t.Error("unexpected composited size", resultDim)
+	}
+	os.MkdirAll(OutputDir, 0755)
+	err = ioutil.WriteFile(OutputDir+"/outpaint_composite.png", *composited,
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,501 @@
+package stability_image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/esimov/stackblur-go"
+)
+
+// ErrUnknownFiller is returned when looking up an outpaint filler that has
+// not been registered.
+var ErrUnknownFiller = errors.New("unknown outpaint filler")
+
+// OutpaintFillContext is what an OutpaintFiller fills the extended area of
+// an outpaint from.
+type OutpaintFillContext struct {
+	// Canvas is the target sized canvas, with Source already laid at
+	// Placement. The filler may modify it in place.
+	Canvas *image.NRGBA
+	// Source is the scaled source image.
+	Source *image.NRGBA
+	// Placement is where Source sits on Canvas.
+	Placement image.Rectangle
+	// Conds describes how the canvas extends the source.
+	Conds OutpaintCondition
+	// Shuffle requests the fill be shuffled to break up its structure.
+	Shuffle bool
+	// Blur is the radius the fill should be blurred by, if non-zero.
+	Blur uint32
+	// Rand is the source of any randomness used by the filler.
+	Rand *rand.Rand
+}
+
+// OutpaintFiller pre-fills the area of an outpaint canvas outside of the
+// source, which the mask then hands over to the model to replace.
+type OutpaintFiller interface {
+	// Name is the name the filler is registered under.
+	Name() string
+	// Fill returns the canvas of `ctx` with the area outside of its
+	// placement filled in. The area inside the placement is left as is,
+	// apart from any shuffling or blurring requested by `ctx`.
+	Fill(ctx *OutpaintFillContext) (*image.NRGBA, error)
+}
+
+var (
+	fillersMtx sync.RWMutex
+	fillers    = map[string]OutpaintFiller{}
+)
+
+// RegisterOutpaintFiller registers `filler` under its name, replacing any
+// filler that was previously registered with that name. Names are case
+// insensitive.
+func RegisterOutpaintFiller(filler OutpaintFiller) {
+	fillersMtx.Lock()
+	defer fillersMtx.Unlock()
+	fillers[strings.ToLower(filler.Name())] = filler
+}
+
+// LookupOutpaintFiller returns the filler registered under `name`.
+func LookupOutpaintFiller(name string) (OutpaintFiller, error) {
+	fillersMtx.RLock()
+	defer fillersMtx.RUnlock()
+	filler, ok := fillers[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFiller, name)
+	}
+	return filler, nil
+}
+
+// OutpaintFillerNames returns the names of the registered fillers, sorted.
+func OutpaintFillerNames() []string {
+	fillersMtx.RLock()
+	defer fillersMtx.RUnlock()
+	names := make([]string, 0, len(fillers))
+	for name := range fillers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	for _, filler := range []OutpaintFiller{
+		ReflectFiller{},
+		StretchFiller{},
+		MirrorTileFiller{},
+		MeanColorFiller{},
+		BlurredExtendFiller{},
+		PerlinFiller{},
+	} {
+		RegisterOutpaintFiller(filler)
+	}
+}
+
+// finishFill applies the shuffling and blurring requested by `ctx` to the
+// whole of `filled`.
+func finishFill(
+	ctx *OutpaintFillContext,
+	filled *image.NRGBA,
+) (*image.NRGBA, error) {
+	if ctx.Shuffle {
+		ShufflePixelsImageWithRand(filled, filled.Bounds(), ctx.Rand)
+	}
+	if ctx.Blur > 0 {
+		return stackblur.Process(filled, ctx.Blur)
+	}
+	return filled, nil
+}
+
+// fillOutside sets every pixel of `canvas` outside of `placement` to `col`.
+func fillOutside(
+	canvas *image.NRGBA,
+	placement image.Rectangle,
+	col color.NRGBA,
+) {
+	bounds := canvas.Bounds()
+	pixel := []byte{col.R, col.G, col.B, col.A}
+	parallelRows(bounds.Min.Y, bounds.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if (image.Point{X: x, Y: y}).In(placement) {
+					x = placement.Max.X - 1
+					continue
+				}
+				copy(canvas.Pix[canvas.PixOffset(x, y):][:4], pixel)
+			}
+		}
+	})
+}
+
+// clampCoord maps `v` into [lo, hi) by clamping it to the nearest edge.
+func clampCoord(v int, lo int, hi int) int {
+	return max(lo, min(v, hi-1))
+}
+
+// ReflectFiller mirrors the source once across each edge it is extended
+// from, as PrepareOutpaintImage has always done. When the canvas extends
+// both axes, the source is not anchored by the condition's direction, or a
+// single reflection would not reach the canvas' edges, the source is
+// mirror-tiled instead.
+type ReflectFiller struct{}
+
+func (ReflectFiller) Name() string { return "reflect" }
+
+func (ReflectFiller) Fill(ctx *OutpaintFillContext) (*image.NRGBA, error) {
+	sourceDim := ctx.Source.Bounds().Size()
+	anchored := AnchorPlacement(sourceDim, ctx.Canvas.Bounds().Size(),
+		ctx.Conds.Direction())
+	reflected := image.Rectangle{
+		Min: ctx.Placement.Min.Sub(sourceDim),
+		Max: ctx.Placement.Max.Add(sourceDim),
+	}
+	if !ctx.Conds.IsBothAxes() && ctx.Placement == anchored &&
+		ctx.Canvas.Bounds().In(reflected) {
+		return ReflectImageEdgesWithRand(ctx.Canvas, ctx.Source, ctx.Conds,
+			ctx.Shuffle, ctx.Blur, ctx.Rand)
+	}
+	return MirrorTileFiller{}.Fill(ctx)
+}
+
+// StretchFiller repeats the source's edge pixels outwards, and its corner
+// pixels into the corners.
+type StretchFiller struct{}
+
+func (StretchFiller) Name() string { return "stretch" }
+
+func (StretchFiller) Fill(ctx *OutpaintFillContext) (*image.NRGBA, error) {
+	remapOutside(ctx.Canvas, ctx.Placement, clampCoord)
+	return finishFill(ctx, ctx.Canvas)
+}
+
+// MirrorTileFiller tiles the canvas with alternately mirrored copies of the
+// source, however far it extends.
+type MirrorTileFiller struct{}
+
+func (MirrorTileFiller) Name() string { return "mirror-tile" }
+
+func (MirrorTileFiller) Fill(ctx *OutpaintFillContext) (*image.NRGBA, error) {
+	ReflectImageEdgesAt(ctx.Canvas, ctx.Placement)
+	return finishFill(ctx, ctx.Canvas)
+}
+
+// MeanColor returns the mean color of `img`, weighting each pixel by its
+// alpha. The result is opaque, or transparent if `img` is.
+func MeanColor(img *image.NRGBA) color.NRGBA {
+	bounds := img.Bounds()
+	var r, g, b, a uint64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+		for idx := 0; idx < len(row); idx += 4 {
+			alpha := uint64(row[idx+3])
+			r += uint64(row[idx]) * alpha
+			g += uint64(row[idx+1]) * alpha
+			b += uint64(row[idx+2]) * alpha
+			a += alpha
+		}
+	}
+	if a == 0 {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{
+		R: uint8((r + a/2) / a),
+		G: uint8((g + a/2) / a),
+		B: uint8((b + a/2) / a),
+		A: 255,
+	}
+}
+
+// MeanColorFiller fills the extended area with the source's mean color.
+type MeanColorFiller struct{}
+
+func (MeanColorFiller) Name() string { return "mean-color" }
+
+func (MeanColorFiller) Fill(ctx *OutpaintFillContext) (*image.NRGBA, error) {
+	fillOutside(ctx.Canvas, ctx.Placement, MeanColor(ctx.Source))
+	return finishFill(ctx, ctx.Canvas)
+}
+
+// DefaultBlurredExtendRadius is the blur radius BlurredExtendFiller uses
+// when its own is zero.
+const DefaultBlurredExtendRadius = 48
+
+// BlurredExtendFiller stretches the source's edges outwards and blurs the
+// result heavily, giving soft color continuations of the source without any
+// of its structure.
+type BlurredExtendFiller struct {
+	Radius uint32
+}
+
+func (BlurredExtendFiller) Name() string { return "blurred-extend" }
+
+func (f BlurredExtendFiller) Fill(
+	ctx *OutpaintFillContext,
+) (*image.NRGBA, error) {
+	radius := f.Radius
+	if radius == 0 {
+		radius = DefaultBlurredExtendRadius
+	}
+	remapOutside(ctx.Canvas, ctx.Placement, clampCoord)
+	blurred, blurErr := stackblur.Process(ctx.Canvas, radius)
+	if blurErr != nil {
+		return nil, blurErr
+	}
+	// Only the extended area keeps the blur.
+	blurred = imaging.Paste(blurred, imaging.Crop(ctx.Canvas,
+		ctx.Placement), ctx.Placement.Min)
+	return finishFill(ctx, blurred)
+}
+
+// Defaults for the PerlinFiller fields left at zero.
+const (
+	DefaultPerlinScale   = 64.0
+	DefaultPerlinOctaves = 4
+)
+
+// PerlinFiller fills the extended area with fractal Perlin noise whose color
+// mean and covariance match those of the source, so the noise keeps the
+// source's palette.
+type PerlinFiller struct {
+	// Scale is the size of the noise's largest features, in pixels.
+	Scale float64
+	// Octaves is the number of noise layers summed, each at half the
+	// scale and amplitude of the last.
+	Octaves int
+}
+
+func (PerlinFiller) Name() string { return "perlin" }
+
+// perlinNoise is Ken Perlin's improved gradient noise, in two dimensions.
+type perlinNoise struct {
+	perm [512]int
+}
+
+func newPerlinNoise(intn func(int) int) *perlinNoise {
+	p := &perlinNoise{}
+	for idx := 0; idx < 256; idx++ {
+		p.perm[idx] = idx
+	}
+	for idx := 255; idx > 0; idx-- {
+		swap := intn(idx + 1)
+		p.perm[idx], p.perm[swap] = p.perm[swap], p.perm[idx]
+	}
+	for idx := 0; idx < 256; idx++ {
+		p.perm[256+idx] = p.perm[idx]
+	}
+	return p
+}
+
+func perlinFade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+func perlinGrad(hash int, x float64, y float64) float64 {
+	switch hash & 7 {
+	case 0:
+		return x + y
+	case 1:
+		return -x + y
+	case 2:
+		return x - y
+	case 3:
+		return -x - y
+	case 4:
+		return x
+	case 5:
+		return -x
+	case 6:
+		return y
+	}
+	return -y
+}
+
+func (p *perlinNoise) at(x float64, y float64) float64 {
+	fx, fy := math.Floor(x), math.Floor(y)
+	xi, yi := int(fx)&255, int(fy)&255
+	x, y = x-fx, y-fy
+	u, v := perlinFade(x), perlinFade(y)
+	aa := p.perm[p.perm[xi]+yi]
+	ab := p.perm[p.perm[xi]+yi+1]
+	ba := p.perm[p.perm[xi+1]+yi]
+	bb := p.perm[p.perm[xi+1]+yi+1]
+	lerp := func(t float64, a float64, b float64) float64 {
+		return a + t*(b-a)
+	}
+	return lerp(v,
+		lerp(u, perlinGrad(aa, x, y), perlinGrad(ba, x-1, y)),
+		lerp(u, perlinGrad(ab, x, y-1), perlinGrad(bb, x-1, y-1)))
+}
+
+// fractal sums `octaves` layers of noise at `(x, y)`.
+func (p *perlinNoise) fractal(
+	x float64,
+	y float64,
+	octaves int,
+) float64 {
+	sum, amplitude := 0.0, 1.0
+	for octave := 0; octave < octaves; octave++ {
+		sum += amplitude * p.at(x, y)
+		x, y, amplitude = x*2, y*2, amplitude/2
+	}
+	return sum
+}
+
+// colorStats returns the alpha-weighted mean and covariance of the color
+// channels of `img`.
+func colorStats(img *image.NRGBA) (mean [3]float64, cov [3][3]float64) {
+	bounds := img.Bounds()
+	var sum [3]float64
+	var sumProd [3][3]float64
+	weight := 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):][:bounds.Dx()*4]
+		for idx := 0; idx < len(row); idx += 4 {
+			alpha := float64(row[idx+3]) / 255
+			for c := 0; c < 3; c++ {
+				v := float64(row[idx+c])
+				sum[c] += v * alpha
+				for d := 0; d <= c; d++ {
+					sumProd[c][d] += v * float64(row[idx+d]) * alpha
+				}
+			}
+			weight += alpha
+		}
+	}
+	if weight == 0 {
+		return mean, cov
+	}
+	for c := 0; c < 3; c++ {
+		mean[c] = sum[c] / weight
+	}
+	for c := 0; c < 3; c++ {
+		for d := 0; d <= c; d++ {
+			cov[c][d] = sumProd[c][d]/weight - mean[c]*mean[d]
+			cov[d][c] = cov[c][d]
+		}
+	}
+	return mean, cov
+}
+
+// cholesky returns the lower triangular `l` with `l * lᵀ = m`, for a
+// covariance matrix `m`. Directions without variance are left at zero.
+func cholesky(m [3][3]float64) (l [3][3]float64) {
+	for i := 0; i < 3; i++ {
+		for j := 0; j <= i; j++ {
+			sum := m[i][j]
+			for k := 0; k < j; k++ {
+				sum -= l[i][k] * l[j][k]
+			}
+			if i == j {
+				l[i][j] = math.Sqrt(math.Max(0, sum))
+			} else if l[j][j] > 0 {
+				l[i][j] = sum / l[j][j]
+			}
+		}
+	}
+	return l
+}
+
+func (f PerlinFiller) Fill(ctx *OutpaintFillContext) (*image.NRGBA, error) {
+	scale, octaves := f.Scale, f.Octaves
+	if scale <= 0 {
+		scale = DefaultPerlinScale
+	}
+	if octaves <= 0 {
+		octaves = DefaultPerlinOctaves
+	}
+	intn := randIntn(ctx.Rand)
+	// Three independent fields are normalized and then correlated by the
+	// Cholesky factor of the source's color covariance.
+	fields := [3]*perlinNoise{}
+	for idx := range fields {
+		fields[idx] = newPerlinNoise(intn)
+	}
+	mean, cov := colorStats(ctx.Source)
+	factor := cholesky(cov)
+
+	canvas := ctx.Canvas
+	bounds := canvas.Bounds()
+	values := make([][3]float32, bounds.Dx()*bounds.Dy())
+	exposed := func(x int, y int) bool {
+		return !(image.Point{X: x, Y: y}).In(ctx.Placement)
+	}
+	parallelRows(bounds.Min.Y, bounds.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if !exposed(x, y) {
+					continue
+				}
+				idx := (y-bounds.Min.Y)*bounds.Dx() + x - bounds.Min.X
+				for field, noise := range fields {
+					values[idx][field] = float32(noise.fractal(
+						float64(x)/scale, float64(y)/scale, octaves))
+				}
+			}
+		}
+	})
+
+	// Normalize each field over the exposed area to zero mean and unit
+	// variance.
+	var fieldMean, fieldStddev [3]float64
+	count := 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if !exposed(x, y) {
+				continue
+			}
+			idx := (y-bounds.Min.Y)*bounds.Dx() + x - bounds.Min.X
+			for field := range fields {
+				v := float64(values[idx][field])
+				fieldMean[field] += v
+				fieldStddev[field] += v * v
+			}
+			count++
+		}
+	}
+	if count == 0 {
+		return finishFill(ctx, canvas)
+	}
+	for field := range fields {
+		fieldMean[field] /= count
+		fieldStddev[field] = math.Sqrt(math.Max(0,
+			fieldStddev[field]/count-fieldMean[field]*fieldMean[field]))
+		if fieldStddev[field] == 0 {
+			fieldStddev[field] = 1
+		}
+	}
+
+	parallelRows(bounds.Min.Y, bounds.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if !exposed(x, y) {
+					continue
+				}
+				idx := (y-bounds.Min.Y)*bounds.Dx() + x - bounds.Min.X
+				normalized := [3]float64{}
+				for field := range fields {
+					normalized[field] = (float64(values[idx][field]) -
+						fieldMean[field]) / fieldStddev[field]
+				}
+				pix := canvas.Pix[canvas.PixOffset(x, y):][:4]
+				for c := 0; c < 3; c++ {
+					v := mean[c]
+					for k := 0; k <= c; k++ {
+						v += factor[c][k] * normalized[k]
+					}
+					pix[c] = uint8(math.Round(math.Max(0, math.Min(255, v))))
+				}
+				pix[3] = 255
+			}
+		}
+	})
+	return finishFill(ctx, canvas)
+}
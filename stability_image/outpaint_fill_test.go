@@ -0,0 +1,170 @@
+package stability_image
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestOutpaintFillers(t *testing.T) {
+	os.MkdirAll(OutputDir, 0755)
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range OutpaintFillerNames() {
+		filler, lookupErr := LookupOutpaintFiller(name)
+		if lookupErr != nil {
+			t.Fatal(lookupErr)
+		}
+		// PatchMatch is slow enough to be checked at a smaller size.
+		size := image.Point{X: 768, Y: 512}
+		if name == "patchmatch" {
+			size = image.Point{X: 384, Y: 256}
+		}
+		for _, zoom := range []float64{0, 0.5} {
+			opts := NewOutpaintImageOpts()
+			opts.OutpaintNoise = false
+			opts.OutpaintBlurEdge = 0
+			opts.ZoomOut = zoom
+			opts.Seed = 1
+			opts.Filler = filler
+			outpaintImage, _, _, _, _, prepareErr := PrepareOutpaintImage(
+				&imageData, size.X, size.Y, opts)
+			if prepareErr != nil {
+				t.Fatal(name, prepareErr)
+			}
+			img, _, _, decodeErr := DecodeImage(outpaintImage)
+			if decodeErr != nil {
+				t.Fatal(name, decodeErr)
+			}
+			if img.Bounds().Size() != size {
+				t.Error(name, "unexpected size", img.Bounds())
+			}
+			// Every corner is outside of the source, and must be filled.
+			for _, corner := range []image.Point{{0, 0}, {size.X - 1, 0},
+				{0, size.Y - 1}, {size.X - 1, size.Y - 1}} {
+				if _, _, _, a := img.At(corner.X, corner.Y).RGBA(); a == 0 {
+					t.Error(name, "did not fill", corner, "at zoom", zoom)
+				}
+			}
+			replayed, _, _, _, _, _ := PrepareOutpaintImage(&imageData,
+				size.X, size.Y, opts)
+			if !bytes.Equal(*outpaintImage, *replayed) {
+				t.Error(name, "is not deterministic for a seed")
+			}
+			if zoom == 0 {
+				ioutil.WriteFile(OutputDir+"/fill_"+name+".png",
+					*outpaintImage, os.ModePerm)
+			}
+		}
+	}
+	if _, lookupErr := LookupOutpaintFiller("nope"); !errors.Is(lookupErr,
+		ErrUnknownFiller) {
+		t.Error("unexpected lookup error", lookupErr)
+	}
+}
+
+func TestStretchAndMeanColorFillers(t *testing.T) {
+	source := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for idx := range source.Pix {
+		source.Pix[idx] = uint8(idx * 4)
+	}
+	for idx := 3; idx < len(source.Pix); idx += 4 {
+		source.Pix[idx] = 255
+	}
+	placement := image.Rect(2, 2, 6, 6)
+	newCtx := func() *OutpaintFillContext {
+		canvas := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+		for y := 0; y < 4; y++ {
+			copy(canvas.Pix[canvas.PixOffset(2, y+2):][:16],
+				source.Pix[source.PixOffset(0, y):][:16])
+		}
+		ctx := &OutpaintFillContext{
+			Canvas:    canvas,
+			Source:    source,
+			Placement: placement,
+		}
+		ctx.Conds.FromPlacement(image.Point{X: 8, Y: 8}, placement)
+		return ctx
+	}
+
+	stretched, err := StretchFiller{}.Fill(newCtx())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stretched.NRGBAAt(0, 0) != source.NRGBAAt(0, 0) ||
+		stretched.NRGBAAt(7, 3) != source.NRGBAAt(3, 1) {
+		t.Error("edges were not stretched")
+	}
+
+	meaned, err := MeanColorFiller{}.Fill(newCtx())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meaned.NRGBAAt(0, 7) != MeanColor(source) {
+		t.Error("unexpected fill", meaned.NRGBAAt(0, 7), MeanColor(source))
+	}
+	if meaned.NRGBAAt(3, 3) != source.NRGBAAt(1, 1) {
+		t.Error("the source was overwritten")
+	}
+}
+
+func TestPerlinFillerMatchesStatistics(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, _, err := DecodeImage(&imageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := image.NewNRGBA(img.Bounds())
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			source.Set(x, y, img.At(x, y))
+		}
+	}
+	size := source.Bounds().Size()
+	canvas := image.NewNRGBA(image.Rect(0, 0, size.X*3, size.Y))
+	placement := image.Rect(size.X, 0, size.X*2, size.Y)
+	ctx := &OutpaintFillContext{
+		Canvas:    canvas,
+		Source:    source,
+		Placement: placement,
+		Rand:      rand.New(rand.NewSource(1)),
+	}
+	filled, err := PerlinFiller{}.Fill(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMean, wantCov := colorStats(source)
+	gotMean, gotCov := colorStats(imaging.Crop(filled,
+		image.Rect(0, 0, size.X, size.Y)))
+	for c := 0; c < 3; c++ {
+		if math.Abs(gotMean[c]-wantMean[c]) > 16 {
+			t.Error("channel", c, "has mean", gotMean[c], "expected",
+				wantMean[c])
+		}
+		for d := 0; d < 3; d++ {
+			// Compare covariances as correlations and deviations.
+			want := wantCov[c][d] / math.Sqrt(wantCov[c][c]*wantCov[d][d])
+			got := gotCov[c][d] / math.Sqrt(gotCov[c][c]*gotCov[d][d])
+			if math.Abs(got-want) > 0.2 {
+				t.Error("channels", c, d, "have correlation", got,
+					"expected", want)
+			}
+		}
+		if math.Abs(math.Sqrt(gotCov[c][c])-math.Sqrt(wantCov[c][c])) > 16 {
+			t.Error("channel", c, "has deviation", math.Sqrt(gotCov[c][c]),
+				"expected", math.Sqrt(wantCov[c][c]))
+		}
+	}
+}
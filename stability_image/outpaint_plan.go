@@ -0,0 +1,149 @@
+package stability_image
+
+import (
+	"image"
+	"image/color"
+)
+
+// FillColorName is the OutpaintPlan.Filler of plans whose borders were
+// filled with OutpaintImageOpts.ZoomFillColor.
+const FillColorName = "color"
+
+// MaskStats summarizes an outpaint mask.
+type MaskStats struct {
+	// Generated is the number of pixels left entirely to generation.
+	Generated int `json:"generated"`
+	// Feathered is the number of pixels blending the source with the
+	// generation.
+	Feathered int `json:"feathered"`
+	// Kept is the number of pixels of the source kept as they are.
+	Kept int `json:"kept"`
+	// Coverage is the share of the canvas to generate, from 0 to 1, with
+	// feathered pixels counted by how much of them is generated.
+	Coverage float64 `json:"coverage"`
+}
+
+// NewMaskStats summarizes `mask`, an outpaint mask marking the source to
+// keep with `background` and the area to generate black, or the other way
+// around if `invert` is set. Levels are compared at 8 bits, as masks may be
+// encoded at either depth.
+func NewMaskStats(
+	mask image.Image,
+	background uint16,
+	invert bool,
+) *MaskStats {
+	generateLevel := int(maskValue(0, background, invert) >> 8)
+	keepLevel := int(maskValue(1, background, invert) >> 8)
+	stats := &MaskStats{}
+	bounds := mask.Bounds()
+	if bounds.Empty() || generateLevel == keepLevel {
+		return stats
+	}
+	span := float64(keepLevel - generateLevel)
+	var generated float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray := color.GrayModel.Convert(mask.At(x, y)).(color.Gray)
+			level := int(gray.Y)
+			switch level {
+			case generateLevel:
+				stats.Generated++
+			case keepLevel:
+				stats.Kept++
+			default:
+				stats.Feathered++
+			}
+			generated += max(0, min(1, float64(keepLevel-level)/span))
+		}
+	}
+	stats.Coverage = generated / float64(bounds.Dx()*bounds.Dy())
+	return stats
+}
+
+// OutpaintPlan is the result of preparing a source for outpainting: the
+// prepared images, along with how the source was laid out on the canvas and
+// how the canvas was filled and masked. Apart from the images, it is small
+// enough to log, and it serializes to JSON for compositing or auditing the
+// result later on.
+type OutpaintPlan struct {
+	// OutpaintGeometry is the layout of the source on the canvas, including
+	// its placement and anchor after auto-correction.
+	OutpaintGeometry
+	// Coerced is the prepared image, and Masked its mask. Masked is nil if
+	// the source fit the canvas without extending it.
+	Coerced *[]byte `json:"coerced,omitempty"`
+	Masked  *[]byte `json:"masked,omitempty"`
+	// Format is the format the source was decoded from, and Orientation
+	// the orientation it was stored in. The geometry is of the upright
+	// source.
+	Format      string      `json:"format"`
+	Orientation Orientation `json:"orientation"`
+	// Profile is the ICC profile embedded in the source, if any. The
+	// prepared images are in sRGB.
+	Profile *ICCProfile `json:"profile,omitempty"`
+	// Scale is the factor the source was scaled by to its placement.
+	Scale float64 `json:"scale"`
+	// Filler is the name of the fill strategy for the extended area, or
+	// FillColorName for a solid fill. It is empty if nothing was extended.
+	Filler string `json:"filler,omitempty"`
+	// Seed is the seed the preparation can be replayed with.
+	Seed int64 `json:"seed"`
+	// Mask summarizes Masked.
+	Mask *MaskStats `json:"mask,omitempty"`
+
+	srcDim    *image.Point
+	scaledDim *image.Point
+}
+
+// PlanOutpaint prepares `src` for outpainting onto a canvas of
+// `targetWidth` by `targetHeight` as PrepareOutpaintImage does, and returns
+// an OutpaintPlan of the prepared images. The plan is never nil, so that on
+// error it still holds what was determined before the failure.
+func PlanOutpaint(
+	src *[]byte,
+	targetWidth int,
+	targetHeight int,
+	opts *OutpaintImageOpts,
+) (*OutpaintPlan, error) {
+	if opts == nil {
+		opts = NewOutpaintImageOpts()
+	}
+	opts.Geometry = nil
+	plan := &OutpaintPlan{}
+	var err error
+	plan.Coerced, plan.Masked, plan.srcDim, plan.Format, plan.scaledDim,
+		err = prepareOutpaintImage(src, targetWidth, targetHeight, opts)
+	plan.Seed = opts.Seed
+	if src != nil {
+		plan.Orientation = ReadOrientation(*src)
+		plan.Profile, _ = ReadICCProfile(*src)
+	}
+	if opts.Geometry == nil {
+		return plan, err
+	}
+	plan.OutpaintGeometry = *opts.Geometry
+	plan.Scale = float64(plan.Placement.Dx()) / float64(plan.Source.X)
+	if err != nil {
+		return plan, err
+	}
+
+	if plan.Placement != (image.Rectangle{Max: plan.Target}) {
+		placed := opts.ZoomOut > 0 || opts.AnchorOffset != nil
+		switch {
+		case placed && opts.ZoomFillColor != nil:
+			plan.Filler = FillColorName
+		case opts.Filler != nil:
+			plan.Filler = opts.Filler.Name()
+		default:
+			plan.Filler = ReflectFiller{}.Name()
+		}
+	}
+	if plan.Masked != nil {
+		mask, _, _, decodeErr := DecodeImage(plan.Masked)
+		if decodeErr != nil {
+			return plan, decodeErr
+		}
+		plan.Mask = NewMaskStats(mask, opts.MaskBackground, opts.MaskInvert)
+	}
+	return plan, nil
+}
@@ -0,0 +1,155 @@
+package stability_image
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestPlanOutpaint(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The source can't be anchored up when it is extended sideways, so the
+	// anchor is corrected to the center.
+	opts := NewOutpaintImageOpts()
+	opts.AnchorDirection = DirectionUp
+	plan, err := PlanOutpaint(&imageData, 768, 512, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Anchor != DirectionCenter {
+		t.Error("anchor was not corrected", plan.Anchor)
+	}
+	if anchor, marshalErr := json.Marshal(plan.Anchor); marshalErr != nil ||
+		string(anchor) != `"center"` {
+		t.Error("anchor is serialized as", string(anchor), marshalErr)
+	}
+	if plan.Placement != image.Rect(96, 0, 672, 512) || plan.Scale != 1 {
+		t.Error("unexpected placement", plan.Placement, "at", plan.Scale)
+	}
+	if plan.Filler != "reflect" || plan.Format != "png" ||
+		plan.Seed != opts.Seed {
+		t.Error("unexpected plan", plan.Filler, plan.Format, plan.Seed)
+	}
+	stats := plan.Mask
+	if stats == nil {
+		t.Fatal("mask was not summarized")
+	}
+	// The extension is generated and the feather blends into the source,
+	// give or take a column where the ramp meets either end.
+	if stats.Generated < 192*512 || stats.Generated > 196*512 ||
+		stats.Feathered < 2*(plan.Feather-2)*512 ||
+		stats.Feathered > 2*plan.Feather*512 ||
+		stats.Generated+stats.Feathered+stats.Kept != 768*512 {
+		t.Error("unexpected mask statistics", *stats)
+	}
+	if generated := float64(stats.Generated) / (768 * 512); stats.Coverage <=
+		generated || stats.Coverage >= generated+
+		float64(stats.Feathered)/(768*512) {
+		t.Error("unexpected mask coverage", stats.Coverage)
+	}
+
+	// The plan holds the same images PrepareOutpaintImage returns.
+	replayOpts := NewOutpaintImageOpts()
+	replayOpts.AnchorDirection = DirectionUp
+	replayOpts.Seed = plan.Seed
+	coerced, masked, srcDim, _, _, err := PrepareOutpaintImage(&imageData,
+		768, 512, replayOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(*coerced, *plan.Coerced) ||
+		!bytes.Equal(*masked, *plan.Masked) || *srcDim != plan.Source {
+		t.Error("plan differs from the prepared images")
+	}
+
+	// Solid fills are recorded as such, along with corner anchors.
+	opts = NewOutpaintImageOpts()
+	opts.ZoomOut = 0.5
+	opts.AnchorDirection = DirectionDownRight
+	opts.ZoomFillColor = &color.NRGBA{A: 255}
+	plan, err = PlanOutpaint(&imageData, 768, 512, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Filler != FillColorName || plan.Anchor != DirectionDownRight ||
+		plan.Scale != 0.5 {
+		t.Error("unexpected zoomed plan", plan.Filler, plan.Anchor,
+			plan.Scale)
+	}
+
+	// A source that already fits is not extended or masked.
+	plan, err = PlanOutpaint(&imageData, 576, 512, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Masked != nil || plan.Mask != nil || plan.Filler != "" {
+		t.Error("unexpected plan for a fitting source", plan.Filler)
+	}
+
+	// Errors still report what was determined before the failure.
+	opts = NewOutpaintImageOpts()
+	opts.ZoomOut = 2
+	plan, err = PlanOutpaint(&imageData, 768, 512, opts)
+	if err == nil || plan == nil || plan.Format != "png" {
+		t.Error("unexpected failed plan", plan, err)
+	}
+}
+
+func TestOutpaintPlanJSON(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := NewOutpaintImageOpts()
+	opts.AnchorDirection = DirectionLeft
+	opts.MaskFalloff = MaskFalloff{Profile: MaskProfileCustom,
+		Stops: []MaskStop{{Position: 0.5, Weight: 0.25}}}
+	opts.Filler = PerlinFiller{}
+	plan, err := PlanOutpaint(&imageData, 768, 512, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan.Coerced, plan.Masked = nil, nil
+	encoded, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"anchor":"left"`, `"filler":"perlin"`,
+		`"profile":"custom"`, `"placement":{"Min":{"X":0,"Y":0}`,
+		`"mask":{"generated":`} {
+		if !bytes.Contains(encoded, []byte(field)) {
+			t.Error(field, "is missing from", string(encoded))
+		}
+	}
+	var decoded OutpaintPlan
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	plan.srcDim, plan.scaledDim = nil, nil
+	if !reflect.DeepEqual(&decoded, plan) {
+		t.Error("plan does not round trip:", decoded, "!=", *plan)
+	}
+
+	var direction Direction
+	if err = json.Unmarshal([]byte(`"bottom-left"`), &direction); err !=
+		nil || direction != DirectionDownLeft {
+		t.Error("direction alias was not decoded", direction, err)
+	}
+	if err = json.Unmarshal([]byte(`"sideways"`), &direction); !errors.Is(
+		err, ErrUnknownDirection) {
+		t.Error("unknown direction was not reported", err)
+	}
+	var profile MaskProfile
+	if err = json.Unmarshal([]byte(`"wobbly"`), &profile); !errors.Is(err,
+		ErrUnknownMaskProfile) {
+		t.Error("unknown mask profile was not reported", err)
+	}
+}
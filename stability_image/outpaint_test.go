@@ -0,0 +1,189 @@
+package stability_image
+
+import (
+	"bytes"
+	"image"
+	"io/ioutil"
+	"testing"
+)
+
+func TestPrepareOutpaintImageSeeded(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepare := func(opts *OutpaintImageOpts) []byte {
+		outpaintImage, _, _, _, _, prepareErr := PrepareOutpaintImage(
+			&imageData, 768, 512, opts)
+		if prepareErr != nil {
+			t.Fatal(prepareErr)
+		}
+		return *outpaintImage
+	}
+	opts := NewOutpaintImageOpts()
+	opts.OutpaintNoise = true
+	first := prepare(opts)
+	if opts.Seed == 0 {
+		t.Fatal("the chosen seed was not recorded")
+	}
+	replayOpts := NewOutpaintImageOpts()
+	replayOpts.OutpaintNoise = true
+	replayOpts.Seed = opts.Seed
+	if !bytes.Equal(first, prepare(replayOpts)) {
+		t.Error("replaying with the recorded seed gave a different image")
+	}
+	otherOpts := NewOutpaintImageOpts()
+	otherOpts.OutpaintNoise = true
+	otherOpts.Seed = opts.Seed + 1
+	if bytes.Equal(first, prepare(otherOpts)) {
+		t.Error("a different seed gave the same image")
+	}
+}
+
+func TestPrepareOutpaintImageZoomOut(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := NewOutpaintImageOpts()
+	opts.ZoomOut = 0.5
+	outpaintImage, outpaintMask, _, _, scaledDim, err := PrepareOutpaintImage(
+		&imageData, 768, 512, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scaledDim.X != 768 || scaledDim.Y != 512 {
+		t.Error("unexpected dimensions", scaledDim)
+	}
+	if _, _, _, err = DecodeImage(outpaintImage); err != nil {
+		t.Error(err)
+	}
+	mask, _, _, err := DecodeImage(outpaintMask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 256x256 source sits in the center, so every border and corner is
+	// generated, and the mask ramps up towards the source's center, which is
+	// kept like the rest of the outpainting masks.
+	gray := func(x, y int) uint32 {
+		v, _, _, _ := mask.At(x, y).RGBA()
+		return v
+	}
+	for _, corner := range [][2]int{{0, 0}, {767, 0}, {0, 511}, {767, 511},
+		{383, 0}, {0, 255}} {
+		if gray(corner[0], corner[1]) != 0 {
+			t.Error("border is not generated at", corner)
+		}
+	}
+	if gray(384, 256) != uint32(opts.MaskBackground) {
+		t.Error("source center is not kept")
+	}
+	if edge := gray(256, 256); edge == 0 ||
+		edge >= uint32(opts.MaskBackground) {
+		t.Error("source edge is not feathered", edge)
+	}
+	if corner := gray(256, 128); corner == 0 ||
+		corner >= uint32(opts.MaskBackground) {
+		t.Error("source corner is not feathered")
+	}
+}
+
+func TestZoomPlacement(t *testing.T) {
+	target := image.Point{X: 1024, Y: 512}
+	placement := ZoomPlacement(image.Point{X: 100, Y: 100}, target, 0.5,
+		DirectionCenter)
+	if placement != image.Rect(384, 128, 640, 384) {
+		t.Error("unexpected centered placement", placement)
+	}
+	placement = ZoomPlacement(image.Point{X: 100, Y: 100}, target, 0.5,
+		DirectionRight)
+	if placement != image.Rect(768, 128, 1024, 384) {
+		t.Error("unexpected right placement", placement)
+	}
+}
+
+func TestOutpaintConditionCorners(t *testing.T) {
+	for direction := Direction(0); direction < DirectionCount; direction++ {
+		cond := CondNone
+		cond.SetDirection(direction)
+		if cond.Direction() != direction {
+			t.Error("direction", direction, "round trips to",
+				cond.Direction())
+		}
+	}
+	cond := CondNone
+	cond.FromPlacement(image.Point{X: 1024, Y: 1024},
+		image.Rect(0, 512, 512, 1024))
+	if cond.Direction() != DirectionDownLeft || !cond.IsBothAxes() {
+		t.Error("unexpected condition from placement", cond)
+	}
+	if outpaintActions[cond] != OutpaintToTopRight {
+		t.Error("unexpected action", outpaintActions[cond])
+	}
+	cond.FromPlacement(image.Point{X: 1024, Y: 1024},
+		image.Rect(256, 256, 768, 768))
+	if outpaintActions[cond] != OutpaintAllSides {
+		t.Error("unexpected action", outpaintActions[cond])
+	}
+}
+
+func TestPrepareOutpaintImageAnchors(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	maskAt := func(masked *[]byte, x, y int) uint32 {
+		mask, _, _, decodeErr := DecodeImage(masked)
+		if decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+		v, _, _, _ := mask.At(x, y).RGBA()
+		return v
+	}
+
+	// A corner anchor zooms out into the corner, generating the opposite
+	// sides.
+	opts := NewOutpaintImageOpts()
+	opts.ZoomOut = 0.5
+	opts.AnchorDirection = DirectionDownRight
+	_, masked, _, _, _, err := PrepareOutpaintImage(&imageData, 768, 512,
+		opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maskAt(masked, 0, 0) != 0 {
+		t.Error("top-left is not generated")
+	}
+	if maskAt(masked, 767, 511) != uint32(opts.MaskBackground) {
+		t.Error("bottom-right source is not kept")
+	}
+
+	// An offset places the source at an arbitrary position along the scaled
+	// axis.
+	opts = NewOutpaintImageOpts()
+	opts.AnchorOffset = &image.Point{X: 100, Y: 0}
+	_, masked, _, _, _, err = PrepareOutpaintImage(&imageData, 768, 512,
+		opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maskAt(masked, 50, 256) != 0 || maskAt(masked, 700, 256) != 0 {
+		t.Error("sides of the offset source are not generated")
+	}
+	if maskAt(masked, 356, 256) != uint32(opts.MaskBackground) {
+		t.Error("offset source is not kept")
+	}
+}
+
+func TestOffsetPlacement(t *testing.T) {
+	target := image.Point{X: 1024, Y: 512}
+	size := image.Point{X: 256, Y: 256}
+	if p := OffsetPlacement(size, target, image.Point{X: 100, Y: 50}); p !=
+		image.Rect(100, 50, 356, 306) {
+		t.Error("unexpected placement", p)
+	}
+	if p := OffsetPlacement(size, target, image.Point{X: 900, Y: -10}); p !=
+		image.Rect(768, 0, 1024, 256) {
+		t.Error("offset was not clamped", p)
+	}
+}
@@ -0,0 +1,293 @@
+package stability_image
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+
+	"github.com/disintegration/imaging"
+)
+
+// ZoomPlacement returns where a source of `srcDim` is placed on a canvas of
+// `targetDim` when zooming out by `factor`: the source is fitted inside the
+// canvas, shrunk by `factor`, and anchored in the direction `anchor`.
+func ZoomPlacement(
+	srcDim image.Point,
+	targetDim image.Point,
+	factor float64,
+	anchor Direction,
+) image.Rectangle {
+	scale := math.Min(float64(targetDim.X)/float64(srcDim.X),
+		float64(targetDim.Y)/float64(srcDim.Y)) * factor
+	size := image.Point{
+		X: max(1, int(math.Round(float64(srcDim.X)*scale))),
+		Y: max(1, int(math.Round(float64(srcDim.Y)*scale))),
+	}
+	return AnchorPlacement(size, targetDim, anchor)
+}
+
+// AnchorPlacement returns the rectangle a source of `size` occupies when
+// anchored on a canvas of `targetDim` in the direction `anchor`.
+func AnchorPlacement(
+	size image.Point,
+	targetDim image.Point,
+	anchor Direction,
+) image.Rectangle {
+	// DirectionMatrix gives -1, 0 or 1 per axis, for the low edge, the
+	// center or the high edge of the canvas.
+	// Centered axes round the same way as imaging.OverlayCenter.
+	offset := DirectionMatrix[anchor]
+	anchorAxis := func(target int, size int, offset int) int {
+		switch {
+		case offset < 0:
+			return 0
+		case offset > 0:
+			return target - size
+		}
+		return target/2 - size/2
+	}
+	origin := image.Point{
+		X: anchorAxis(targetDim.X, size.X, offset.X),
+		Y: anchorAxis(targetDim.Y, size.Y, offset.Y),
+	}
+	return image.Rectangle{Min: origin, Max: origin.Add(size)}
+}
+
+// OffsetPlacement returns the rectangle a source of `size` occupies when its
+// top-left corner is placed at `offset` on a canvas of `targetDim`. The
+// offset is clamped so that as much of the source as possible stays on the
+// canvas.
+func OffsetPlacement(
+	size image.Point,
+	targetDim image.Point,
+	offset image.Point,
+) image.Rectangle {
+	origin := image.Point{
+		X: max(0, min(offset.X, targetDim.X-size.X)),
+		Y: max(0, min(offset.Y, targetDim.Y-size.Y)),
+	}
+	return image.Rectangle{Min: origin, Max: origin.Add(size)}
+}
+
+// mirrorCoord maps `v` into [lo, hi) by mirroring it back and forth across
+// the edges, repeating the edge pixels as a reflection does.
+func mirrorCoord(v int, lo int, hi int) int {
+	size := hi - lo
+	if size <= 0 {
+		return lo
+	}
+	period := 2 * size
+	offset := (v - lo) % period
+	if offset < 0 {
+		offset += period
+	}
+	if offset >= size {
+		offset = period - 1 - offset
+	}
+	return lo + offset
+}
+
+// ReflectImageEdgesAt fills the area of `canvas` outside of `placement` by
+// mirroring the pixels inside of `placement` across its edges, on all four
+// sides and the corners. The canvas is modified in place.
+func ReflectImageEdgesAt(canvas *image.NRGBA, placement image.Rectangle) {
+	remapOutside(canvas, placement, mirrorCoord)
+}
+
+// remapOutside fills the area of `canvas` outside of `placement` with the
+// pixels inside of it, mapping each coordinate into `placement` with
+// `remap`.
+func remapOutside(
+	canvas *image.NRGBA,
+	placement image.Rectangle,
+	remap func(v int, lo int, hi int) int,
+) {
+	bounds := canvas.Bounds()
+	placement = placement.Intersect(bounds)
+	if placement.Empty() {
+		return
+	}
+	parallelRows(bounds.Min.Y, bounds.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			srcY := remap(y, placement.Min.Y, placement.Max.Y)
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if y == srcY && x >= placement.Min.X &&
+					x < placement.Max.X {
+					x = placement.Max.X - 1
+					continue
+				}
+				srcX := remap(x, placement.Min.X, placement.Max.X)
+				copy(canvas.Pix[canvas.PixOffset(x, y):][:4],
+					canvas.Pix[canvas.PixOffset(srcX, srcY):][:4])
+			}
+		}
+	})
+}
+
+// CreatePlacementMask creates a mask of `size` for a source placed at
+// `placement`: the area outside of the placement is black, to be generated,
+// and the placement is `background`, to be kept, apart from a `feather`
+// pixel wide ramp shaped by `falloff` along each of its edges that does not
+// touch the canvas border. Where two feathered edges meet at a corner, the
+// nearer edge wins. If `invert` is set, the levels are swapped.
+func CreatePlacementMask(
+	size image.Point,
+	placement image.Rectangle,
+	feather int,
+	background uint16,
+	falloff MaskFalloff,
+	invert bool,
+) *image.Gray16 {
+	mask := image.NewGray16(image.Rectangle{Max: size})
+	bounds := mask.Bounds()
+	exposedLeft := placement.Min.X > bounds.Min.X
+	exposedRight := placement.Max.X < bounds.Max.X
+	exposedTop := placement.Min.Y > bounds.Min.Y
+	exposedBottom := placement.Max.Y < bounds.Max.Y
+	// The ramp is the same for every edge, so it is computed once.
+	ramp := make([]uint16, max(feather, 0))
+	for distance := range ramp {
+		ramp[distance] = maskValue(falloff.Weight(
+			(float64(distance)+0.5)/float64(feather)), background, invert)
+	}
+	outside := maskValue(0, background, invert)
+	inside := maskValue(1, background, invert)
+	parallelRows(bounds.Min.Y, bounds.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				value := outside
+				if (image.Point{X: x, Y: y}).In(placement) {
+					// Distance from the nearest exposed edge.
+					distance := math.MaxInt
+					if exposedLeft {
+						distance = min(distance, x-placement.Min.X)
+					}
+					if exposedRight {
+						distance = min(distance, placement.Max.X-1-x)
+					}
+					if exposedTop {
+						distance = min(distance, y-placement.Min.Y)
+					}
+					if exposedBottom {
+						distance = min(distance, placement.Max.Y-1-y)
+					}
+					value = inside
+					if distance < len(ramp) {
+						value = ramp[distance]
+					}
+				}
+				offset := mask.PixOffset(x, y)
+				mask.Pix[offset] = uint8(value >> 8)
+				mask.Pix[offset+1] = uint8(value)
+			}
+		}
+	})
+	return mask
+}
+
+// prepareZoomOutImage implements the zoom-out mode of PrepareOutpaintImage:
+// the source is shrunk to its placement in `geometry`, then prepared by
+// preparePlacedImage.
+func prepareZoomOutImage(
+	i image.Image,
+	geometry *OutpaintGeometry,
+	opts *OutpaintImageOpts,
+	rng *rand.Rand,
+) (
+	coerced *[]byte,
+	masked *[]byte,
+	scaledDim *image.Point,
+	err error,
+) {
+	resized := resizeWithAlpha(i, geometry.Placement.Dx(),
+		geometry.Placement.Dy(), imaging.Lanczos, opts.Alpha)
+	coerced, masked, err = preparePlacedImage(resized, geometry, opts, rng)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	targetDim := geometry.Target
+	return coerced, masked, &targetDim, nil
+}
+
+// relayerSource pastes the part of `source` within `inset` back onto
+// `canvas`, where `source` sits at `placement`. An empty inset re-layers the
+// whole source.
+func relayerSource(
+	canvas *image.NRGBA,
+	source *image.NRGBA,
+	placement image.Rectangle,
+	inset image.Rectangle,
+) *image.NRGBA {
+	inset = inset.Intersect(placement)
+	if inset.Empty() {
+		inset = placement
+	}
+	return imaging.Paste(canvas, imaging.Crop(source,
+		inset.Sub(placement.Min)), inset.Min)
+}
+
+// preparePlacedImage places the already scaled `resized` at its placement
+// in `geometry` on the target canvas, fills all of the exposed borders, and
+// feathers the mask along every exposed edge.
+func preparePlacedImage(
+	resized *image.NRGBA,
+	geometry *OutpaintGeometry,
+	opts *OutpaintImageOpts,
+	rng *rand.Rand,
+) (
+	coerced *[]byte,
+	masked *[]byte,
+	err error,
+) {
+	targetDim := geometry.Target
+	placement := geometry.Placement
+	canvas := imaging.New(targetDim.X, targetDim.Y, color.NRGBA{})
+	if opts.ZoomFillColor != nil {
+		canvas = imaging.New(targetDim.X, targetDim.Y, *opts.ZoomFillColor)
+	}
+	canvas = imaging.Paste(canvas, resized, placement.Min)
+	fillCtx := &OutpaintFillContext{
+		Canvas:    canvas,
+		Source:    resized,
+		Placement: placement,
+		Shuffle:   opts.OutpaintNoise,
+		Blur:      opts.OutpaintBlurEdge,
+		Rand:      rng,
+	}
+	fillCtx.Conds.FromPlacement(targetDim, placement)
+	var fillErr error
+	if opts.ZoomFillColor != nil {
+		canvas, fillErr = finishFill(fillCtx, canvas)
+	} else {
+		filler := opts.Filler
+		if filler == nil {
+			filler = ReflectFiller{}
+		}
+		canvas, fillErr = filler.Fill(fillCtx)
+	}
+	if fillErr != nil {
+		return nil, nil, fillErr
+	}
+	if opts.OutpaintNoise || opts.OutpaintBlurEdge > 0 {
+		// Re-layer the source, leaving the noised or blurred borders to
+		// overlap its edges by the feather width.
+		canvas = relayerSource(canvas, resized, placement,
+			placement.Inset(opts.OutpaintOffset))
+	}
+
+	mask := CreatePlacementMask(targetDim, placement, geometry.Feather,
+		opts.MaskBackground, opts.MaskFalloff, opts.MaskInvert)
+
+	var writeErr error
+	coerced, writeErr = EncodePng(canvas, png.BestSpeed)
+	if writeErr != nil {
+		return nil, nil, writeErr
+	}
+	masked, writeErr = EncodePng(mask, png.BestSpeed)
+	if writeErr != nil {
+		return nil, nil, writeErr
+	}
+	return coerced, masked, nil
+}
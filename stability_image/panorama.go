@@ -0,0 +1,483 @@
+package stability_image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+var (
+	ErrNoPanoramaAspect = errors.New("no aspect ratio fits the panorama")
+	ErrTooManySteps     = errors.New("panorama needs too many steps")
+)
+
+const (
+	// DefaultPanoramaOverlap is the share of each step's window that is
+	// already known, giving the generation its context.
+	DefaultPanoramaOverlap = 1.0 / 3
+	// DefaultPanoramaMaxUpscale is how much a step's generation may be
+	// scaled up to fill its window, before fewer steps stop being preferred
+	// over more detail.
+	DefaultPanoramaMaxUpscale = 2.0
+	// DefaultPanoramaMaxSteps bounds the number of steps of a panorama.
+	DefaultPanoramaMaxSteps = 32
+)
+
+type PanoramaOpts struct {
+	// Aspects are the sizes each step may be generated at. If nil, the
+	// aspect ratios for MaxPixels are used.
+	Aspects *AspectRatios
+	// StepAspect, if set, is the label of the aspect ratio every step is
+	// generated at, rather than the one needing the fewest steps.
+	StepAspect string
+	// Overlap is the share of each step's window that is already known.
+	Overlap float64
+	// MaxUpscale is how much a step's generation may be scaled up to fill
+	// its window.
+	MaxUpscale float64
+	// MaxSteps bounds the number of steps.
+	MaxSteps int
+	// Anchor is where the source sits on the canvas along the extended
+	// axis.
+	Anchor Direction
+	// Feather is the width in canvas pixels of the blend between the known
+	// and the generated parts of each step. If it is zero, OutpaintEdge at
+	// the generation's scale is used.
+	Feather int
+	// MaskBackground and MaskFalloff shape the masks of the steps, as they
+	// do in OutpaintImageOpts.
+	MaskBackground uint16
+	MaskFalloff    MaskFalloff
+	// Filler pre-fills the area each step generates. If nil, ReflectFiller
+	// is used.
+	Filler OutpaintFiller
+	// Seed seeds the fillers of the steps. If it is zero, PlanPanorama
+	// picks a seed and records it here.
+	Seed int64
+}
+
+func NewPanoramaOpts() *PanoramaOpts {
+	return &PanoramaOpts{
+		Overlap:        DefaultPanoramaOverlap,
+		MaxUpscale:     DefaultPanoramaMaxUpscale,
+		MaxSteps:       DefaultPanoramaMaxSteps,
+		Anchor:         DirectionCenter,
+		MaskBackground: OutpaintBackground,
+	}
+}
+
+// PanoramaStep is a single outpainting of a panorama: the part of the
+// canvas in `Window` is generated at `Size`, keeping what is already known
+// of it in `Known`.
+type PanoramaStep struct {
+	// Window is the part of the canvas the step generates.
+	Window image.Rectangle `json:"window"`
+	// Size is the size the window is generated at.
+	Size image.Point `json:"size"`
+	// Known is the part of the window known before the step.
+	Known image.Rectangle `json:"known"`
+	// Anchor is where the known part sits in the window, opposite to the
+	// direction the step extends the panorama in.
+	Anchor Direction `json:"anchor"`
+}
+
+// PanoramaPlan breaks extending a source to a canvas too large to generate
+// at once into a sequence of steps. The source is scaled to fill the
+// canvas across the extended axis, and each step outpaints a window of the
+// canvas at one of the sizes in the aspect ratios table, with part of the
+// window already known for context. Each step is prepared from the canvas
+// as the previous steps left it, so the steps are run in order:
+//
+//	canvas := plan.NewCanvas(source)
+//	for index := range plan.Steps {
+//		coerced, masked, _ := plan.PrepareStep(index, canvas)
+//		// Outpaint coerced with masked into generated.
+//		plan.StitchStep(index, canvas, generated)
+//	}
+type PanoramaPlan struct {
+	// Source is the size of the source.
+	Source image.Point `json:"source"`
+	// Canvas is the size of the panorama.
+	Canvas image.Point `json:"canvas"`
+	// Placement is where the scaled source sits on the canvas.
+	Placement image.Rectangle `json:"placement"`
+	// Aspect is the label of the aspect ratio the steps are generated at,
+	// and Scale how much each generation is scaled up to its window.
+	Aspect string  `json:"aspect"`
+	Scale  float64 `json:"scale"`
+	// Feather is the width in canvas pixels of the blend between the known
+	// and the generated parts of each step.
+	Feather int            `json:"feather"`
+	Steps   []PanoramaStep `json:"steps"`
+	// Seed is the seed the steps' fillers are seeded from.
+	Seed int64 `json:"seed"`
+
+	opts PanoramaOpts
+}
+
+// panoramaAxis maps points between the canvas' axes and the extended
+// (along) and fixed (across) axes of a panorama.
+type panoramaAxis bool
+
+const (
+	panoramaHorizontal panoramaAxis = false
+	panoramaVertical   panoramaAxis = true
+)
+
+func (axis panoramaAxis) split(p image.Point) (along int, across int) {
+	if axis == panoramaVertical {
+		return p.Y, p.X
+	}
+	return p.X, p.Y
+}
+
+func (axis panoramaAxis) rect(lo int, hi int, across int) image.Rectangle {
+	if axis == panoramaVertical {
+		return image.Rect(0, lo, across, hi)
+	}
+	return image.Rect(lo, 0, hi, across)
+}
+
+// panoramaSteps lays the steps of a panorama out at `size`, growing the
+// known interval from the placement of the source outwards, alternating
+// between the high and the low side.
+func panoramaSteps(
+	axis panoramaAxis,
+	canvas image.Point,
+	placement image.Rectangle,
+	size image.Point,
+	overlap float64,
+	maxSteps int,
+) ([]PanoramaStep, error) {
+	canvasAlong, across := axis.split(canvas)
+	sizeAlong, sizeAcross := axis.split(size)
+	window := int(math.Round(float64(across) * float64(sizeAlong) /
+		float64(sizeAcross)))
+	if window > canvasAlong || window < 2 {
+		return nil, fmt.Errorf("%w: %v windows are %d long", ErrNoPanoramaAspect,
+			size, window)
+	}
+	context := max(1, min(window-1,
+		int(math.Ceil(float64(window)*overlap))))
+	lo, _ := axis.split(placement.Min)
+	hi, _ := axis.split(placement.Max)
+	steps := make([]PanoramaStep, 0)
+	high := true
+	for lo > 0 || hi < canvasAlong {
+		if len(steps) >= maxSteps {
+			return nil, fmt.Errorf("%w: more than %d at %v", ErrTooManySteps,
+				maxSteps, size)
+		}
+		var start int
+		if hi < canvasAlong && (high || lo == 0) {
+			start = hi - context
+		} else {
+			start = lo + context - window
+		}
+		start = max(0, min(start, canvasAlong-window))
+		end := start + window
+		step := PanoramaStep{
+			Window: axis.rect(start, end, across),
+			Size:   size,
+			Known:  axis.rect(max(start, lo), min(end, hi), across),
+		}
+		conds := CondNone
+		conds.FromPlacement(step.Window.Size(),
+			step.Known.Sub(step.Window.Min))
+		step.Anchor = conds.Direction()
+		steps = append(steps, step)
+		lo, hi = min(lo, start), max(hi, end)
+		high = !high
+	}
+	return steps, nil
+}
+
+// PlanPanorama plans extending a source of `srcDim` to a canvas of
+// `canvasWidth` by `canvasHeight` in steps generated at sizes from
+// `opts.Aspects`. Unless `opts.StepAspect` picks the aspect ratio, the one
+// needing the fewest steps without scaling the generations up by more than
+// `opts.MaxUpscale` is used, or failing that the one scaling them up the
+// least.
+func PlanPanorama(
+	srcDim image.Point,
+	canvasWidth int,
+	canvasHeight int,
+	opts *PanoramaOpts,
+) (*PanoramaPlan, error) {
+	if opts == nil {
+		opts = NewPanoramaOpts()
+	}
+	if opts.Seed == 0 {
+		opts.Seed = NewSeed()
+	}
+	if srcDim.X <= 0 || srcDim.Y <= 0 || canvasWidth <= 0 ||
+		canvasHeight <= 0 {
+		return nil, fmt.Errorf("cannot extend %v to %vx%v", srcDim,
+			canvasWidth, canvasHeight)
+	}
+	aspects := opts.Aspects
+	if aspects == nil {
+		defaults := NewAspectRatios(MaxPixels, DimensionStep, MinDimension,
+			MaxDimension)
+		aspects = &defaults
+	}
+	overlap := opts.Overlap
+	if overlap <= 0 || overlap >= 1 {
+		overlap = DefaultPanoramaOverlap
+	}
+	maxSteps := opts.MaxSteps
+	if maxSteps <= 0 {
+		maxSteps = DefaultPanoramaMaxSteps
+	}
+	maxUpscale := opts.MaxUpscale
+	if maxUpscale <= 0 {
+		maxUpscale = DefaultPanoramaMaxUpscale
+	}
+
+	// The source fills the canvas across the extended axis.
+	canvas := image.Point{X: canvasWidth, Y: canvasHeight}
+	axis := panoramaHorizontal
+	scaled := image.Point{X: fitLength(canvasHeight, srcDim.X, srcDim.Y),
+		Y: canvasHeight}
+	anchor := opts.Anchor.Horizontal()
+	if canvasWidth*srcDim.Y < canvasHeight*srcDim.X {
+		axis = panoramaVertical
+		scaled = image.Point{X: canvasWidth,
+			Y: fitLength(canvasWidth, srcDim.Y, srcDim.X)}
+		anchor = opts.Anchor.Vertical()
+	}
+	plan := &PanoramaPlan{
+		Source:    srcDim,
+		Canvas:    canvas,
+		Placement: AnchorPlacement(scaled, canvas, anchor),
+		Steps:     make([]PanoramaStep, 0),
+		Seed:      opts.Seed,
+		opts:      *opts,
+	}
+	if scaled == canvas {
+		return plan, nil
+	}
+
+	labels := make([]string, 0, len(aspects.Table))
+	for label := range aspects.Table {
+		labels = append(labels, label)
+	}
+	if opts.StepAspect != "" {
+		if _, ok := aspects.Table[opts.StepAspect]; !ok {
+			return nil, fmt.Errorf("%w: %q is not in the table",
+				ErrNoPanoramaAspect, opts.StepAspect)
+		}
+		labels = []string{opts.StepAspect}
+	}
+	sort.Strings(labels)
+	_, across := axis.split(canvas)
+	var lastErr error = ErrNoPanoramaAspect
+	for _, label := range labels {
+		aspect := aspects.Table[label]
+		size := image.Point{X: int(aspect.WidthPixels),
+			Y: int(aspect.HeightPixels)}
+		steps, err := panoramaSteps(axis, canvas, plan.Placement, size,
+			overlap, maxSteps)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		_, sizeAcross := axis.split(size)
+		scale := float64(across) / float64(sizeAcross)
+		if plan.Aspect != "" {
+			fits, planFits := scale <= maxUpscale, plan.Scale <= maxUpscale
+			switch {
+			case fits != planFits:
+				if !fits {
+					continue
+				}
+			case fits:
+				if len(steps) > len(plan.Steps) ||
+					len(steps) == len(plan.Steps) && scale >= plan.Scale {
+					continue
+				}
+			case scale > plan.Scale ||
+				scale == plan.Scale && len(steps) >= len(plan.Steps):
+				continue
+			}
+		}
+		plan.Aspect, plan.Scale, plan.Steps = label, scale, steps
+	}
+	if plan.Aspect == "" {
+		return nil, lastErr
+	}
+
+	// The feather fits within the context of every step.
+	plan.Feather = opts.Feather
+	if plan.Feather <= 0 {
+		plan.Feather = int(math.Round(float64(OutpaintEdge) * plan.Scale))
+	}
+	for _, step := range plan.Steps {
+		knownAlong, _ := axis.split(step.Known.Size())
+		plan.Feather = min(plan.Feather, knownAlong)
+	}
+	plan.Feather = max(1, plan.Feather)
+	return plan, nil
+}
+
+// NewCanvas returns a blank canvas for the panorama, with `source` scaled
+// to its placement.
+func (p *PanoramaPlan) NewCanvas(source image.Image) *image.NRGBA {
+	canvas := image.NewNRGBA(image.Rectangle{Max: p.Canvas})
+	resized := imaging.Resize(source, p.Placement.Dx(), p.Placement.Dy(),
+		imaging.Lanczos)
+	draw.Draw(canvas, p.Placement, resized, image.Point{}, draw.Src)
+	return canvas
+}
+
+func (p *PanoramaPlan) checkStep(index int, canvas *image.NRGBA) error {
+	if index < 0 || index >= len(p.Steps) {
+		return fmt.Errorf("no panorama step %d of %d", index, len(p.Steps))
+	}
+	if size := canvas.Bounds().Size(); size != p.Canvas {
+		return fmt.Errorf("%w: canvas is %v, not %v", ErrGeometryMismatch,
+			size, p.Canvas)
+	}
+	return nil
+}
+
+// PrepareStep prepares step `index` from `canvas`, as the steps before it
+// left it: the window is cropped and scaled to the step's size, its unknown
+// part is filled, and the mask feathers the known part into it.
+func (p *PanoramaPlan) PrepareStep(index int, canvas *image.NRGBA) (
+	coerced *[]byte,
+	masked *[]byte,
+	err error,
+) {
+	if err = p.checkStep(index, canvas); err != nil {
+		return nil, nil, err
+	}
+	step := p.Steps[index]
+	scaleX := float64(step.Size.X) / float64(step.Window.Dx())
+	scaleY := float64(step.Size.Y) / float64(step.Window.Dy())
+	local := step.Known.Sub(step.Window.Min)
+	known := image.Rect(
+		int(math.Round(float64(local.Min.X)*scaleX)),
+		int(math.Round(float64(local.Min.Y)*scaleY)),
+		int(math.Round(float64(local.Max.X)*scaleX)),
+		int(math.Round(float64(local.Max.Y)*scaleY)),
+	).Intersect(image.Rectangle{Max: step.Size})
+
+	// Only the known part is scaled, so that the unknown part does not
+	// bleed into it.
+	source := imaging.Resize(imaging.Crop(canvas, step.Known), known.Dx(),
+		known.Dy(), imaging.Lanczos)
+	prepared := image.NewNRGBA(image.Rectangle{Max: step.Size})
+	draw.Draw(prepared, known, source, image.Point{}, draw.Src)
+	fillCtx := &OutpaintFillContext{
+		Canvas:    prepared,
+		Source:    source,
+		Placement: known,
+		Rand:      rand.New(rand.NewSource(p.Seed + int64(index))),
+	}
+	fillCtx.Conds.FromPlacement(step.Size, known)
+	filler := p.opts.Filler
+	if filler == nil {
+		filler = ReflectFiller{}
+	}
+	prepared, err = filler.Fill(fillCtx)
+	if err != nil {
+		return nil, nil, err
+	}
+	feather := max(1, int(math.Round(float64(p.Feather)*(scaleX+scaleY)/2)))
+	mask := CreatePlacementMask(step.Size, known, feather,
+		p.opts.MaskBackground, p.opts.MaskFalloff, false)
+
+	if coerced, err = EncodePng(prepared, png.BestSpeed); err != nil {
+		return nil, nil, err
+	}
+	if masked, err = EncodePng(mask, png.BestSpeed); err != nil {
+		return nil, nil, err
+	}
+	return coerced, masked, nil
+}
+
+// StitchStep scales `generated`, the outpainting of step `index`, to the
+// step's window and blends it into `canvas`, feathering the known part of
+// the window into it.
+func (p *PanoramaPlan) StitchStep(
+	index int,
+	canvas *image.NRGBA,
+	generated image.Image,
+) error {
+	if err := p.checkStep(index, canvas); err != nil {
+		return err
+	}
+	step := p.Steps[index]
+	generatedDim := generated.Bounds().Size()
+	aspect := float64(step.Size.X) / float64(step.Size.Y)
+	if generatedDim.X <= 0 || generatedDim.Y <= 0 ||
+		math.Abs(float64(generatedDim.X)/float64(generatedDim.Y)-aspect) >
+			geometryAspectTolerance*aspect {
+		return fmt.Errorf("%w: step %d generated %v, not the aspect ratio "+
+			"of %v", ErrGeometryMismatch, index, generatedDim, step.Size)
+	}
+	window := imaging.Resize(generated, step.Window.Dx(), step.Window.Dy(),
+		imaging.Lanczos)
+	local := step.Known.Sub(step.Window.Min)
+	weights := CreatePlacementMask(step.Window.Size(), local, p.Feather,
+		0xffff, p.opts.MaskFalloff, false)
+	blendWeighted(window, imaging.Crop(canvas, step.Window), image.Point{},
+		weights, local)
+	draw.Draw(canvas, step.Window, window, image.Point{}, draw.Src)
+	return nil
+}
+
+// Assemble stitches the outpaintings of every step, in order, onto a new
+// canvas of `source`.
+func (p *PanoramaPlan) Assemble(
+	source image.Image,
+	results []image.Image,
+) (*image.NRGBA, error) {
+	if len(results) != len(p.Steps) {
+		return nil, fmt.Errorf("%d results for %d panorama steps",
+			len(results), len(p.Steps))
+	}
+	canvas := p.NewCanvas(source)
+	for index, result := range results {
+		if err := p.StitchStep(index, canvas, result); err != nil {
+			return nil, err
+		}
+	}
+	return canvas, nil
+}
+
+// Run runs every step in order on a new canvas of `source`, outpainting
+// each with `generate`.
+func (p *PanoramaPlan) Run(
+	source image.Image,
+	generate func(index int, coerced *[]byte, masked *[]byte) (*[]byte,
+		error),
+) (*image.NRGBA, error) {
+	canvas := p.NewCanvas(source)
+	for index := range p.Steps {
+		coerced, masked, err := p.PrepareStep(index, canvas)
+		if err != nil {
+			return nil, err
+		}
+		result, err := generate(index, coerced, masked)
+		if err != nil {
+			return nil, err
+		}
+		generated, _, _, err := DecodeImage(result)
+		if err != nil {
+			return nil, err
+		}
+		if err = p.StitchStep(index, canvas, generated); err != nil {
+			return nil, err
+		}
+	}
+	return canvas, nil
+}
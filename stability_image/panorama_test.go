@@ -0,0 +1,228 @@
+package stability_image
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// checkPanoramaSteps checks that the steps of `plan` are each generated at
+// a size from `aspects`, grow the known part of the canvas outwards from
+// the source, and cover the canvas between them.
+func checkPanoramaSteps(
+	t *testing.T,
+	plan *PanoramaPlan,
+	aspects *AspectRatios,
+) {
+	t.Helper()
+	canvas := image.Rectangle{Max: plan.Canvas}
+	known := plan.Placement
+	for index, step := range plan.Steps {
+		if _, ok := aspects.ReverseTable[step.Size]; !ok {
+			t.Error("step", index, "is generated at", step.Size)
+		}
+		if !step.Window.In(canvas) || !step.Known.In(step.Window) ||
+			step.Known.Empty() || step.Known == step.Window {
+			t.Error("step", index, "has window", step.Window, "known",
+				step.Known)
+		}
+		if step.Known != step.Window.Intersect(known) {
+			t.Error("step", index, "does not know", step.Window.Intersect(
+				known))
+		}
+		// The window keeps the generation's aspect ratio.
+		if diff := step.Window.Dx()*step.Size.Y -
+			step.Window.Dy()*step.Size.X; abs(diff) >
+			max(step.Size.X, step.Size.Y) {
+			t.Error("step", index, "window", step.Window,
+				"distorts", step.Size)
+		}
+		known = known.Union(step.Window)
+	}
+	if known != canvas {
+		t.Error("steps cover", known, "of", canvas)
+	}
+}
+
+func TestPlanPanorama(t *testing.T) {
+	aspects := NewAspectRatios(1048576, 64, 256, 1536)
+
+	// A square source extended to a 21:9 panorama at 4K is anchored in the
+	// center and extended on both sides.
+	opts := NewPanoramaOpts()
+	opts.Aspects = &aspects
+	plan, err := PlanPanorama(image.Point{X: 1024, Y: 1024}, 3840, 1646, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Placement != image.Rect(1097, 0, 2743, 1646) {
+		t.Error("unexpected placement", plan.Placement)
+	}
+	if plan.Scale > DefaultPanoramaMaxUpscale || len(plan.Steps) != 2 {
+		t.Error("unexpected plan at", plan.Aspect, plan.Scale, "with",
+			len(plan.Steps), "steps")
+	}
+	if plan.Steps[0].Anchor != DirectionLeft ||
+		plan.Steps[1].Anchor != DirectionRight {
+		t.Error("steps do not alternate sides", plan.Steps[0].Anchor,
+			plan.Steps[1].Anchor)
+	}
+	if encoded, marshalErr := json.Marshal(plan.Steps[0]); marshalErr !=
+		nil || !bytes.Contains(encoded, []byte(`"anchor":"left"`)) {
+		t.Error("step is serialized as", string(encoded), marshalErr)
+	}
+	checkPanoramaSteps(t, plan, &aspects)
+
+	// Forcing a narrow step size takes more, smaller steps.
+	opts = NewPanoramaOpts()
+	opts.Aspects = &aspects
+	opts.StepAspect = "9:16"
+	narrowPlan, err := PlanPanorama(image.Point{X: 1024, Y: 1024}, 3840, 1646,
+		opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(narrowPlan.Steps) <= len(plan.Steps) {
+		t.Error("narrow steps are not smaller", len(narrowPlan.Steps))
+	}
+	checkPanoramaSteps(t, narrowPlan, &aspects)
+
+	// Tall panoramas are extended downwards from a source anchored up.
+	opts = NewPanoramaOpts()
+	opts.Aspects = &aspects
+	opts.Anchor = DirectionUpLeft
+	plan, err = PlanPanorama(image.Point{X: 1024, Y: 768}, 1024, 3072, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Placement != image.Rect(0, 0, 1024, 768) {
+		t.Error("unexpected placement", plan.Placement)
+	}
+	for index, step := range plan.Steps {
+		if step.Anchor != DirectionUp {
+			t.Error("step", index, "is anchored", step.Anchor)
+		}
+	}
+	checkPanoramaSteps(t, plan, &aspects)
+
+	// A source that already fits needs no steps.
+	plan, err = PlanPanorama(image.Point{X: 1024, Y: 512}, 2048, 1024, opts)
+	if err != nil || len(plan.Steps) != 0 {
+		t.Error("fitting source was planned", err)
+	}
+
+	opts = NewPanoramaOpts()
+	opts.Aspects = &aspects
+	opts.MaxSteps = 2
+	opts.StepAspect = "9:21"
+	if _, err = PlanPanorama(image.Point{X: 1024, Y: 1024}, 3840, 1646,
+		opts); !errors.Is(err, ErrTooManySteps) {
+		t.Error("too many steps were not reported", err)
+	}
+	opts.StepAspect = "7:3"
+	if _, err = PlanPanorama(image.Point{X: 1024, Y: 1024}, 3840, 1646,
+		opts); !errors.Is(err, ErrNoPanoramaAspect) {
+		t.Error("unknown aspect was not reported", err)
+	}
+}
+
+func TestPanoramaRun(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, _, srcDim, err := DecodeImage(&imageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aspects := NewAspectRatios(65536, 64, 128, 512)
+	opts := NewPanoramaOpts()
+	opts.Aspects = &aspects
+	opts.Seed = 1
+	plan, err := PlanPanorama(*srcDim, 1536, 384, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPanoramaSteps(t, plan, &aspects)
+
+	// Stand in for the generation with the prepared images themselves.
+	results := make([]image.Image, 0, len(plan.Steps))
+	panorama, err := plan.Run(source, func(index int, coerced *[]byte,
+		masked *[]byte) (*[]byte, error) {
+		mask, _, maskDim, maskErr := DecodeImage(masked)
+		if maskErr != nil {
+			return nil, maskErr
+		}
+		if *maskDim != plan.Steps[index].Size {
+			t.Error("step", index, "mask is", *maskDim)
+		}
+		// The middle of the known part is kept, and the far end of the
+		// window generated.
+		step := plan.Steps[index]
+		corner := image.Point{}
+		if step.Anchor == DirectionLeft {
+			corner.X = maskDim.X - 1
+		}
+		gray, _, _, _ := mask.At(corner.X, corner.Y).RGBA()
+		if gray != 0 {
+			t.Error("step", index, "does not generate its far end")
+		}
+		generated, _, _, decodeErr := DecodeImage(coerced)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		results = append(results, generated)
+		return coerced, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < plan.Canvas.Y; y += 7 {
+		for x := 0; x < plan.Canvas.X; x += 7 {
+			if panorama.NRGBAAt(x, y).A != 255 {
+				t.Fatal("panorama has a hole at", x, y)
+			}
+		}
+	}
+	// The source is left as it was placed, away from the feathers.
+	initial := plan.NewCanvas(source)
+	inner := plan.Placement.Inset(plan.Feather)
+	for y := inner.Min.Y; y < inner.Max.Y; y += 5 {
+		for x := inner.Min.X; x < inner.Max.X; x += 5 {
+			if colorDistance(panorama.At(x, y), initial.At(x, y)) > 0 {
+				t.Fatal("source was changed at", x, y)
+			}
+		}
+	}
+
+	assembled, err := plan.Assemble(source, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for offset := range assembled.Pix {
+		if assembled.Pix[offset] != panorama.Pix[offset] {
+			t.Fatal("assembling the results gives a different panorama")
+		}
+	}
+	if _, err = plan.Assemble(source, results[1:]); err == nil {
+		t.Error("missing results were not reported")
+	}
+	if err = plan.StitchStep(0, initial, image.NewNRGBA(image.Rect(0, 0,
+		10, 30))); !errors.Is(err, ErrGeometryMismatch) {
+		t.Error("mismatched result was not reported", err)
+	}
+
+	os.MkdirAll(OutputDir, 0755)
+	encoded, err := EncodePng(panorama, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(OutputDir+"/panorama.png", *encoded, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
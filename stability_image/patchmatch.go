@@ -0,0 +1,571 @@
+package stability_image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"math/rand"
+)
+
+var ErrPatchSizeTooLarge = errors.New("patch size is too large")
+
+// MaxPatchSize is the largest PatchSize, at which the squared color
+// differences summed over a patch still fit in the int32 distances.
+const MaxPatchSize = 101
+
+// PatchMatchOpts configures PatchMatchFill.
+type PatchMatchOpts struct {
+	// PatchSize is the width and height of the patches compared, and is
+	// rounded up to be odd. It is at most MaxPatchSize.
+	PatchSize int
+	// Iterations is the number of PatchMatch propagation and random search
+	// passes made before each vote.
+	Iterations int
+	// EMSteps is the number of times the hole is re-synthesized from its
+	// nearest patches at each level of the pyramid.
+	EMSteps int
+	// MinLevelSize is the smallest dimension of the coarsest pyramid level.
+	MinLevelSize int
+	// Seed seeds the random initialization and search. The same seed always
+	// gives the same fill, regardless of how many goroutines are used.
+	Seed int64
+}
+
+func NewPatchMatchOpts() *PatchMatchOpts {
+	return &PatchMatchOpts{
+		PatchSize:    7,
+		Iterations:   4,
+		EMSteps:      2,
+		MinLevelSize: 32,
+		Seed:         1,
+	}
+}
+
+// pmLevel is one level of the image pyramid, at the origin.
+type pmLevel struct {
+	img  *image.NRGBA
+	hole []bool
+}
+
+func (l *pmLevel) width() int  { return l.img.Rect.Dx() }
+func (l *pmLevel) height() int { return l.img.Rect.Dy() }
+
+// downsample halves the level, averaging the known pixels of each 2x2 block.
+// A block with any hole pixel is a hole at the coarser level, so coarse
+// source patches are made of known pixels only.
+func (l *pmLevel) downsample() *pmLevel {
+	w, h := (l.width()+1)/2, (l.height()+1)/2
+	coarse := &pmLevel{
+		img:  image.NewNRGBA(image.Rect(0, 0, w, h)),
+		hole: make([]bool, w*h),
+	}
+	parallelRows(0, h, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < w; x++ {
+				var sums [4]int
+				count := 0
+				hole := false
+				for dy := 0; dy < 2; dy++ {
+					for dx := 0; dx < 2; dx++ {
+						fx, fy := x*2+dx, y*2+dy
+						if fx >= l.width() || fy >= l.height() {
+							continue
+						}
+						if l.hole[fy*l.width()+fx] {
+							hole = true
+							continue
+						}
+						pix := l.img.Pix[l.img.PixOffset(fx, fy):][:4]
+						for c := 0; c < 4; c++ {
+							sums[c] += int(pix[c])
+						}
+						count++
+					}
+				}
+				coarse.hole[y*w+x] = hole
+				if count == 0 {
+					continue
+				}
+				pix := coarse.img.Pix[coarse.img.PixOffset(x, y):][:4]
+				for c := 0; c < 4; c++ {
+					pix[c] = uint8((sums[c] + count/2) / count)
+				}
+			}
+		}
+	})
+	return coarse
+}
+
+// hasKnown returns whether any pixel of the level is outside of the hole.
+func (l *pmLevel) hasKnown() bool {
+	for _, hole := range l.hole {
+		if !hole {
+			return true
+		}
+	}
+	return false
+}
+
+// holeCounts returns the summed area table of the level's hole, with an
+// extra leading row and column of zeros.
+func (l *pmLevel) holeCounts() []int32 {
+	w, h := l.width(), l.height()
+	sat := make([]int32, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		var row int32
+		for x := 0; x < w; x++ {
+			if l.hole[y*w+x] {
+				row++
+			}
+			sat[(y+1)*(w+1)+x+1] = sat[y*(w+1)+x+1] + row
+		}
+	}
+	return sat
+}
+
+// patchMatcher solves one pyramid level: it keeps, for every pixel whose
+// patch overlaps the hole, the nearest fully known source patch, and
+// re-synthesizes the hole from them.
+type patchMatcher struct {
+	level  *pmLevel
+	radius int
+	width  int
+	height int
+	// valid flags the centers of patches that are within the image and
+	// free of the hole.
+	valid   []bool
+	sources []int32
+	// target flags the pixels whose patch overlaps the hole; their nearest
+	// source patch centers and distances are in nnf and dist.
+	target []bool
+	nnf    []int32
+	dist   []int32
+}
+
+func newPatchMatcher(level *pmLevel, radius int) *patchMatcher {
+	w, h := level.width(), level.height()
+	m := &patchMatcher{
+		level:  level,
+		radius: radius,
+		width:  w,
+		height: h,
+		valid:  make([]bool, w*h),
+		target: make([]bool, w*h),
+		nnf:    make([]int32, w*h),
+		dist:   make([]int32, w*h),
+	}
+	sat := level.holeCounts()
+	holesIn := func(x0 int, y0 int, x1 int, y1 int) int32 {
+		x0, y0 = max(x0, 0), max(y0, 0)
+		x1, y1 = min(x1, w), min(y1, h)
+		return sat[y1*(w+1)+x1] - sat[y0*(w+1)+x1] -
+			sat[y1*(w+1)+x0] + sat[y0*(w+1)+x0]
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			idx := y*w + x
+			holes := holesIn(x-radius, y-radius, x+radius+1, y+radius+1)
+			m.target[idx] = holes > 0
+			m.valid[idx] = holes == 0 && x >= radius && y >= radius &&
+				x < w-radius && y < h-radius
+			if m.valid[idx] {
+				m.sources = append(m.sources, int32(idx))
+			}
+		}
+	}
+	return m
+}
+
+// distance returns the sum of squared color differences between the patches
+// centered on `target` and `source`, or a value above `limit` if it exceeds
+// it. Target pixels outside of the image are skipped.
+func (m *patchMatcher) distance(target int32, source int32, limit int32) int32 {
+	tx, ty := int(target)%m.width, int(target)/m.width
+	sx, sy := int(source)%m.width, int(source)/m.width
+	pix, stride := m.level.img.Pix, m.level.img.Stride
+	var sum int32
+	for dy := -m.radius; dy <= m.radius; dy++ {
+		y := ty + dy
+		if y < 0 || y >= m.height {
+			continue
+		}
+		x0, x1 := max(tx-m.radius, 0), min(tx+m.radius+1, m.width)
+		tOff := y*stride + x0*4
+		sOff := (sy+dy)*stride + (sx+x0-tx)*4
+		tRow := pix[tOff : tOff+(x1-x0)*4]
+		sRow := pix[sOff : sOff+len(tRow)]
+		for i := 0; i+3 < len(tRow); i += 4 {
+			dr := int32(tRow[i]) - int32(sRow[i])
+			dg := int32(tRow[i+1]) - int32(sRow[i+1])
+			db := int32(tRow[i+2]) - int32(sRow[i+2])
+			sum += dr*dr + dg*dg + db*db
+		}
+		if sum > limit {
+			return sum
+		}
+	}
+	return sum
+}
+
+// rowRand returns the random source for row `y` of a pass, so that passes
+// are deterministic however the rows are split between goroutines.
+func rowRand(seed int64, pass int, y int) *rand.Rand {
+	return rand.New(rand.NewSource(seed ^ int64(pass)<<32 ^ int64(y)))
+}
+
+// initialize sets the nearest source of every target to its guess in
+// `guess`, if valid, or to a random source patch.
+func (m *patchMatcher) initialize(guess func(x int, y int) int32, seed int64) {
+	parallelRows(0, m.height, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			rng := rowRand(seed, 0, y)
+			for x := 0; x < m.width; x++ {
+				idx := y*m.width + x
+				if !m.target[idx] {
+					continue
+				}
+				source := int32(-1)
+				if guess != nil {
+					source = guess(x, y)
+				}
+				if source < 0 || !m.valid[source] {
+					source = m.sources[rng.Intn(len(m.sources))]
+				}
+				m.nnf[idx] = source
+			}
+		}
+	})
+	m.measure()
+}
+
+// measure recomputes the distance of every target to its nearest source,
+// after the image has changed.
+func (m *patchMatcher) measure() {
+	parallelRows(0, m.height, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < m.width; x++ {
+				idx := y*m.width + x
+				if m.target[idx] {
+					m.dist[idx] = m.distance(int32(idx), m.nnf[idx],
+						math.MaxInt32)
+				}
+			}
+		}
+	})
+}
+
+// iterate makes one Jacobi-style pass of propagation and random search:
+// every target is improved from the previous pass's field only, so rows can
+// be processed in parallel with the same result.
+func (m *patchMatcher) iterate(seed int64, pass int) {
+	prevNnf := append([]int32(nil), m.nnf...)
+	maxRadius := max(m.width, m.height)
+	parallelRows(0, m.height, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			rng := rowRand(seed, pass, y)
+			for x := 0; x < m.width; x++ {
+				idx := int32(y*m.width + x)
+				if !m.target[idx] {
+					continue
+				}
+				best, bestDist := m.nnf[idx], m.dist[idx]
+				try := func(sx int, sy int) {
+					if sx < 0 || sy < 0 || sx >= m.width || sy >= m.height {
+						return
+					}
+					source := int32(sy*m.width + sx)
+					if !m.valid[source] || source == best {
+						return
+					}
+					if d := m.distance(idx, source, bestDist); d < bestDist {
+						best, bestDist = source, d
+					}
+				}
+				// Propagate the neighbours' matches, shifted back.
+				for _, n := range [4][2]int{{-1, 0}, {1, 0}, {0, -1},
+					{0, 1}} {
+					nx, ny := x+n[0], y+n[1]
+					if nx < 0 || ny < 0 || nx >= m.width || ny >= m.height {
+						continue
+					}
+					nIdx := ny*m.width + nx
+					if !m.target[nIdx] {
+						continue
+					}
+					source := int(prevNnf[nIdx])
+					try(source%m.width-n[0], source/m.width-n[1])
+				}
+				// Search randomly around the best match, in shrinking
+				// windows.
+				for r := maxRadius; r >= 1; r /= 2 {
+					bx, by := int(best)%m.width, int(best)/m.width
+					try(bx+rng.Intn(2*r+1)-r, by+rng.Intn(2*r+1)-r)
+				}
+				m.nnf[idx], m.dist[idx] = best, bestDist
+			}
+		}
+	})
+}
+
+// vote re-synthesizes every hole pixel as the weighted average of the pixels
+// that the source patches of the targets covering it place there. Patches
+// that match more closely weigh more.
+func (m *patchMatcher) vote() {
+	var total float64
+	count := 0
+	for idx, isTarget := range m.target {
+		if isTarget {
+			total += float64(m.dist[idx])
+			count++
+		}
+	}
+	sigma2 := 1.0
+	if count > 0 && total > 0 {
+		sigma2 = total / float64(count)
+	}
+	weights := make([]float64, len(m.target))
+	for idx, isTarget := range m.target {
+		if isTarget {
+			weights[idx] = math.Exp(-float64(m.dist[idx]) / (2 * sigma2))
+		}
+	}
+	img := m.level.img
+	voted := make([]uint8, len(img.Pix))
+	copy(voted, img.Pix)
+	parallelRows(0, m.height, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < m.width; x++ {
+				if !m.level.hole[y*m.width+x] {
+					continue
+				}
+				var sums [4]float64
+				total := 0.0
+				for dy := -m.radius; dy <= m.radius; dy++ {
+					for dx := -m.radius; dx <= m.radius; dx++ {
+						qx, qy := x-dx, y-dy
+						if qx < 0 || qy < 0 || qx >= m.width ||
+							qy >= m.height {
+							continue
+						}
+						q := qy*m.width + qx
+						if !m.target[q] {
+							continue
+						}
+						source := int(m.nnf[q])
+						sx := source%m.width + dx
+						sy := source/m.width + dy
+						w := weights[q]
+						pix := img.Pix[img.PixOffset(sx, sy):][:4]
+						for c := 0; c < 4; c++ {
+							sums[c] += w * float64(pix[c])
+						}
+						total += w
+					}
+				}
+				if total == 0 {
+					continue
+				}
+				out := voted[img.PixOffset(x, y):][:4]
+				for c := 0; c < 4; c++ {
+					out[c] = uint8(math.Round(sums[c] / total))
+				}
+			}
+		}
+	})
+	img.Pix = voted
+}
+
+// patchMatchFill fills the hole of `level` in place, with a coarse to fine
+// PatchMatch search and expectation-maximization voting.
+func patchMatchFill(level *pmLevel, opts *PatchMatchOpts) error {
+	if opts == nil {
+		opts = NewPatchMatchOpts()
+	}
+	if opts.PatchSize > MaxPatchSize {
+		return fmt.Errorf("%w: %d, at most %d", ErrPatchSizeTooLarge,
+			opts.PatchSize, MaxPatchSize)
+	}
+	radius := max(opts.PatchSize/2, 1)
+	minLevelSize := max(opts.MinLevelSize, 4*radius+2)
+
+	if !level.hasKnown() {
+		return errors.New("nothing to fill from: the mask covers the " +
+			"whole image")
+	}
+
+	pyramid := []*pmLevel{level}
+	for {
+		coarsest := pyramid[len(pyramid)-1]
+		if min(coarsest.width(), coarsest.height())/2 < minLevelSize {
+			break
+		}
+		// Thin known areas can vanish into the hole when downsampling.
+		coarser := coarsest.downsample()
+		if !coarser.hasKnown() {
+			break
+		}
+		pyramid = append(pyramid, coarser)
+	}
+
+	// The coarsest level is seeded by smoothly inpainting its hole.
+	coarsest := pyramid[len(pyramid)-1]
+	if inpaintErr := inpaintTelea(coarsest.img, coarsest.hole,
+		0); inpaintErr != nil {
+		return inpaintErr
+	}
+
+	var previous *patchMatcher
+	for depth := len(pyramid) - 1; depth >= 0; depth-- {
+		current := pyramid[depth]
+		if previous != nil {
+			// Start from the coarser level's fill, upsampled.
+			coarse := previous.level
+			parallelRows(0, current.height(), func(y0 int, y1 int) {
+				for y := y0; y < y1; y++ {
+					for x := 0; x < current.width(); x++ {
+						if !current.hole[y*current.width()+x] {
+							continue
+						}
+						copy(current.img.Pix[current.img.PixOffset(x, y):][:4],
+							coarse.img.Pix[coarse.img.PixOffset(x/2, y/2):][:4])
+					}
+				}
+			})
+		}
+		matcher := newPatchMatcher(current, radius)
+		if len(matcher.sources) == 0 {
+			// Too little of this level is known to take patches from.
+			previous = matcher
+			continue
+		}
+		var guess func(x int, y int) int32
+		if previous != nil && len(previous.sources) > 0 {
+			guess = func(x int, y int) int32 {
+				qx, qy := min(x/2, previous.width-1), min(y/2, previous.height-1)
+				q := qy*previous.width + qx
+				if !previous.target[q] {
+					return -1
+				}
+				source := int(previous.nnf[q])
+				sx := source%previous.width*2 + x - qx*2
+				sy := source/previous.width*2 + y - qy*2
+				if sx >= matcher.width || sy >= matcher.height {
+					return -1
+				}
+				return int32(sy*matcher.width + sx)
+			}
+		}
+		seed := opts.Seed ^ int64(depth)<<48
+		matcher.initialize(guess, seed)
+		pass := 1
+		for step := 0; step < opts.EMSteps; step++ {
+			for iteration := 0; iteration < opts.Iterations; iteration++ {
+				matcher.iterate(seed, pass)
+				pass++
+			}
+			matcher.vote()
+			matcher.measure()
+		}
+		previous = matcher
+	}
+	return nil
+}
+
+// PatchMatchFill fills the masked region of `img` with texture synthesized
+// from the rest of the image, using PatchMatch to find similar patches, and
+// returns the result as a new image. Pixels where `mask` is under half of
+// full intensity are filled, as outpaint masks mark the area to generate
+// black. If `opts` is nil, NewPatchMatchOpts is used.
+func PatchMatchFill(
+	img image.Image,
+	mask image.Image,
+	opts *PatchMatchOpts,
+) (*image.NRGBA, error) {
+	bounds := img.Bounds()
+	if mask.Bounds().Size() != bounds.Size() {
+		return nil, fmt.Errorf("mask is %v, but the image is %v",
+			mask.Bounds().Size(), bounds.Size())
+	}
+	level := &pmLevel{
+		img:  image.NewNRGBA(image.Rectangle{Max: bounds.Size()}),
+		hole: maskGenerated(mask),
+	}
+	draw.Draw(level.img, level.img.Bounds(), img, bounds.Min, draw.Src)
+	if fillErr := patchMatchFill(level, opts); fillErr != nil {
+		return nil, fillErr
+	}
+	return level.img, nil
+}
+
+// ContentAwareFillImage decodes `src` and `mask`, fills the masked region of
+// the image with PatchMatchFill, and returns it encoded as a PNG.
+func ContentAwareFillImage(
+	src *[]byte,
+	mask *[]byte,
+	opts *PatchMatchOpts,
+) (filled *[]byte, err error) {
+	img, _, _, decodeErr := DecodeImage(src)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	maskImg, _, _, maskErr := DecodeImage(mask)
+	if maskErr != nil {
+		return nil, maskErr
+	}
+	filledImg, fillErr := PatchMatchFill(img, maskImg, opts)
+	if fillErr != nil {
+		return nil, fillErr
+	}
+	return EncodePng(filledImg, png.BestSpeed)
+}
+
+// PatchMatchFiller fills the extended area with PatchMatchFill, synthesizing
+// texture that looks like the source rather than mirroring it. If `Opts` is
+// nil, NewPatchMatchOpts is used. A zero seed is drawn from the fill
+// context's randomness, so that it follows the outpaint's seed.
+type PatchMatchFiller struct {
+	Opts *PatchMatchOpts
+}
+
+func (PatchMatchFiller) Name() string { return "patchmatch" }
+
+func (f PatchMatchFiller) Fill(ctx *OutpaintFillContext) (*image.NRGBA, error) {
+	opts := NewPatchMatchOpts()
+	opts.Seed = 0
+	if f.Opts != nil {
+		copied := *f.Opts
+		opts = &copied
+	}
+	if opts.Seed == 0 && ctx.Rand != nil {
+		opts.Seed = ctx.Rand.Int63()
+	}
+	bounds := ctx.Canvas.Bounds()
+	level := &pmLevel{
+		img: &image.NRGBA{
+			Pix:    ctx.Canvas.Pix,
+			Stride: ctx.Canvas.Stride,
+			Rect:   image.Rectangle{Max: bounds.Size()},
+		},
+		hole: make([]bool, bounds.Dx()*bounds.Dy()),
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			level.hole[(y-bounds.Min.Y)*bounds.Dx()+x-bounds.Min.X] =
+				!(image.Point{X: x, Y: y}).In(ctx.Placement)
+		}
+	}
+	if fillErr := patchMatchFill(level, opts); fillErr != nil {
+		return nil, fillErr
+	}
+	// Voting replaces the pixel buffer.
+	canvas := &image.NRGBA{Pix: level.img.Pix, Stride: level.img.Stride,
+		Rect: bounds}
+	return finishFill(ctx, canvas)
+}
+
+func init() {
+	RegisterOutpaintFiller(PatchMatchFiller{})
+}
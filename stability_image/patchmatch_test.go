@@ -0,0 +1,129 @@
+package stability_image
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// checkerboard returns an image of 8 pixel red and blue squares.
+func checkerboard(width int, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if (x/8+y/8)%2 == 0 {
+				img.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+			} else {
+				img.SetNRGBA(x, y, color.NRGBA{B: 255, A: 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestPatchMatchFill(t *testing.T) {
+	// A hole in a repetitive texture should be filled with the texture's
+	// colors, rather than blended between them.
+	img := checkerboard(96, 96)
+	hole := image.Rect(32, 32, 64, 64)
+	mask := holeMask(img.Bounds(), hole)
+	for y := hole.Min.Y; y < hole.Max.Y; y++ {
+		for x := hole.Min.X; x < hole.Max.X; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{G: 255, A: 255})
+		}
+	}
+	opts := NewPatchMatchOpts()
+	filled, err := PatchMatchFill(img, mask, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pure := 0
+	for y := hole.Min.Y; y < hole.Max.Y; y++ {
+		for x := hole.Min.X; x < hole.Max.X; x++ {
+			c := filled.NRGBAAt(x, y)
+			if c.G > 64 {
+				t.Fatal("hole pixel", x, y, "kept the hole's color", c)
+			}
+			if c.R > 224 && c.B < 32 || c.B > 224 && c.R < 32 {
+				pure++
+			}
+		}
+	}
+	if pure < hole.Dx()*hole.Dy()*3/4 {
+		t.Error("only", pure, "of the hole's pixels are texture colors")
+	}
+	if filled.NRGBAAt(0, 0) != img.NRGBAAt(0, 0) {
+		t.Error("a known pixel was changed")
+	}
+
+	again, err := PatchMatchFill(img, mask, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(filled.Pix, again.Pix) {
+		t.Error("the fill is not deterministic for a seed")
+	}
+
+	// Patches too large for their distances to be summed are rejected.
+	opts.PatchSize = MaxPatchSize + 1
+	if _, err = PatchMatchFill(img, mask, opts); !errors.Is(err,
+		ErrPatchSizeTooLarge) {
+		t.Error("large patch size was not rejected", err)
+	}
+}
+
+func TestContentAwareFillImage(t *testing.T) {
+	os.MkdirAll(OutputDir, 0755)
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, _, err := DecodeImage(&imageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := img.Bounds().Size()
+	mask := holeMask(img.Bounds(), image.Rect(size.X/3, size.Y/3,
+		size.X*2/3, size.Y*2/3))
+	maskData, err := EncodePng(mask, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filled, err := ContentAwareFillImage(&imageData, maskData, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(OutputDir+"/inpaint_patchmatch.png", *filled,
+		os.ModePerm)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// benchmarkPatchMatch fills the right half of an image of MaxPixels, as an
+// outpaint doubling the width would.
+func benchmarkPatchMatch(b *testing.B, width int, height int) {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for idx := range img.Pix {
+		img.Pix[idx] = uint8(idx*7 + idx/4096)
+	}
+	mask := holeMask(img.Bounds(), image.Rect(width/2, 0, width, height))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := PatchMatchFill(img, mask, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPatchMatchFillLandscape(b *testing.B) {
+	benchmarkPatchMatch(b, 1024, int(MaxPixels/1024))
+}
+
+func BenchmarkPatchMatchFillPortrait(b *testing.B) {
+	benchmarkPatchMatch(b, int(MaxPixels/1024), 1024)
+}
@@ -0,0 +1,349 @@
+package stability_image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+var ErrTooManySeams = errors.New("retargeting needs too many seams")
+
+const (
+	// DefaultSeamCarveMaxRatio is the largest share of an axis seam carving
+	// removes or inserts before the content distorts too much.
+	DefaultSeamCarveMaxRatio = 0.3
+	// seamProtectEnergy is added to the energy of protected pixels, so that
+	// seams only cross them when there is no way around.
+	seamProtectEnergy = 1 << 20
+)
+
+type SeamCarveOpts struct {
+	// Protect, if set, marks the pixels seams should keep clear of, such
+	// as faces or subjects, where it is at least half of full intensity.
+	// It is the size of the source.
+	Protect image.Image
+	// Insert widens the short axis by inserting seams, rather than
+	// narrowing the long axis by removing them.
+	Insert bool
+	// MaxRatio is the largest share of the carved axis to remove or insert.
+	MaxRatio float64
+}
+
+func NewSeamCarveOpts() *SeamCarveOpts {
+	return &SeamCarveOpts{
+		MaxRatio: DefaultSeamCarveMaxRatio,
+	}
+}
+
+// seamCarver removes and inserts vertical seams of an image in place. Rows
+// keep their original stride, and the image narrows or widens within it.
+type seamCarver struct {
+	width   int
+	height  int
+	stride  int
+	pix     []uint8
+	protect []bool
+	energy  []float64
+	// origin is the column each pixel started out in, for insertion.
+	origin []int
+}
+
+func newSeamCarver(
+	img *image.NRGBA,
+	protect []bool,
+	capacity int,
+) *seamCarver {
+	size := img.Bounds().Size()
+	c := &seamCarver{
+		width:   size.X,
+		height:  size.Y,
+		stride:  capacity,
+		pix:     make([]uint8, capacity*size.Y*4),
+		protect: make([]bool, capacity*size.Y),
+		energy:  make([]float64, capacity*size.Y),
+		origin:  make([]int, capacity*size.Y),
+	}
+	for y := 0; y < size.Y; y++ {
+		copy(c.pix[y*capacity*4:], img.Pix[y*img.Stride:][:size.X*4])
+		for x := 0; x < size.X; x++ {
+			c.origin[y*capacity+x] = x
+			if protect != nil {
+				c.protect[y*capacity+x] = protect[y*size.X+x]
+			}
+		}
+	}
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			c.updateEnergy(x, y)
+		}
+	}
+	return c
+}
+
+// updateEnergy computes the dual gradient energy of a pixel, clamping at
+// the edges.
+func (c *seamCarver) updateEnergy(x int, y int) {
+	at := func(x int, y int) []uint8 {
+		x = clampCoord(x, 0, c.width)
+		y = clampCoord(y, 0, c.height)
+		return c.pix[(y*c.stride+x)*4:][:4]
+	}
+	left, right, up, down := at(x-1, y), at(x+1, y), at(x, y-1), at(x, y+1)
+	energy := 0.0
+	for channel := 0; channel < 3; channel++ {
+		energy += math.Abs(float64(right[channel])-float64(left[channel])) +
+			math.Abs(float64(down[channel])-float64(up[channel]))
+	}
+	if c.protect[y*c.stride+x] {
+		energy += seamProtectEnergy
+	}
+	c.energy[y*c.stride+x] = energy
+}
+
+// findSeam returns the column of the lowest energy vertical seam in each
+// row, moving at most one column between rows.
+func (c *seamCarver) findSeam() []int {
+	costs := make([]float64, c.width*c.height)
+	from := make([]int8, c.width*c.height)
+	copy(costs, c.energy[:c.width])
+	for y := 1; y < c.height; y++ {
+		above := costs[(y-1)*c.width:][:c.width]
+		row := costs[y*c.width:][:c.width]
+		for x := 0; x < c.width; x++ {
+			best, step := above[x], int8(0)
+			if x > 0 && above[x-1] < best {
+				best, step = above[x-1], -1
+			}
+			if x < c.width-1 && above[x+1] < best {
+				best, step = above[x+1], 1
+			}
+			row[x] = best + c.energy[y*c.stride+x]
+			from[y*c.width+x] = step
+		}
+	}
+	seam := make([]int, c.height)
+	last := costs[(c.height-1)*c.width:][:c.width]
+	for x := range last {
+		if last[x] < last[seam[c.height-1]] {
+			seam[c.height-1] = x
+		}
+	}
+	for y := c.height - 1; y > 0; y-- {
+		seam[y-1] = seam[y] + int(from[y*c.width+seam[y]])
+	}
+	return seam
+}
+
+// removeSeam removes `seam` and updates the energy along it.
+func (c *seamCarver) removeSeam(seam []int) {
+	for y, x := range seam {
+		row := y * c.stride
+		copy(c.pix[(row+x)*4:(row+c.width-1)*4], c.pix[(row+x+1)*4:])
+		copy(c.protect[row+x:row+c.width-1], c.protect[row+x+1:])
+		copy(c.energy[row+x:row+c.width-1], c.energy[row+x+1:])
+		copy(c.origin[row+x:row+c.width-1], c.origin[row+x+1:])
+	}
+	c.width--
+	for y, x := range seam {
+		for _, column := range []int{x - 1, x} {
+			if column >= 0 && column < c.width {
+				c.updateEnergy(column, y)
+			}
+		}
+	}
+}
+
+// insertSeams widens the carver by `count` seams: the lowest energy seams
+// are found by removing them from a copy, and each is then duplicated in
+// place, blended with its right neighbour.
+func (c *seamCarver) insertSeams(count int) {
+	scratch := &seamCarver{
+		width:   c.width,
+		height:  c.height,
+		stride:  c.stride,
+		pix:     append([]uint8(nil), c.pix...),
+		protect: append([]bool(nil), c.protect...),
+		energy:  append([]float64(nil), c.energy...),
+		origin:  append([]int(nil), c.origin...),
+	}
+	// inserted counts how many seams are inserted after each column of
+	// each row.
+	inserted := make([]int, c.width*c.height)
+	for seams := 0; seams < count; seams++ {
+		seam := scratch.findSeam()
+		for y, x := range seam {
+			inserted[y*c.width+scratch.origin[y*scratch.stride+x]]++
+		}
+		scratch.removeSeam(seam)
+	}
+
+	width := c.width + count
+	for y := 0; y < c.height; y++ {
+		row := y * c.stride
+		pix := append([]uint8(nil), c.pix[row*4:(row+c.width)*4]...)
+		protect := append([]bool(nil), c.protect[row:row+c.width]...)
+		to := 0
+		for x := 0; x < c.width; x++ {
+			copy(c.pix[(row+to)*4:][:4], pix[x*4:][:4])
+			c.protect[row+to] = protect[x]
+			to++
+			next := pix[min(x+1, c.width-1)*4:][:4]
+			for copies := 0; copies < inserted[y*c.width+x]; copies++ {
+				for channel := 0; channel < 4; channel++ {
+					c.pix[(row+to)*4+channel] = uint8((int(pix[x*4+channel]) +
+						int(next[channel]) + 1) / 2)
+				}
+				c.protect[row+to] = protect[x]
+				to++
+			}
+		}
+	}
+	c.width = width
+	for y := 0; y < c.height; y++ {
+		for x := 0; x < c.width; x++ {
+			c.origin[y*c.stride+x] = x
+			c.updateEnergy(x, y)
+		}
+	}
+}
+
+func (c *seamCarver) image() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, c.width, c.height))
+	for y := 0; y < c.height; y++ {
+		copy(img.Pix[y*img.Stride:], c.pix[y*c.stride*4:][:c.width*4])
+	}
+	return img
+}
+
+// carveWidth removes or inserts vertical seams of `img` until it is `width`
+// wide, keeping clear of `protect` where it can.
+func carveWidth(img *image.NRGBA, protect []bool, width int) *image.NRGBA {
+	size := img.Bounds().Size()
+	carver := newSeamCarver(img, protect, max(size.X, width))
+	if width > size.X {
+		carver.insertSeams(width - size.X)
+	}
+	for carver.width > width {
+		carver.removeSeam(carver.findSeam())
+	}
+	return carver.image()
+}
+
+// seamCarvePlan returns the size a source of `srcDim` is scaled to before
+// seams are carved out of it or into it to reach `target`, and whether the
+// seams run vertically, carving its width.
+func seamCarvePlan(
+	srcDim image.Point,
+	target image.Point,
+	insert bool,
+) (scaled image.Point, vertical bool) {
+	wider := srcDim.X*target.Y > srcDim.Y*target.X
+	// Removing seams from a wider source, or inserting them into a taller
+	// one, carves its width with the height fitted to the target's.
+	vertical = wider != insert
+	if vertical {
+		return image.Point{X: fitLength(target.Y, srcDim.X, srcDim.Y),
+			Y: target.Y}, true
+	}
+	return image.Point{X: target.X,
+		Y: fitLength(target.X, srcDim.Y, srcDim.X)}, false
+}
+
+// SeamCarveRatio returns the share of the carved axis that retargeting a
+// source of `srcDim` to `target` with SeamCarve removes or inserts.
+func SeamCarveRatio(
+	srcDim image.Point,
+	target image.Point,
+	insert bool,
+) float64 {
+	scaled, vertical := seamCarvePlan(srcDim, target, insert)
+	if vertical {
+		return math.Abs(float64(scaled.X-target.X)) / float64(scaled.X)
+	}
+	return math.Abs(float64(scaled.Y-target.Y)) / float64(scaled.Y)
+}
+
+// SeamCarve retargets `img` to `target` without generating any content:
+// the image is scaled to fit the target along one axis, and low energy
+// seams are removed from, or inserted into, the other until it fits.
+func SeamCarve(
+	img image.Image,
+	target image.Point,
+	opts *SeamCarveOpts,
+) (*image.NRGBA, error) {
+	if opts == nil {
+		opts = NewSeamCarveOpts()
+	}
+	srcDim := img.Bounds().Size()
+	if srcDim.X <= 0 || srcDim.Y <= 0 || target.X <= 0 || target.Y <= 0 {
+		return nil, fmt.Errorf("cannot seam carve %v to %v", srcDim, target)
+	}
+	if opts.Protect != nil && opts.Protect.Bounds().Size() != srcDim {
+		return nil, fmt.Errorf("%w: protection mask is %v, but the image "+
+			"is %v", ErrGeometryMismatch, opts.Protect.Bounds().Size(), srcDim)
+	}
+	maxRatio := opts.MaxRatio
+	if maxRatio <= 0 {
+		maxRatio = DefaultSeamCarveMaxRatio
+	}
+	if ratio := SeamCarveRatio(srcDim, target, opts.Insert); ratio >
+		maxRatio {
+		return nil, fmt.Errorf("%w: %.0f%% of %v to reach %v",
+			ErrTooManySeams, ratio*100, srcDim, target)
+	}
+
+	scaled, vertical := seamCarvePlan(srcDim, target, opts.Insert)
+	resized := imaging.Resize(img, scaled.X, scaled.Y, imaging.Lanczos)
+	var protect []bool
+	if opts.Protect != nil {
+		protect = inpaintMasked(imaging.Resize(opts.Protect, scaled.X,
+			scaled.Y, imaging.Linear))
+	}
+	if vertical {
+		return carveWidth(resized, protect, target.X), nil
+	}
+
+	// Carve the height as the width of the transposed image.
+	var transposedProtect []bool
+	if protect != nil {
+		transposedProtect = make([]bool, len(protect))
+		for y := 0; y < scaled.Y; y++ {
+			for x := 0; x < scaled.X; x++ {
+				transposedProtect[x*scaled.Y+y] = protect[y*scaled.X+x]
+			}
+		}
+	}
+	carved := carveWidth(imaging.Transpose(resized), transposedProtect,
+		target.Y)
+	return imaging.Transpose(carved), nil
+}
+
+// SeamCarveImage decodes `src`, retargets it to `targetWidth` by
+// `targetHeight` with SeamCarve, and returns it encoded as a PNG.
+func SeamCarveImage(
+	src *[]byte,
+	targetWidth int,
+	targetHeight int,
+	opts *SeamCarveOpts,
+) (
+	carved *[]byte,
+	srcDim *image.Point,
+	format string,
+	err error,
+) {
+	img, format, srcDim, err := DecodeImage(src)
+	if err != nil {
+		return nil, nil, format, err
+	}
+	retargeted, err := SeamCarve(img, image.Point{X: targetWidth,
+		Y: targetHeight}, opts)
+	if err != nil {
+		return nil, srcDim, format, err
+	}
+	carved, err = EncodePng(retargeted, png.BestSpeed)
+	return carved, srcDim, format, err
+}
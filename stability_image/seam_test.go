@@ -0,0 +1,129 @@
+package stability_image
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSeamCarve(t *testing.T) {
+	aspects := NewAspectRatios(1048576, 64, 256, 1536)
+	square, ok := aspects.Table["1:1"]
+	if !ok {
+		t.Fatal("no 1:1 aspect ratio")
+	}
+	target := image.Point{X: int(square.WidthPixels),
+		Y: int(square.HeightPixels)}
+
+	// Removing seams from a strip with detail on its right keeps the detail
+	// and takes the flat gray instead.
+	strip := detailedStrip(image.Point{X: 1200, Y: 1000}, 900)
+	carved, err := SeamCarve(strip, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if carved.Bounds().Size() != target {
+		t.Fatal("carved to", carved.Bounds().Size())
+	}
+	detail := 0
+	for x := 0; x < target.X; x++ {
+		if level := carved.NRGBAAt(x, target.Y/2).R; level < 120 ||
+			level > 136 {
+			detail++
+		}
+	}
+	// The detail is 300 of the 1200 columns, scaled to 1024 high.
+	if want := 300 * target.Y / 1000; detail < want*9/10 {
+		t.Error("carving lost detail:", detail, "of", want, "columns")
+	}
+
+	// Inserting seams into a tall image widens it. Seams run through its
+	// flat subject unless it is protected, and then keep clear of it.
+	tall := detailedStrip(image.Point{X: 900, Y: 1000}, 0)
+	protect := image.NewGray(tall.Bounds())
+	for y := 0; y < 1000; y++ {
+		for x := 400; x < 500; x++ {
+			tall.SetNRGBA(x, y, color.NRGBA{255, 0, 0, 255})
+			protect.SetGray(x, y, color.Gray{Y: 0xff})
+		}
+	}
+	want := 100 * target.Y / 1000
+	for _, protected := range []bool{false, true} {
+		opts := NewSeamCarveOpts()
+		opts.Insert = true
+		if protected {
+			opts.Protect = protect
+		}
+		widened, carveErr := SeamCarve(tall, target, opts)
+		if carveErr != nil {
+			t.Fatal(carveErr)
+		}
+		if widened.Bounds().Size() != target {
+			t.Fatal("widened to", widened.Bounds().Size())
+		}
+		red := 0
+		for x := 0; x < target.X; x++ {
+			if pixel := widened.NRGBAAt(x, target.Y/2); pixel.R > 200 &&
+				pixel.G < 50 {
+				red++
+			}
+		}
+		if protected != (red >= want-2 && red <= want+2) {
+			t.Error("subject is", red, "columns wide, protected:",
+				protected)
+		}
+	}
+
+	raw, err := EncodePng(strip, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carvedData, srcDim, format, err := SeamCarveImage(raw, target.X,
+		target.Y, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *srcDim != strip.Bounds().Size() || format != "png" {
+		t.Error("unexpected source", *srcDim, format)
+	}
+	os.MkdirAll(OutputDir, 0755)
+	if err = ioutil.WriteFile(OutputDir+"/seam_carve.png", *carvedData,
+		0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wide := image.NewNRGBA(image.Rect(0, 0, 2000, 1000))
+	if _, err = SeamCarve(wide, target, nil); !errors.Is(err,
+		ErrTooManySeams) {
+		t.Error("too many seams were not reported", err)
+	}
+
+	// Seam carving is offered alongside outpainting for the aspect ratios
+	// it can reach.
+	filter := strip.Bounds().Size()
+	filtered := aspects.FilterByOutpaintWithOpts(filter,
+		aspects.GetSortedByNearest(filter),
+		&FilterOutpaintOpts{SeamCarve: true})
+	offered := map[string]bool{}
+	for _, aspect := range filtered {
+		for _, outpaint := range aspect.Outpaints {
+			if outpaint.Action == OutpaintSeamCarve {
+				offered[aspect.AspectRatio.Label] = true
+			}
+		}
+	}
+	if !offered["1:1"] || offered["9:16"] {
+		t.Error("unexpected seam carving offers", offered)
+	}
+	for _, aspect := range aspects.FilterByOutpaint(filter,
+		aspects.GetSortedByNearest(filter)) {
+		for _, outpaint := range aspect.Outpaints {
+			if outpaint.Action == OutpaintSeamCarve {
+				t.Error("seam carving offered without opts")
+			}
+		}
+	}
+}
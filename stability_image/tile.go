@@ -0,0 +1,451 @@
+package stability_image
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+var (
+	ErrNoTileSize       = errors.New("no tile size fits the pixel budget")
+	ErrUnknownTileBlend = errors.New("unknown tile blend")
+)
+
+const (
+	// DefaultTileOverlap is the least number of pixels neighbouring tiles
+	// share, for their seam to be blended across.
+	DefaultTileOverlap = 128
+	// DefaultTileBands is the number of frequency bands of
+	// TileBlendMultiBand.
+	DefaultTileBands = 4
+)
+
+// TileBlend is how the overlapping tiles of a TilePlan are blended back
+// together.
+type TileBlend int
+
+const (
+	// TileBlendLinear cross-fades neighbouring tiles across their overlap.
+	TileBlendLinear TileBlend = iota
+	// TileBlendMultiBand cross-fades each frequency band of the tiles
+	// separately, low frequencies over a wider area than high ones, so that
+	// shifts in tone blend in without ghosting the details.
+	TileBlendMultiBand
+)
+
+func (b TileBlend) String() string {
+	return [...]string{"linear", "multiband"}[b]
+}
+
+func (b *TileBlend) FromString(s string) {
+	switch s {
+	case "linear":
+		*b = TileBlendLinear
+	case "multiband", "multi-band", "laplacian":
+		*b = TileBlendMultiBand
+	}
+}
+
+func (b TileBlend) MarshalText() ([]byte, error) {
+	if b < TileBlendLinear || b > TileBlendMultiBand {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownTileBlend, int(b))
+	}
+	return []byte(b.String()), nil
+}
+
+func (b *TileBlend) UnmarshalText(text []byte) error {
+	parsed := TileBlend(-1)
+	parsed.FromString(string(text))
+	if parsed < 0 {
+		return fmt.Errorf("%w: %q", ErrUnknownTileBlend, text)
+	}
+	*b = parsed
+	return nil
+}
+
+type TileOpts struct {
+	// Aspects holds the pixel budget and the dimension limits and step
+	// tiles are generated within. If nil, MaxPixels, DimensionStep,
+	// MinDimension and MaxDimension are used.
+	Aspects *AspectRatios
+	// Overlap is the least number of pixels neighbouring tiles share. It is
+	// capped at half a tile.
+	Overlap int
+	// Scale is how much larger than its crop each tile is returned, such as
+	// the factor of an upscaler.
+	Scale float64
+	// Blend is how the tiles are blended back together, and Bands the
+	// number of frequency bands of TileBlendMultiBand.
+	Blend TileBlend
+	Bands int
+	// Falloff is the shape of the cross-fade across each overlap.
+	Falloff MaskFalloff
+}
+
+func NewTileOpts() *TileOpts {
+	return &TileOpts{
+		Overlap: DefaultTileOverlap,
+		Scale:   1,
+		Blend:   TileBlendMultiBand,
+		Bands:   DefaultTileBands,
+	}
+}
+
+// TileFeather is the width of a tile's overlap with its neighbour on each
+// side, across which the tile is cross-faded into the neighbour. Sides at
+// the edge of the image are 0.
+type TileFeather struct {
+	Left   int `json:"left"`
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+}
+
+// scale returns the feather of a tile scaled by `scale` to `size`.
+func (f TileFeather) scale(scale float64, size image.Point) TileFeather {
+	side := func(width int, length int) int {
+		return min(length, int(math.Round(float64(width)*scale)))
+	}
+	return TileFeather{
+		Left:   side(f.Left, size.X),
+		Top:    side(f.Top, size.Y),
+		Right:  side(f.Right, size.X),
+		Bottom: side(f.Bottom, size.Y),
+	}
+}
+
+// Tile is a single generation of a TilePlan: the part of the image in
+// `Rect` is generated at `Size`.
+type Tile struct {
+	// Rect is the crop of the image the tile covers.
+	Rect image.Rectangle `json:"rect"`
+	// Size is the size the tile is generated at, which is the size of its
+	// crop unless the image is too small to snap it to DimensionStep.
+	Size image.Point `json:"size"`
+	// Feather is how far the tile overlaps its neighbours.
+	Feather TileFeather `json:"feather"`
+}
+
+// TilePlan splits an image too large to generate at once into overlapping
+// tiles within the pixel budget, and blends the generated tiles back into a
+// single image. Tiles are laid out in rows, from the top left.
+type TilePlan struct {
+	// Size is the size of the image.
+	Size image.Point `json:"size"`
+	// Columns and Rows are the number of tiles across and down the image.
+	Columns int `json:"columns"`
+	Rows    int `json:"rows"`
+	// Scale is how much larger than its crop each tile is returned.
+	Scale float64 `json:"scale"`
+	// Blend is how the tiles are blended back together, and Bands the
+	// number of frequency bands of TileBlendMultiBand.
+	Blend TileBlend `json:"blend"`
+	Bands int       `json:"bands"`
+	// Falloff is the shape of the cross-fade across each overlap.
+	Falloff MaskFalloff `json:"falloff"`
+	Tiles   []Tile      `json:"tiles"`
+}
+
+// tileSpans lays tiles of `tile` out along a side of `length`, spread
+// evenly so that neighbours share at least `overlap`, and returns where
+// each starts. If the side fits in a single tile, the tile is shortened to
+// `length`.
+func tileSpans(length int, tile int, overlap int) (starts []int, span int) {
+	if length <= tile {
+		return []int{0}, length
+	}
+	count := (length - overlap + tile - overlap - 1) / (tile - overlap)
+	starts = make([]int, count)
+	for idx := range starts {
+		starts[idx] = idx * (length - tile) / (count - 1)
+	}
+	return starts, tile
+}
+
+// tileLength returns the length a tile spanning `span` is generated at:
+// the span itself if it is a full tile, and otherwise the span snapped up
+// to `step`, within the dimension limits.
+func tileLength(span int, tile int, step int, minDimension int) int {
+	if span == tile {
+		return tile
+	}
+	return min(tile, max(minDimension,
+		int(NearestUp(uint64(span), uint64(step)))))
+}
+
+// PlanTiles splits an image of `size` into the fewest overlapping tiles
+// that fit within the pixel budget of `opts.Aspects`, each snapped to its
+// DimensionStep. Of the tilings with as few tiles, the one generating the
+// fewest pixels, then the squarest, is used.
+func PlanTiles(size image.Point, opts *TileOpts) (*TilePlan, error) {
+	if opts == nil {
+		opts = NewTileOpts()
+	}
+	if size.X <= 0 || size.Y <= 0 {
+		return nil, fmt.Errorf("cannot tile %v", size)
+	}
+	maxPixels, step := MaxPixels, DimensionStep
+	minDimension, maxDimension := MinDimension, MaxDimension
+	if opts.Aspects != nil {
+		maxPixels, step = opts.Aspects.MaxPixels, opts.Aspects.DimensionStep
+		minDimension = opts.Aspects.MinDimension
+		maxDimension = opts.Aspects.MaxDimension
+	}
+	if step == 0 {
+		return nil, fmt.Errorf("%w: dimension step is 0", ErrNoTileSize)
+	}
+	overlap := opts.Overlap
+	if overlap < 0 {
+		overlap = DefaultTileOverlap
+	}
+	scale := opts.Scale
+	if scale <= 0 {
+		scale = 1
+	}
+
+	// Try every tile size within the limits.
+	lengths := make([]int, 0)
+	for length := NearestUp(max(minDimension, step), step); length <=
+		maxDimension; length += step {
+		lengths = append(lengths, int(length))
+	}
+	var plan *TilePlan
+	var best struct{ count, pixels, squareness int }
+	for _, width := range lengths {
+		for _, height := range lengths {
+			if uint64(width*height) > maxPixels {
+				break
+			}
+			columns, spanX := tileSpans(size.X, width,
+				min(overlap, width/2))
+			rows, spanY := tileSpans(size.Y, height,
+				min(overlap, height/2))
+			generated := image.Point{
+				X: tileLength(spanX, width, int(step), int(minDimension)),
+				Y: tileLength(spanY, height, int(step), int(minDimension)),
+			}
+			count := len(columns) * len(rows)
+			pixels := count * generated.X * generated.Y
+			squareness := abs(generated.X - generated.Y)
+			if plan != nil && (count > best.count || count == best.count &&
+				(pixels > best.pixels || pixels == best.pixels &&
+					squareness >= best.squareness)) {
+				continue
+			}
+			best.count, best.pixels, best.squareness = count, pixels,
+				squareness
+			plan = &TilePlan{
+				Size:    size,
+				Columns: len(columns),
+				Rows:    len(rows),
+				Tiles:   make([]Tile, 0, count),
+			}
+			for row, y := range rows {
+				for column, x := range columns {
+					tile := Tile{
+						Rect: image.Rect(x, y, x+spanX, y+spanY),
+						Size: generated,
+					}
+					if column > 0 {
+						tile.Feather.Left = columns[column-1] + spanX - x
+					}
+					if column < len(columns)-1 {
+						tile.Feather.Right = x + spanX - columns[column+1]
+					}
+					if row > 0 {
+						tile.Feather.Top = rows[row-1] + spanY - y
+					}
+					if row < len(rows)-1 {
+						tile.Feather.Bottom = y + spanY - rows[row+1]
+					}
+					plan.Tiles = append(plan.Tiles, tile)
+				}
+			}
+		}
+	}
+	if plan == nil {
+		return nil, fmt.Errorf("%w: %d pixels between %d and %d by %d",
+			ErrNoTileSize, maxPixels, minDimension, maxDimension, step)
+	}
+	plan.Scale = scale
+	plan.Blend = opts.Blend
+	plan.Falloff = opts.Falloff
+	plan.Bands = 1
+	if plan.Blend == TileBlendMultiBand {
+		plan.Bands = opts.Bands
+		if plan.Bands <= 0 {
+			plan.Bands = DefaultTileBands
+		}
+		// Each band blends over twice the width of the one before, and the
+		// coarsest should still fit in the overlaps.
+		narrowest := math.MaxInt
+		for _, tile := range plan.Tiles {
+			for _, width := range []int{tile.Feather.Left, tile.Feather.Top,
+				tile.Feather.Right, tile.Feather.Bottom} {
+				if width > 0 {
+					narrowest = min(narrowest, width)
+				}
+			}
+		}
+		if narrowest < math.MaxInt {
+			scaled := max(1, int(float64(narrowest)*scale))
+			plan.Bands = max(1, min(plan.Bands, bitLength(scaled)))
+		}
+	}
+	return plan, nil
+}
+
+// bitLength returns the number of bits needed to represent `n`.
+func bitLength(n int) int {
+	length := 0
+	for ; n > 0; n >>= 1 {
+		length++
+	}
+	return length
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// tileWeights returns the weights a tile of `size` is blended with: 0xffff
+// away from its neighbours, falling off with `falloff` across each overlap
+// towards the tile's edge, but never quite to 0.
+func tileWeights(
+	size image.Point,
+	feather TileFeather,
+	falloff MaskFalloff,
+) *image.Gray16 {
+	ramp := func(length int, lo int, hi int) []float64 {
+		weights := make([]float64, length)
+		for idx := range weights {
+			weights[idx] = 1
+			if idx < lo {
+				weights[idx] *= falloff.Weight((float64(idx) + 0.5) /
+					float64(lo))
+			}
+			if fromEnd := length - 1 - idx; fromEnd < hi {
+				weights[idx] *= falloff.Weight((float64(fromEnd) + 0.5) /
+					float64(hi))
+			}
+		}
+		return weights
+	}
+	across := ramp(size.X, feather.Left, feather.Right)
+	down := ramp(size.Y, feather.Top, feather.Bottom)
+	weights := image.NewGray16(image.Rectangle{Max: size})
+	for y, weightY := range down {
+		for x, weightX := range across {
+			value := uint16(max(1, math.Round(weightX*weightY*0xffff)))
+			offset := weights.PixOffset(x, y)
+			weights.Pix[offset] = uint8(value >> 8)
+			weights.Pix[offset+1] = uint8(value)
+		}
+	}
+	return weights
+}
+
+func (p *TilePlan) checkTile(index int) error {
+	if index < 0 || index >= len(p.Tiles) {
+		return fmt.Errorf("no tile %d of %d", index, len(p.Tiles))
+	}
+	return nil
+}
+
+// FeatherMask returns the weights tile `index` is blended with, at the size
+// of its crop.
+func (p *TilePlan) FeatherMask(index int) (*image.Gray16, error) {
+	if err := p.checkTile(index); err != nil {
+		return nil, err
+	}
+	tile := p.Tiles[index]
+	return tileWeights(tile.Rect.Size(), tile.Feather, p.Falloff), nil
+}
+
+// CropTile crops tile `index` out of `source` and scales it to the tile's
+// size, encoded as a PNG.
+func (p *TilePlan) CropTile(source image.Image, index int) (*[]byte, error) {
+	if err := p.checkTile(index); err != nil {
+		return nil, err
+	}
+	if size := source.Bounds().Size(); size != p.Size {
+		return nil, fmt.Errorf("%w: image is %v, not %v",
+			ErrGeometryMismatch, size, p.Size)
+	}
+	tile := p.Tiles[index]
+	cropped := imaging.Crop(source, tile.Rect.Add(source.Bounds().Min))
+	if tile.Size != tile.Rect.Size() {
+		cropped = imaging.Resize(cropped, tile.Size.X, tile.Size.Y,
+			imaging.Lanczos)
+	}
+	return EncodePng(cropped, png.BestSpeed)
+}
+
+// scaledRect returns `rect` scaled by the plan's scale.
+func (p *TilePlan) scaledRect(rect image.Rectangle) image.Rectangle {
+	scale := func(v int) int { return int(math.Round(float64(v) * p.Scale)) }
+	return image.Rect(scale(rect.Min.X), scale(rect.Min.Y), scale(rect.Max.X),
+		scale(rect.Max.Y))
+}
+
+// Composite blends `results`, the generated tiles in order, back into a
+// single image at the plan's scale. Each result is scaled to its crop at the
+// plan's scale before it is blended.
+func (p *TilePlan) Composite(results []image.Image) (*image.NRGBA, error) {
+	if len(results) != len(p.Tiles) {
+		return nil, fmt.Errorf("%d results for %d tiles", len(results),
+			len(p.Tiles))
+	}
+	canvas := p.scaledRect(image.Rectangle{Max: p.Size})
+	blender := newTileBlender(canvas.Size(), max(1, p.Bands))
+	for index, result := range results {
+		tile := p.Tiles[index]
+		rect := p.scaledRect(tile.Rect)
+		resultDim := result.Bounds().Size()
+		aspect := float64(tile.Size.X) / float64(tile.Size.Y)
+		if resultDim.X <= 0 || resultDim.Y <= 0 ||
+			math.Abs(float64(resultDim.X)/float64(resultDim.Y)-aspect) >
+				geometryAspectTolerance*aspect {
+			return nil, fmt.Errorf("%w: tile %d is %v, not the aspect ratio "+
+				"of %v", ErrGeometryMismatch, index, resultDim, tile.Size)
+		}
+		resized := imaging.Resize(result, rect.Dx(), rect.Dy(),
+			imaging.Lanczos)
+		feather := tile.Feather.scale(p.Scale, rect.Size())
+		blender.add(rect, resized, tileWeights(rect.Size(), feather,
+			p.Falloff))
+	}
+	return blender.result(), nil
+}
+
+// Run crops every tile out of `source`, generates each with `generate`, and
+// composites the results.
+func (p *TilePlan) Run(
+	source image.Image,
+	generate func(index int, tile *[]byte) (*[]byte, error),
+) (*image.NRGBA, error) {
+	results := make([]image.Image, 0, len(p.Tiles))
+	for index := range p.Tiles {
+		cropped, err := p.CropTile(source, index)
+		if err != nil {
+			return nil, err
+		}
+		generated, err := generate(index, cropped)
+		if err != nil {
+			return nil, err
+		}
+		result, _, _, err := DecodeImage(generated)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return p.Composite(results)
+}
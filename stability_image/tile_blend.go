@@ -0,0 +1,256 @@
+package stability_image
+
+import (
+	"image"
+	"math"
+)
+
+// tilePlane is a floating point image of `channels` over `rect`, in the
+// coordinates of a level of a tileBlender's pyramid.
+type tilePlane struct {
+	rect     image.Rectangle
+	channels int
+	pix      []float32
+}
+
+func newTilePlane(rect image.Rectangle, channels int) *tilePlane {
+	return &tilePlane{
+		rect:     rect,
+		channels: channels,
+		pix:      make([]float32, rect.Dx()*rect.Dy()*channels),
+	}
+}
+
+func (p *tilePlane) offset(x int, y int) int {
+	return ((y-p.rect.Min.Y)*p.rect.Dx() + x - p.rect.Min.X) * p.channels
+}
+
+// tileTap is a weighted sample of a resampling, at `index` relative to the
+// start of the source's axis.
+type tileTap struct {
+	index  int
+	weight float32
+}
+
+// pyramidKernel is the binomial kernel the pyramid levels are reduced and
+// expanded with.
+var pyramidKernel = [5]float32{1.0 / 16, 4.0 / 16, 6.0 / 16, 4.0 / 16,
+	1.0 / 16}
+
+// reduceTaps returns the taps reducing an axis spanning [`srcMin`,
+// `srcMax`) to half its resolution over [`dstMin`, `dstMax`), clamping at
+// its ends.
+func reduceTaps(dstMin int, dstMax int, srcMin int, srcMax int) [][]tileTap {
+	taps := make([][]tileTap, dstMax-dstMin)
+	for x := dstMin; x < dstMax; x++ {
+		row := make([]tileTap, 0, len(pyramidKernel))
+		for m, weight := range pyramidKernel {
+			row = append(row, tileTap{
+				index:  clampCoord(2*x+m-2, srcMin, srcMax) - srcMin,
+				weight: weight,
+			})
+		}
+		taps[x-dstMin] = row
+	}
+	return taps
+}
+
+// expandTaps returns the taps expanding an axis spanning [`srcMin`,
+// `srcMax`) to twice its resolution over [`dstMin`, `dstMax`), clamping at
+// its ends.
+func expandTaps(dstMin int, dstMax int, srcMin int, srcMax int) [][]tileTap {
+	taps := make([][]tileTap, dstMax-dstMin)
+	tap := func(parent int, weight float32) tileTap {
+		return tileTap{clampCoord(parent, srcMin, srcMax) - srcMin, weight}
+	}
+	for x := dstMin; x < dstMax; x++ {
+		if x%2 == 0 {
+			taps[x-dstMin] = []tileTap{tap(x/2-1, 2*pyramidKernel[0]),
+				tap(x/2, 2*pyramidKernel[2]), tap(x/2+1, 2*pyramidKernel[4])}
+		} else {
+			taps[x-dstMin] = []tileTap{tap((x-1)/2, 2*pyramidKernel[1]),
+				tap((x+1)/2, 2*pyramidKernel[3])}
+		}
+	}
+	return taps
+}
+
+// resample resamples `src` onto `dst` separably, with `across` along rows
+// and `down` along columns.
+func resample(
+	src *tilePlane,
+	dst image.Rectangle,
+	across [][]tileTap,
+	down [][]tileTap,
+) *tilePlane {
+	channels := src.channels
+	rows := newTilePlane(image.Rect(dst.Min.X, src.rect.Min.Y, dst.Max.X,
+		src.rect.Max.Y), channels)
+	parallelRows(src.rect.Min.Y, src.rect.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			from := src.pix[src.offset(src.rect.Min.X, y):]
+			to := rows.pix[rows.offset(dst.Min.X, y):]
+			for x, taps := range across {
+				for _, tap := range taps {
+					for c := 0; c < channels; c++ {
+						to[x*channels+c] += from[tap.index*channels+c] *
+							tap.weight
+					}
+				}
+			}
+		}
+	})
+	out := newTilePlane(dst, channels)
+	width := dst.Dx() * channels
+	parallelRows(dst.Min.Y, dst.Max.Y, func(y0 int, y1 int) {
+		for y := y0; y < y1; y++ {
+			to := out.pix[out.offset(dst.Min.X, y):][:width]
+			for _, tap := range down[y-dst.Min.Y] {
+				from := rows.pix[tap.index*width:][:width]
+				for x := range to {
+					to[x] += from[x] * tap.weight
+				}
+			}
+		}
+	})
+	return out
+}
+
+// halveRect returns the rectangle of the next level of a pyramid for
+// `rect`, whose minimum must be even.
+func halveRect(rect image.Rectangle) image.Rectangle {
+	return image.Rect(rect.Min.X/2, rect.Min.Y/2, (rect.Max.X+1)/2,
+		(rect.Max.Y+1)/2)
+}
+
+func reducePlane(src *tilePlane) *tilePlane {
+	dst := halveRect(src.rect)
+	return resample(src, dst,
+		reduceTaps(dst.Min.X, dst.Max.X, src.rect.Min.X, src.rect.Max.X),
+		reduceTaps(dst.Min.Y, dst.Max.Y, src.rect.Min.Y, src.rect.Max.Y))
+}
+
+func expandPlane(src *tilePlane, dst image.Rectangle) *tilePlane {
+	return resample(src, dst,
+		expandTaps(dst.Min.X, dst.Max.X, src.rect.Min.X, src.rect.Max.X),
+		expandTaps(dst.Min.Y, dst.Max.Y, src.rect.Min.Y, src.rect.Max.Y))
+}
+
+// tileBlender blends overlapping tiles into an image of `size` by their
+// weights, band by band over a Laplacian pyramid of `levels`. With a single
+// level, it is a weighted average of the tiles.
+type tileBlender struct {
+	levels  []image.Rectangle
+	sums    []*tilePlane
+	weights []*tilePlane
+}
+
+func newTileBlender(size image.Point, levels int) *tileBlender {
+	blender := &tileBlender{}
+	rect := image.Rectangle{Max: size}
+	for level := 0; level < levels; level++ {
+		blender.levels = append(blender.levels, rect)
+		blender.sums = append(blender.sums, newTilePlane(rect, 4))
+		blender.weights = append(blender.weights, newTilePlane(rect, 1))
+		rect = halveRect(rect)
+	}
+	return blender
+}
+
+// add blends `tile`, covering `rect` of the image, in by `weights`.
+func (b *tileBlender) add(
+	rect image.Rectangle,
+	tile *image.NRGBA,
+	weights *image.Gray16,
+) {
+	// Each level's pyramid is aligned to the image's, so that the tile's
+	// region is expanded to the coarsest level's grid, and the tile's edges
+	// are repeated across the expansion with no weight.
+	align := 1 << (len(b.levels) - 1)
+	region := image.Rect(
+		rect.Min.X/align*align, rect.Min.Y/align*align,
+		(rect.Max.X+align-1)/align*align, (rect.Max.Y+align-1)/align*align,
+	).Intersect(b.levels[0])
+	colors := newTilePlane(region, 4)
+	mask := newTilePlane(region, 1)
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		ty := clampCoord(y, rect.Min.Y, rect.Max.Y) - rect.Min.Y
+		for x := region.Min.X; x < region.Max.X; x++ {
+			tx := clampCoord(x, rect.Min.X, rect.Max.X) - rect.Min.X
+			from := tile.Pix[tile.PixOffset(tx, ty):][:4]
+			to := colors.pix[colors.offset(x, y):][:4]
+			for c := range to {
+				to[c] = float32(from[c])
+			}
+			if image.Pt(x, y).In(rect) {
+				offset := weights.PixOffset(tx, ty)
+				mask.pix[mask.offset(x, y)] = float32(
+					uint16(weights.Pix[offset])<<8|
+						uint16(weights.Pix[offset+1])) / 0xffff
+			}
+		}
+	}
+
+	for level := range b.levels {
+		var band *tilePlane
+		var next *tilePlane
+		if level < len(b.levels)-1 {
+			next = reducePlane(colors)
+			expanded := expandPlane(next, colors.rect)
+			band = newTilePlane(colors.rect, 4)
+			for idx := range band.pix {
+				band.pix[idx] = colors.pix[idx] - expanded.pix[idx]
+			}
+		} else {
+			band = colors
+		}
+		sums, totals := b.sums[level], b.weights[level]
+		for y := band.rect.Min.Y; y < band.rect.Max.Y; y++ {
+			for x := band.rect.Min.X; x < band.rect.Max.X; x++ {
+				weight := mask.pix[mask.offset(x, y)]
+				if weight == 0 {
+					continue
+				}
+				from := band.pix[band.offset(x, y):][:4]
+				to := sums.pix[sums.offset(x, y):][:4]
+				for c := range to {
+					to[c] += from[c] * weight
+				}
+				totals.pix[totals.offset(x, y)] += weight
+			}
+		}
+		if next != nil {
+			colors = next
+			mask = reducePlane(mask)
+		}
+	}
+}
+
+// result collapses the blended pyramid into an image.
+func (b *tileBlender) result() *image.NRGBA {
+	var collapsed *tilePlane
+	for level := len(b.levels) - 1; level >= 0; level-- {
+		sums, totals := b.sums[level], b.weights[level]
+		band := newTilePlane(b.levels[level], 4)
+		for idx, total := range totals.pix {
+			if total > 0 {
+				for c := 0; c < 4; c++ {
+					band.pix[idx*4+c] = sums.pix[idx*4+c] / total
+				}
+			}
+		}
+		if collapsed != nil {
+			expanded := expandPlane(collapsed, band.rect)
+			for idx := range band.pix {
+				band.pix[idx] += expanded.pix[idx]
+			}
+		}
+		collapsed = band
+	}
+	blended := image.NewNRGBA(b.levels[0])
+	for idx, value := range collapsed.pix {
+		blended.Pix[idx] = uint8(math.Max(0, math.Min(255,
+			math.Round(float64(value)))))
+	}
+	return blended
+}
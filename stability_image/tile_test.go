@@ -0,0 +1,227 @@
+package stability_image
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestPlanTiles(t *testing.T) {
+	aspects := NewAspectRatios(1048576, 64, 256, 1536)
+	opts := NewTileOpts()
+	opts.Aspects = &aspects
+	plan, err := PlanTiles(image.Point{X: 4096, Y: 2304}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Tiles) != plan.Columns*plan.Rows || len(plan.Tiles) > 12 {
+		t.Error("unexpected tiling", plan.Columns, "by", plan.Rows)
+	}
+	covered := image.Rectangle{}
+	for index, tile := range plan.Tiles {
+		if tile.Size.X%64 != 0 || tile.Size.Y%64 != 0 ||
+			tile.Size.X > 1536 || tile.Size.Y > 1536 ||
+			tile.Size.X*tile.Size.Y > 1048576 || tile.Size != tile.Rect.Size() {
+			t.Error("tile", index, "is generated at", tile.Size)
+		}
+		covered = covered.Union(tile.Rect)
+		column, row := index%plan.Columns, index/plan.Columns
+		if column > 0 {
+			left := plan.Tiles[index-1]
+			overlap := left.Rect.Max.X - tile.Rect.Min.X
+			if overlap < DefaultTileOverlap || tile.Feather.Left != overlap ||
+				left.Feather.Right != overlap {
+				t.Error("tile", index, "overlaps by", overlap, "feathering",
+					tile.Feather)
+			}
+		} else if tile.Feather.Left != 0 {
+			t.Error("tile", index, "is feathered at the edge", tile.Feather)
+		}
+		if row > 0 {
+			above := plan.Tiles[index-plan.Columns]
+			if overlap := above.Rect.Max.Y - tile.Rect.Min.Y; overlap <
+				DefaultTileOverlap || tile.Feather.Top != overlap {
+				t.Error("tile", index, "overlaps by", overlap, "feathering",
+					tile.Feather)
+			}
+		}
+	}
+	if covered != image.Rect(0, 0, 4096, 2304) {
+		t.Error("tiles cover", covered)
+	}
+
+	// A strip too thin to snap is generated at the least dimension.
+	plan, err = PlanTiles(image.Point{X: 3000, Y: 200}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Rows != 1 || plan.Tiles[0].Rect.Dy() != 200 ||
+		plan.Tiles[0].Size.Y != 256 {
+		t.Error("unexpected strip tiling", plan.Rows, plan.Tiles[0])
+	}
+
+	tiny := NewAspectRatios(1024, 64, 256, 1536)
+	opts.Aspects = &tiny
+	if _, err = PlanTiles(image.Point{X: 4096, Y: 2304}, opts); !errors.Is(
+		err, ErrNoTileSize) {
+		t.Error("missing tile size was not reported", err)
+	}
+}
+
+func TestTilePlanJSON(t *testing.T) {
+	aspects := NewAspectRatios(65536, 64, 128, 256)
+	opts := NewTileOpts()
+	opts.Aspects = &aspects
+	opts.Overlap = 64
+	opts.Falloff = MaskFalloff{Profile: MaskProfileCosine}
+	plan, err := PlanTiles(image.Point{X: 576, Y: 512}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TilePlan
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, plan) {
+		t.Error("plan does not round trip:", decoded, "!=", *plan)
+	}
+	var blend TileBlend
+	if err = json.Unmarshal([]byte(`"laplacian"`), &blend); err != nil ||
+		blend != TileBlendMultiBand {
+		t.Error("blend alias was not decoded", blend, err)
+	}
+	if err = json.Unmarshal([]byte(`"smudge"`), &blend); !errors.Is(err,
+		ErrUnknownTileBlend) {
+		t.Error("unknown blend was not reported", err)
+	}
+
+	// The first tile is kept whole away from its neighbours, and fades out
+	// towards them.
+	mask, err := plan.FeatherMask(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := plan.Tiles[0].Rect.Size()
+	if mask.Gray16At(0, 0).Y != 0xffff ||
+		mask.Gray16At(size.X-1, 0).Y > 0x1000 ||
+		mask.Gray16At(size.X-1, size.Y-1).Y == 0 {
+		t.Error("unexpected feather mask", mask.Gray16At(0, 0),
+			mask.Gray16At(size.X-1, 0))
+	}
+	if _, err = plan.FeatherMask(len(plan.Tiles)); err == nil {
+		t.Error("missing tile was not reported")
+	}
+}
+
+func TestTilePlanComposite(t *testing.T) {
+	imageData, err := ioutil.ReadFile("../resources/square.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, _, srcDim, err := DecodeImage(&imageData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aspects := NewAspectRatios(65536, 64, 128, 256)
+	for _, blend := range []TileBlend{TileBlendLinear, TileBlendMultiBand} {
+		opts := NewTileOpts()
+		opts.Aspects = &aspects
+		opts.Overlap = 64
+		opts.Blend = blend
+		opts.Scale = 2
+		plan, planErr := PlanTiles(*srcDim, opts)
+		if planErr != nil {
+			t.Fatal(planErr)
+		}
+		if len(plan.Tiles) < 4 {
+			t.Fatal(blend, "did not tile", len(plan.Tiles))
+		}
+
+		// Upscaled tiles of the source blend back into the upscaled source.
+		upscaled, runErr := plan.Run(source, func(index int,
+			tile *[]byte) (*[]byte, error) {
+			decoded, _, dim, decodeErr := DecodeImage(tile)
+			if decodeErr != nil {
+				return nil, decodeErr
+			}
+			if *dim != plan.Tiles[index].Size {
+				t.Error(blend, "tile", index, "is", *dim)
+			}
+			return EncodePng(imaging.Resize(decoded, 2*dim.X, 2*dim.Y,
+				imaging.Lanczos), 0)
+		})
+		if runErr != nil {
+			t.Fatal(runErr)
+		}
+		if upscaled.Bounds().Size() != srcDim.Mul(2) {
+			t.Fatal(blend, "composited", upscaled.Bounds().Size())
+		}
+		expected := imaging.Resize(source, 2*srcDim.X, 2*srcDim.Y,
+			imaging.Lanczos)
+		worst := 0
+		for y := 0; y < 2*srcDim.Y; y += 3 {
+			for x := 0; x < 2*srcDim.X; x += 3 {
+				worst = max(worst, colorDistance(upscaled.At(x, y),
+					expected.At(x, y)))
+			}
+		}
+		if worst > 2 {
+			t.Error(blend, "tiles differ from the source by", worst)
+		}
+
+		// Tiles generated in different tones are blended without a seam.
+		results := make([]image.Image, len(plan.Tiles))
+		for index, tile := range plan.Tiles {
+			tinted := image.NewNRGBA(image.Rectangle{Max: tile.Size})
+			level := uint8(100 + 40*(index%2) + 20*(index/plan.Columns))
+			for idx := range tinted.Pix {
+				tinted.Pix[idx] = level
+			}
+			results[index] = tinted
+		}
+		blended, compositeErr := plan.Composite(results)
+		if compositeErr != nil {
+			t.Fatal(compositeErr)
+		}
+		bounds := blended.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y += 5 {
+			for x := bounds.Min.X + 1; x < bounds.Max.X; x++ {
+				if step := colorDistance(blended.At(x-1, y),
+					blended.At(x, y)); step > 4 {
+					t.Fatal(blend, "has a seam of", step, "at", x, y)
+				}
+			}
+		}
+
+		results[0] = image.NewNRGBA(image.Rect(0, 0, 10, 30))
+		if _, compositeErr = plan.Composite(results); !errors.Is(
+			compositeErr, ErrGeometryMismatch) {
+			t.Error("mismatched tile was not reported", compositeErr)
+		}
+		if _, compositeErr = plan.Composite(results[1:]); compositeErr == nil {
+			t.Error("missing tiles were not reported")
+		}
+
+		if blend == TileBlendMultiBand {
+			os.MkdirAll(OutputDir, 0755)
+			encoded, encodeErr := EncodePng(upscaled, 0)
+			if encodeErr != nil {
+				t.Fatal(encodeErr)
+			}
+			if err = ioutil.WriteFile(OutputDir+"/tiled.png", *encoded,
+				0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}